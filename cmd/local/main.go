@@ -70,6 +70,7 @@ func runWithContext(ctx context.Context) error {
 	if err != nil {
 		return err
 	}
+	defer businessLogic.Close()
 
 	//// Prom. metrics
 	reg := prom.NewRegistry()
@@ -29,12 +29,19 @@ var options struct {
 	Port    int
 	TLSCert string
 	TLSKey  string
+
+	TLSCertFile string
+	TLSKeyFile  string
+	TLSClientCA string
 }
 
 func init() {
 	flag.IntVar(&options.Port, "port", 3000, "use '--port' option to specify the port for broker to listen on")
 	flag.StringVar(&options.TLSCert, "tlsCert", "", "base-64 encoded PEM block to use as the certificate for TLS. If '--tlsCert' is used, then '--tlsKey' must also be used. If '--tlsCert' is not used, then TLS will not be used.")
 	flag.StringVar(&options.TLSKey, "tlsKey", "", "base-64 encoded PEM block to use as the private key matching the TLS certificate. If '--tlsKey' is used, then '--tlsCert' must also be used")
+	flag.StringVar(&options.TLSCertFile, "tlsCertFile", "", "path to the PEM certificate to use for TLS, reread as it is rotated. Replaces '--tlsCert', and needs '--tlsKeyFile'.")
+	flag.StringVar(&options.TLSKeyFile, "tlsKeyFile", "", "path to the PEM private key matching '--tlsCertFile'")
+	flag.StringVar(&options.TLSClientCA, "tlsClientCA", "", "path to the PEM CA bundle client certificates must be signed by. If set, platforms must present a client certificate. Needs '--tlsCertFile'.")
 	cli.AddFlags(&options.Options)
 	flag.Parse()
 }
@@ -63,6 +70,20 @@ func runWithContext(ctx context.Context) error {
 		fmt.Println("To use TLS, both --tlsCert and --tlsKey must be used")
 		return nil
 	}
+	if (options.TLSCertFile != "" || options.TLSKeyFile != "") &&
+		(options.TLSCertFile == "" || options.TLSKeyFile == "") {
+		fmt.Println("To use TLS, both --tlsCertFile and --tlsKeyFile must be used")
+		return nil
+	}
+	if options.TLSClientCA != "" && options.TLSCertFile == "" {
+		fmt.Println("To require client certificates, --tlsCertFile and --tlsKeyFile must be used")
+		return nil
+	}
+	if options.ClientAuthz != "" && options.TLSClientCA == "" {
+		// Without a client CA no certificate is ever verified, and
+		// --clientAuthz would turn every platform away.
+		return fmt.Errorf("--clientAuthz needs --tlsClientCA to verify client certificates")
+	}
 
 	addr := ":" + strconv.Itoa(options.Port)
 
@@ -75,6 +96,9 @@ func runWithContext(ctx context.Context) error {
 	reg := prom.NewRegistry()
 	osbMetrics := metrics.New()
 	reg.MustRegister(osbMetrics)
+	if err := businessLogic.RegisterMetrics(reg); err != nil {
+		return err
+	}
 
 	api, err := rest.NewAPISurface(businessLogic, osbMetrics)
 	if err != nil {
@@ -88,9 +112,17 @@ func runWithContext(ctx context.Context) error {
 
 	businessLogic.AdditionalRouting(s.Router)
 
-	if options.TLSCert == "" && options.TLSKey == "" {
+	switch {
+	case options.TLSCertFile != "":
+		serverTLS, err := proxy.NewServerTLS(options.TLSCertFile, options.TLSKeyFile, options.TLSClientCA)
+		if err != nil {
+			return err
+		}
+		serverTLS.StartReload(options.CredentialsReload)
+		err = proxy.RunTLS(ctx, s.Router, addr, serverTLS.Config())
+	case options.TLSCert == "" && options.TLSKey == "":
 		err = s.Run(ctx, addr)
-	} else {
+	default:
 		err = s.RunTLS(ctx, addr, options.TLSCert, options.TLSKey)
 	}
 	return err
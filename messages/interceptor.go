@@ -0,0 +1,62 @@
+package messages
+
+import (
+	"context"
+
+	"github.com/golang/glog"
+)
+
+// VentInvoker publishes msg.
+type VentInvoker func(ctx context.Context, msg *Message) error
+
+// VentInterceptor wraps publishing a message. It may inspect or rewrite msg,
+// and must call invoker to continue publishing it.
+type VentInterceptor func(ctx context.Context, msg *Message, invoker VentInvoker) error
+
+// SinkHandler hands msg to the callback of the sink it was routed to.
+type SinkHandler func(ctx context.Context, msg *Message)
+
+// SinkInterceptor wraps the dispatch of a received message to sink. It may
+// inspect or rewrite msg, and must call handler to deliver it.
+type SinkInterceptor func(ctx context.Context, msg *Message, sink *Subscription, handler SinkHandler)
+
+// chainVent builds the invoker that runs interceptors in order around
+// invoker, so the first interceptor is the outermost.
+func chainVent(interceptors []VentInterceptor, invoker VentInvoker) VentInvoker {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], invoker
+		invoker = func(ctx context.Context, msg *Message) error {
+			return interceptor(ctx, msg, next)
+		}
+	}
+	return invoker
+}
+
+// chainSink builds the handler that runs interceptors in order around
+// handler, so the first interceptor is the outermost.
+func chainSink(interceptors []SinkInterceptor, sink *Subscription, handler SinkHandler) SinkHandler {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], handler
+		handler = func(ctx context.Context, msg *Message) {
+			interceptor(ctx, msg, sink, next)
+		}
+	}
+	return handler
+}
+
+// LoggingVentInterceptor logs every message that is published.
+func LoggingVentInterceptor(ctx context.Context, msg *Message, invoker VentInvoker) error {
+	glog.Info("Vent ", msg.ID, " ", msg.Event)
+	if err := invoker(ctx, msg); err != nil {
+		glog.Errorf("could not publish message %s: %v", msg.ID, err)
+		return err
+	}
+	glog.Info("message published ", msg.ID)
+	return nil
+}
+
+// LoggingSinkInterceptor logs every message that is dispatched to a sink.
+func LoggingSinkInterceptor(ctx context.Context, msg *Message, sink *Subscription, handler SinkHandler) {
+	glog.Info("Processing  ", msg.ID, " for sink ", sink.Key, ": ", string(msg.Body))
+	handler(ctx, msg)
+}
@@ -0,0 +1,34 @@
+package messages
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestInterceptorOrder(t *testing.T) {
+	var calls []string
+	vent := func(name string) VentInterceptor {
+		return func(ctx context.Context, msg *Message, invoker VentInvoker) error {
+			calls = append(calls, name)
+			msg.Event += "+" + name
+			return invoker(ctx, msg)
+		}
+	}
+
+	var published *Message
+	invoker := chainVent([]VentInterceptor{vent("outer"), vent("inner")}, func(ctx context.Context, msg *Message) error {
+		published = msg
+		return nil
+	})
+	if err := invoker(context.Background(), &Message{Event: "Provision"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{"outer", "inner"}; !reflect.DeepEqual(calls, want) {
+		t.Errorf("expected interceptors to run as %v, got %v", want, calls)
+	}
+	if want := "Provision+outer+inner"; published.Event != want {
+		t.Errorf("expected published event %q, got %q", want, published.Event)
+	}
+}
@@ -0,0 +1,117 @@
+package messages
+
+import (
+	"net/http"
+	"time"
+
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	"github.com/pmorie/osb-broker-lib/pkg/broker"
+)
+
+// CatalogRequest is the empty request body of GetCatalog.
+type CatalogRequest struct{}
+
+// The OSB operations that are tunneled between the proxy and the local side.
+// Adding an operation only requires declaring it here; the proxy calls it
+// with Call and the local Server picks it up from the registry.
+var (
+	GetCatalog = NewOperation("GetCatalog", func(b broker.Interface, _ *CatalogRequest, c *broker.RequestContext) (*broker.CatalogResponse, error) {
+		return b.GetCatalog(c)
+	})
+	Provision     = NewOperation("Provision", broker.Interface.Provision)
+	Deprovision   = NewOperation("Deprovision", broker.Interface.Deprovision)
+	LastOperation = NewOperation("LastOperation", broker.Interface.LastOperation)
+	Bind          = NewOperation("Bind", broker.Interface.Bind)
+	Unbind        = NewOperation("Unbind", broker.Interface.Unbind)
+	Update        = NewOperation("Update", broker.Interface.Update)
+)
+
+// InstanceRetriever is implemented by brokers that can fetch a service
+// instance. broker.Interface does not cover it.
+type InstanceRetriever interface {
+	GetInstance(request *osb.GetInstanceRequest, c *broker.RequestContext) (*osb.GetInstanceResponse, error)
+}
+
+// BindingRetriever is implemented by brokers that can fetch a service
+// binding. broker.Interface does not cover it.
+type BindingRetriever interface {
+	GetBinding(request *osb.GetBindingRequest, c *broker.RequestContext) (*osb.GetBindingResponse, error)
+}
+
+// BindingOperationPoller is implemented by brokers that can bind and unbind
+// asynchronously. broker.Interface only polls instance operations.
+type BindingOperationPoller interface {
+	BindingLastOperation(request *osb.BindingLastOperationRequest, c *broker.RequestContext) (*broker.LastOperationResponse, error)
+}
+
+// The optional operations, served when the broker implements them.
+var (
+	GetInstance = NewOperation("GetInstance", func(b broker.Interface, r *osb.GetInstanceRequest, c *broker.RequestContext) (*osb.GetInstanceResponse, error) {
+		retriever, ok := b.(InstanceRetriever)
+		if !ok {
+			return nil, notImplemented("GetInstance")
+		}
+		return retriever.GetInstance(r, c)
+	})
+	GetBinding = NewOperation("GetBinding", func(b broker.Interface, r *osb.GetBindingRequest, c *broker.RequestContext) (*osb.GetBindingResponse, error) {
+		retriever, ok := b.(BindingRetriever)
+		if !ok {
+			return nil, notImplemented("GetBinding")
+		}
+		return retriever.GetBinding(r, c)
+	})
+	BindingLastOperation = NewOperation("BindingLastOperation", func(b broker.Interface, r *osb.BindingLastOperationRequest, c *broker.RequestContext) (*broker.LastOperationResponse, error) {
+		poller, ok := b.(BindingOperationPoller)
+		if !ok {
+			return nil, notImplemented("BindingLastOperation")
+		}
+		return poller.BindingLastOperation(r, c)
+	})
+)
+
+// HealthRequest is the empty request body of Health.
+type HealthRequest struct{}
+
+// HealthResponse is the health of the brokers behind the local side.
+type HealthResponse struct {
+	Backends []BackendHealth `json:"backends"`
+}
+
+// BackendHealth is the health of a broker, which is healthy while any of its
+// replicas is.
+type BackendHealth struct {
+	Name     string          `json:"name"`
+	Healthy  bool            `json:"healthy"`
+	Replicas []ReplicaHealth `json:"replicas"`
+}
+
+// ReplicaHealth is the health of one replica of a broker.
+type ReplicaHealth struct {
+	URL       string    `json:"url"`
+	Healthy   bool      `json:"healthy"`
+	LastCheck time.Time `json:"lastCheck,omitempty"`
+	LastError string    `json:"lastError,omitempty"`
+}
+
+// HealthReporter is implemented by local sides that report the health of
+// their brokers to the proxy.
+type HealthReporter interface {
+	Health(request *HealthRequest, c *broker.RequestContext) (*HealthResponse, error)
+}
+
+// Health asks the local side how its brokers are doing.
+var Health = NewOperation("Health", func(b broker.Interface, r *HealthRequest, c *broker.RequestContext) (*HealthResponse, error) {
+	reporter, ok := b.(HealthReporter)
+	if !ok {
+		return nil, notImplemented("Health")
+	}
+	return reporter.Health(r, c)
+})
+
+func notImplemented(name string) error {
+	description := name + " is not supported by the broker"
+	return osb.HTTPStatusCodeError{
+		StatusCode:  http.StatusNotImplemented,
+		Description: &description,
+	}
+}
@@ -0,0 +1,70 @@
+package messages
+
+import (
+	"context"
+	"fmt"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/golang/glog"
+	"google.golang.org/api/option"
+)
+
+// pubsubTransport publishes to a Pub/Sub topic and receives from a
+// subscription on the other side's topic.
+type pubsubTransport struct {
+	client       *pubsub.Client
+	topic        *pubsub.Topic
+	subscription *pubsub.Subscription
+}
+
+// NewPubSubTransport wraps a pub/sub topic and subscription. Without opts,
+// the client uses the application default credentials.
+func NewPubSubTransport(projectID, topic, subscription string, opts ...option.ClientOption) (Transport, error) {
+	ctx := context.Background()
+
+	client, err := pubsub.NewClient(ctx, projectID, opts...)
+	if err != nil {
+		glog.Error("failed to create client, ", err)
+		return nil, err
+	}
+
+	clientTopic := client.Topic(topic)
+	if _, err := clientTopic.Exists(ctx); err != nil {
+		glog.Error("failed to verify topic exists: ", err)
+		return nil, err
+	}
+
+	clientSubscription := client.Subscription(subscription)
+	if ok, err := clientSubscription.Exists(ctx); err != nil || !ok {
+		glog.Error("failed to create client subscription, exists: ", ok, " error: ", err)
+		if err == nil {
+			err = fmt.Errorf("subscription %s does not exist", subscription)
+		}
+		return nil, err
+	}
+
+	return &pubsubTransport{
+		client:       client,
+		topic:        clientTopic,
+		subscription: clientSubscription,
+	}, nil
+}
+
+func (t *pubsubTransport) Publish(ctx context.Context, data []byte) error {
+	_, err := t.topic.Publish(ctx, &pubsub.Message{Data: data}).Get(ctx)
+	return err
+}
+
+func (t *pubsubTransport) Receive(ctx context.Context, f func(ctx context.Context, d Delivery)) error {
+	return t.subscription.Receive(ctx, func(ctx context.Context, msg *pubsub.Message) {
+		f(ctx, pubsubDelivery{msg: msg})
+	})
+}
+
+type pubsubDelivery struct {
+	msg *pubsub.Message
+}
+
+func (d pubsubDelivery) Data() []byte { return d.msg.Data }
+func (d pubsubDelivery) Ack()         { d.msg.Ack() }
+func (d pubsubDelivery) Nack()        { d.msg.Nack() }
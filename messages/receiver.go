@@ -0,0 +1,159 @@
+package messages
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// ReceiverState is the state of the registry's receive stream.
+type ReceiverState int
+
+const (
+	// ReceiverIdle means the stream has not been started.
+	ReceiverIdle ReceiverState = iota
+	// ReceiverReceiving means the stream is open and dispatching messages.
+	ReceiverReceiving
+	// ReceiverBackoff means the stream failed and is waiting to reconnect.
+	ReceiverBackoff
+	// ReceiverStopped means the stream was stopped and will not reconnect.
+	ReceiverStopped
+)
+
+func (s ReceiverState) String() string {
+	switch s {
+	case ReceiverIdle:
+		return "idle"
+	case ReceiverReceiving:
+		return "receiving"
+	case ReceiverBackoff:
+		return "backoff"
+	case ReceiverStopped:
+		return "stopped"
+	}
+	return "unknown"
+}
+
+// ReceiverStatus describes the receive stream at a point in time.
+type ReceiverStatus struct {
+	State ReceiverState
+	// Since is when the stream entered State.
+	Since time.Time
+	// Reconnects counts how often the stream has been reopened after failing.
+	Reconnects int
+	// LastError is the error that most recently closed the stream.
+	LastError error
+}
+
+// Status returns the current state of the receive stream.
+func (r *Registry) Status() ReceiverStatus {
+	r.statusMutex.RLock()
+	defer r.statusMutex.RUnlock()
+	return r.status
+}
+
+func (r *Registry) setState(state ReceiverState, err error) {
+	r.statusMutex.Lock()
+	defer r.statusMutex.Unlock()
+	if state == ReceiverReceiving && r.status.State == ReceiverBackoff {
+		r.status.Reconnects++
+	}
+	if err != nil {
+		r.status.LastError = err
+	}
+	r.status.State = state
+	r.status.Since = time.Now()
+}
+
+// Start opens the receive stream. The stream stays open until Stop is called,
+// reconnecting with backoff whenever it fails. Calling Start more than once
+// has no effect.
+func (r *Registry) Start() {
+	r.startOnce.Do(func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		r.stop = cancel
+		go r.receive(ctx)
+	})
+}
+
+// Stop closes the receive stream.
+func (r *Registry) Stop() {
+	r.Start()
+	r.stop()
+}
+
+func (r *Registry) receive(ctx context.Context) {
+	glog.Info("starting receiver")
+
+	backoff := r.MinBackoff
+	for {
+		var received int32
+		r.setState(ReceiverReceiving, nil)
+		err := r.transport.Receive(ctx, func(ctx context.Context, d Delivery) {
+			atomic.StoreInt32(&received, 1)
+			r.dispatch(ctx, d)
+		})
+		if ctx.Err() != nil {
+			break
+		}
+		if err == nil {
+			err = errors.New("receive stream closed")
+		}
+		if atomic.LoadInt32(&received) == 1 {
+			backoff = r.MinBackoff
+		}
+
+		glog.Errorf("receiver failed, reconnecting in %s: %v", backoff, err)
+		r.setState(ReceiverBackoff, err)
+		select {
+		case <-ctx.Done():
+		case <-time.After(backoff):
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		backoff *= 2
+		if backoff > r.MaxBackoff {
+			backoff = r.MaxBackoff
+		}
+	}
+
+	r.setState(ReceiverStopped, nil)
+	glog.Info("receiver stopped")
+}
+
+// dispatch hands a delivery to the sink registered for its ID, or failing
+// that, for its event.
+func (r *Registry) dispatch(ctx context.Context, d Delivery) {
+	message := &Message{}
+	if err := json.Unmarshal(d.Data(), message); err != nil {
+		glog.Error(err)
+		// ack because you can never deal with this message
+		d.Ack()
+		return
+	}
+
+	r.sinkMutex.RLock()
+	s := r.sinks[message.ID]
+	if s == nil {
+		s = r.sinks[message.Event]
+	}
+	r.sinkMutex.RUnlock()
+
+	// Messages nobody is waiting for are garbage, redelivering them will not help.
+	d.Ack()
+	if s == nil {
+		glog.Info("no sink for ", message.ID, " ", message.Event)
+		return
+	}
+
+	handler := chainSink(r.SinkInterceptors, s, func(ctx context.Context, msg *Message) {
+		s.Callback(msg)
+	})
+	go handler(ctx, message)
+}
@@ -5,209 +5,223 @@ import (
 	"time"
 
 	"encoding/json"
+	"errors"
 
 	"fmt"
 
-	"cloud.google.com/go/pubsub"
 	"github.com/golang/glog"
 	"github.com/pborman/uuid"
+	"google.golang.org/api/option"
 )
 
 const DefaultWaitForTimeoutSec = 30
-const DefaultSinkPollTimeSec = 5
+const DefaultWaitForMaxTimeoutSec = 600
+const DefaultMinBackoff = time.Second
+const DefaultMaxBackoff = time.Minute
 
 // NewRegistry wraps a pub/sub topic and subscription.
-func NewRegistry(projectID, topic, subscription string) (*Registry, error) {
-
-	ctx := context.Background()
-
-	client, err := pubsub.NewClient(ctx, projectID)
+func NewRegistry(projectID, topic, subscription string, opts ...option.ClientOption) (*Registry, error) {
+	transport, err := NewPubSubTransport(projectID, topic, subscription, opts...)
 	if err != nil {
-		glog.Fatal("failed to create client, ", err)
-		return nil, err
-	}
-
-	clientTopic := client.Topic(topic)
-	if _, err := clientTopic.Exists(ctx); err != nil {
-		glog.Fatal("failed to verify topic exists: ", err)
 		return nil, err
 	}
+	return NewRegistryWithTransport(transport), nil
+}
 
-	clientSubscription := client.Subscription(subscription)
-	if ok, err := clientSubscription.Exists(ctx); err != nil || !ok {
-		glog.Fatal("failed to create client subscription, exists: ", ok, " error: ", err)
-		return nil, err
-	}
+// NewRegistryWithTransport returns a Registry that sends and receives on
+// transport.
+func NewRegistryWithTransport(transport Transport) *Registry {
+	return &Registry{
+		WaitForTimeout:    time.Second * DefaultWaitForTimeoutSec,
+		WaitForMaxTimeout: time.Second * DefaultWaitForMaxTimeoutSec,
+		MinBackoff:        DefaultMinBackoff,
+		MaxBackoff:        DefaultMaxBackoff,
 
-	r := &Registry{
-		WaitForTimeout: time.Second * DefaultWaitForTimeoutSec,
-		SinkPollTime:   time.Second * DefaultSinkPollTimeSec,
+		VentInterceptors: []VentInterceptor{LoggingVentInterceptor},
+		SinkInterceptors: []SinkInterceptor{LoggingSinkInterceptor},
 
-		client:       client,
-		topic:        clientTopic,
-		subscription: clientSubscription,
+		transport: transport,
 
 		sinks: make(map[string]*Subscription, 10),
 	}
-	return r, nil
 }
 
 func (r *Registry) Vent(event string, body interface{}) (*string, error) {
 	id := uuid.NewUUID().String()
-
-	glog.Info("Vent ", id)
-
 	return r.vent(id, event, body)
 }
 
 func (r *Registry) VentWith(id, event string, body interface{}) (*string, error) {
-	glog.Info("VentWith ", id)
 	return r.vent(id, event, body)
 }
 
-func (r *Registry) vent(id, event string, body interface{}) (*string, error) {
+func (r *Registry) vent(id, event string, body interface{}, opts ...MessageOption) (*string, error) {
 	ctx := context.Background()
 
-	json, err := json.Marshal(Message{
-		ID:    id,
-		Event: event,
-		Body:  body,
-	})
+	data, err := json.Marshal(body)
 	if err != nil {
 		glog.Errorf("failed to marshal body: %v", err)
 		return nil, err
 	}
 
-	msg := &pubsub.Message{Data: json}
-
-	if _, err := r.topic.Publish(ctx, msg).Get(ctx); err != nil {
-		glog.Errorf("could not publish message: %v", err)
+	msg := &Message{
+		ID:    id,
+		Event: event,
+		Body:  data,
+	}
+	for _, opt := range opts {
+		opt(msg)
+	}
+	if err := chainVent(r.VentInterceptors, r.publish)(ctx, msg); err != nil {
 		return nil, err
 	}
 
-	glog.Info("message published to ", r.topic.String())
-
 	return &id, nil
 }
 
-func (r *Registry) SinkWorker() {
-	ctx := context.Background()
-
-	r.sinkMutex.Lock()
-	if !r.sinking {
-		r.sinking = true
-	} else {
-		return
-	}
-	r.sinkMutex.Unlock()
-
-	glog.Info("starting sink worker")
-
-	cctx, cancel := context.WithCancel(ctx)
-	for {
-		select {
-		case <-ctx.Done():
-			glog.Info("worker quit")
-			return
-		case <-time.After(r.SinkPollTime):
-			if len(r.sinks) == 0 {
-				glog.Info("no sinks, cancel")
-				cancel()
-				continue
-			}
-			err := r.subscription.Receive(cctx, func(ctx context.Context, msg *pubsub.Message) {
-				//r.sinkMutex.Lock()
-				//defer r.sinkMutex.Unlock()
-
-				glog.Info("Got message: ", string(msg.Data))
-
-				// TODO: I am not sure about this
-				if msg.ID == "abort" {
-					cancel()
-				}
-
-				message := &Message{}
-				err := json.Unmarshal(msg.Data, message)
-				if err != nil {
-					glog.Error(err)
-					// ack because you can never deal with this message
-					msg.Ack()
-					return
-				}
-
-				glog.Info("Processing  ", message.ID)
-				if s := r.sinks[message.ID]; s != nil {
-					msg.Ack()
-					go s.Callback(message.ID, message.Body)
-				} else if s := r.sinks[message.Event]; s != nil {
-					msg.Ack()
-					go s.Callback(message.ID, message.Body)
-				} else {
-					//msg.Nack()
-					msg.Ack() // for now, if the message was random garbage then we get here and retry...
-				}
-			})
-			if err != nil {
-				glog.Error(err)
-				// TODO: cancel here too?
-				return
-			}
-		}
+func (r *Registry) publish(ctx context.Context, msg *Message) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
 	}
-	r.sinkMutex.Lock()
-	r.sinking = false
-	r.sinkMutex.Unlock()
-
-	glog.Info("sink worker done")
+	return r.transport.Publish(ctx, data)
 }
 
-// Skin will watch the subscription for messages with a matching event and call the callback with the body of the message.
+// Sink will watch the subscription for messages with a matching event and call the callback with the body of the message.
 func (r *Registry) Sink(key string, callback Callback) error {
-	// TODO: add some more validation handling here.
+	r.sinkMutex.Lock()
+	defer r.sinkMutex.Unlock()
+
 	if r.sinks[key] != nil {
 		return fmt.Errorf("error: sink exists for %s", key)
 	}
-	sink := &Subscription{
+	r.sinks[key] = &Subscription{
 		Key:      key,
 		Callback: callback,
 	}
-	r.sinks[key] = sink
-	if !r.sinking {
-		go r.SinkWorker()
-	}
+	r.Start()
 	glog.Info("sink added for ", key)
 	return nil
 }
 
 func (r *Registry) RemoveSink(key string) {
+	r.sinkMutex.Lock()
+	defer r.sinkMutex.Unlock()
+
 	if r.sinks[key] != nil {
 		glog.Info("sink removed for ", key)
 		delete(r.sinks, key)
 	}
 }
 
+// ErrTimeout is returned when no reply arrived in time.
+var ErrTimeout = errors.New("timeout")
+
+// Request vents body as event and waits for the reply. Unlike Vent followed
+// by WaitFor, the reply cannot arrive before anyone is waiting for it.
+func (r *Registry) Request(event string, body interface{}) (json.RawMessage, error) {
+	return r.RequestWithTimeout(event, body, r.WaitForTimeout)
+}
+
+// RequestWithTimeout is Request waiting for timeout instead of WaitForTimeout.
+// opts set envelope fields of the request message.
+func (r *Registry) RequestWithTimeout(event string, body interface{}, timeout time.Duration, opts ...MessageOption) (json.RawMessage, error) {
+	id := uuid.NewUUID().String()
+
+	w, err := r.expect(id)
+	if err != nil {
+		return nil, err
+	}
+	defer r.forget(w)
+
+	if _, err := r.vent(id, event, body, opts...); err != nil {
+		return nil, err
+	}
+	return r.await(w, timeout)
+}
+
 // WaitFor will block until a message arrives with the matching id provided
-func (r *Registry) WaitFor(id string) (interface{}, error) {
-	response := make(chan interface{})
+// and returns the raw body of that message. Heartbeats for the id extend the
+// wait by WaitForTimeout each, up to WaitForMaxTimeout in total.
+func (r *Registry) WaitFor(id string) (json.RawMessage, error) {
+	w, err := r.expect(id)
+	if err != nil {
+		return nil, err
+	}
+	defer r.forget(w)
 
-	r.Sink(id, func(event string, body interface{}) {
-		glog.Info("WaitFor ", id, " got ", body)
-		response <- body
+	return r.await(w, r.WaitForTimeout)
+}
+
+// Heartbeat tells whoever waits for id that the request is still being
+// worked on.
+func (r *Registry) Heartbeat(id string, progress Progress) error {
+	_, err := r.vent(id, HeartbeatEvent, progress)
+	return err
+}
+
+// waiter collects the messages sent for one request id.
+type waiter struct {
+	id       string
+	messages chan *Message
+	done     chan struct{}
+}
+
+func (r *Registry) expect(id string) (*waiter, error) {
+	w := &waiter{
+		id:       id,
+		messages: make(chan *Message),
+		done:     make(chan struct{}),
+	}
+	err := r.Sink(id, func(msg *Message) {
+		select {
+		case w.messages <- msg:
+		case <-w.done:
+			// the waiter already has its answer or gave up.
+		}
 	})
+	return w, err
+}
 
-	var resp interface{}
-	var err error
-	select {
-	case resp = <-response:
-		glog.Info(id, " response received ", resp)
-	case <-time.After(r.WaitForTimeout):
-		glog.Error(id, " - timeout")
-		err = fmt.Errorf("timeout")
+func (r *Registry) forget(w *waiter) {
+	r.RemoveSink(w.id)
+	close(w.done)
+}
+
+// await waits timeout for the reply to w, extending the wait by timeout on
+// each heartbeat up to WaitForMaxTimeout, or timeout if that is longer.
+func (r *Registry) await(w *waiter, timeout time.Duration) (json.RawMessage, error) {
+	longest := r.WaitForMaxTimeout
+	if timeout > longest {
+		longest = timeout
 	}
+	limit := time.Now().Add(longest)
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
 
-	r.RemoveSink(id)
+	for {
+		select {
+		case msg := <-w.messages:
+			if msg.Event != HeartbeatEvent {
+				return msg.Body, nil
+			}
 
-	return resp, err
+			deadline := time.Now().Add(timeout)
+			if deadline.After(limit) {
+				deadline = limit
+			}
+			glog.Info(w.id, " heartbeat, waiting until ", deadline)
+			timer.Stop()
+			select {
+			case <-timer.C:
+			default:
+			}
+			timer.Reset(time.Until(deadline))
+		case <-timer.C:
+			glog.Error(w.id, " - timeout")
+			return nil, ErrTimeout
+		}
+	}
 }
 
 // topic string, subscription string
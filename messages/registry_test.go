@@ -0,0 +1,165 @@
+package messages
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	"github.com/pmorie/osb-broker-lib/pkg/broker"
+)
+
+// catalogBroker only answers GetCatalog.
+type catalogBroker struct {
+	broker.Interface
+}
+
+func (catalogBroker) GetCatalog(c *broker.RequestContext) (*broker.CatalogResponse, error) {
+	return &broker.CatalogResponse{
+		CatalogResponse: osb.CatalogResponse{
+			Services: []osb.Service{{ID: "service", Name: "service"}},
+		},
+	}, nil
+}
+
+// pollingTransport reproduces the SinkWorker design this package used to
+// have: the subscription is only pulled every poll interval, and a pull is
+// cancelled once it has delivered a message.
+type pollingTransport struct {
+	Transport
+	poll time.Duration
+}
+
+func (t pollingTransport) Receive(ctx context.Context, f func(ctx context.Context, d Delivery)) error {
+	select {
+	case <-time.After(t.poll):
+	case <-ctx.Done():
+		return nil
+	}
+	rctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	return t.Transport.Receive(rctx, func(ctx context.Context, d Delivery) {
+		cancel()
+		f(ctx, d)
+	})
+}
+
+func newTunnel(wrap func(Transport) Transport) (*Client, func()) {
+	proxySide, localSide := NewPipe()
+
+	proxy := NewRegistryWithTransport(wrap(proxySide))
+	proxy.MinBackoff = 0
+	local := NewRegistryWithTransport(wrap(localSide))
+	local.MinBackoff = 0
+
+	NewServer(local, catalogBroker{}).Register()
+	proxy.Start()
+
+	return NewClient(proxy), func() {
+		proxy.Stop()
+		local.Stop()
+	}
+}
+
+func benchmarkRoundTrip(b *testing.B, wrap func(Transport) Transport) {
+	client, stop := newTunnel(wrap)
+	defer stop()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := Call(client, GetCatalog, &CatalogRequest{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkRoundTripStreaming(b *testing.B) {
+	benchmarkRoundTrip(b, func(t Transport) Transport {
+		return t
+	})
+}
+
+func BenchmarkRoundTripPolling(b *testing.B) {
+	benchmarkRoundTrip(b, func(t Transport) Transport {
+		return pollingTransport{Transport: t, poll: 10 * time.Millisecond}
+	})
+}
+
+// flakyTransport fails the first failures calls to Receive.
+type flakyTransport struct {
+	Transport
+	failures int32
+}
+
+func (t *flakyTransport) Receive(ctx context.Context, f func(ctx context.Context, d Delivery)) error {
+	if atomic.AddInt32(&t.failures, -1) >= 0 {
+		return errors.New("stream reset")
+	}
+	return t.Transport.Receive(ctx, f)
+}
+
+func TestReceiverReconnects(t *testing.T) {
+	transport, _ := NewPipe()
+	reg := NewRegistryWithTransport(&flakyTransport{Transport: transport, failures: 3})
+	reg.MinBackoff = time.Millisecond
+	reg.MaxBackoff = 2 * time.Millisecond
+
+	reg.Start()
+	defer reg.Stop()
+
+	deadline := time.Now().Add(time.Second)
+	for reg.Status().Reconnects < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected 3 reconnects, got %+v", reg.Status())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if status := reg.Status(); status.State != ReceiverReceiving || status.LastError == nil {
+		t.Errorf("expected receiving with the last error kept, got %+v", status)
+	}
+}
+
+// slowBroker takes delay to answer GetCatalog.
+type slowBroker struct {
+	catalogBroker
+	delay time.Duration
+}
+
+func (b slowBroker) GetCatalog(c *broker.RequestContext) (*broker.CatalogResponse, error) {
+	time.Sleep(b.delay)
+	return b.catalogBroker.GetCatalog(c)
+}
+
+func TestHeartbeatsExtendWait(t *testing.T) {
+	cases := []struct {
+		name    string
+		maxWait time.Duration
+		wantErr bool
+	}{
+		{name: "within max wait", maxWait: time.Second},
+		{name: "past max wait", maxWait: 40 * time.Millisecond, wantErr: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			proxySide, localSide := NewPipe()
+			proxy := NewRegistryWithTransport(proxySide)
+			proxy.WaitForTimeout = 20 * time.Millisecond
+			proxy.WaitForMaxTimeout = tc.maxWait
+			local := NewRegistryWithTransport(localSide)
+			defer proxy.Stop()
+			defer local.Stop()
+
+			server := NewServer(local, slowBroker{delay: 100 * time.Millisecond})
+			server.HeartbeatInterval = 5 * time.Millisecond
+			server.Register()
+
+			_, err := Call(NewClient(proxy), GetCatalog, &CatalogRequest{})
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Errorf("expected error %v, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
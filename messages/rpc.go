@@ -0,0 +1,301 @@
+package messages
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/golang/glog"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	"github.com/pmorie/osb-broker-lib/pkg/broker"
+)
+
+// Operation is a single OSB call that can be made through the tunnel. Req and
+// Resp are the concrete types carried in the request and reply bodies, so a
+// caller passing the wrong request type is a compile error.
+type Operation[Req, Resp any] struct {
+	Name string
+
+	serve func(b broker.Interface, request *Req, c *broker.RequestContext) (*Resp, error)
+}
+
+// handler is the untyped view of an Operation that the Server uses to decode
+// and dispatch the messages it receives.
+type handler interface {
+	name() string
+	handle(b broker.Interface, body json.RawMessage, c *broker.RequestContext) (interface{}, error)
+}
+
+// operations is the registry of every declared Operation, keyed by name.
+var operations = map[string]handler{}
+
+// NewOperation declares an operation and adds it to the registry. serve is
+// what the local side runs against its broker.Interface when a request for
+// the operation arrives. Declaring two operations with the same name panics.
+func NewOperation[Req, Resp any](name string, serve func(broker.Interface, *Req, *broker.RequestContext) (*Resp, error)) Operation[Req, Resp] {
+	if _, ok := operations[name]; ok {
+		panic(fmt.Sprintf("messages: operation %s declared twice", name))
+	}
+	op := Operation[Req, Resp]{
+		Name:  name,
+		serve: serve,
+	}
+	operations[name] = op
+	return op
+}
+
+func (o Operation[Req, Resp]) name() string {
+	return o.Name
+}
+
+func (o Operation[Req, Resp]) handle(b broker.Interface, body json.RawMessage, c *broker.RequestContext) (interface{}, error) {
+	request := new(Req)
+	if len(body) != 0 {
+		if err := json.Unmarshal(body, request); err != nil {
+			return nil, badRequest(fmt.Sprintf("failed to decode %s request: %v", o.Name, err))
+		}
+	}
+	return o.serve(b, request, c)
+}
+
+// Reply is the body of the message sent back for a request.
+type Reply struct {
+	Response json.RawMessage `json:"response,omitempty"`
+	Error    *RemoteError    `json:"error,omitempty"`
+}
+
+// RemoteError carries an error returned by the remote broker across the
+// tunnel. OSB status code errors keep their status code so the proxy can
+// return the same status to the platform.
+type RemoteError struct {
+	StatusCode   int     `json:"statusCode,omitempty"`
+	ErrorMessage *string `json:"errorMessage,omitempty"`
+	Description  *string `json:"description,omitempty"`
+	Message      string  `json:"message"`
+}
+
+func (e *RemoteError) Error() string {
+	return e.Message
+}
+
+// Err converts the remote error back into the error the remote broker
+// returned.
+func (e *RemoteError) Err() error {
+	if e.StatusCode == 0 {
+		return errors.New(e.Message)
+	}
+	return osb.HTTPStatusCodeError{
+		StatusCode:   e.StatusCode,
+		ErrorMessage: e.ErrorMessage,
+		Description:  e.Description,
+	}
+}
+
+func newRemoteError(err error) *RemoteError {
+	if err == nil {
+		return nil
+	}
+	remote := &RemoteError{
+		Message: err.Error(),
+	}
+	if httpErr, ok := osb.IsHTTPError(err); ok {
+		remote.StatusCode = httpErr.StatusCode
+		remote.ErrorMessage = httpErr.ErrorMessage
+		remote.Description = httpErr.Description
+	}
+	return remote
+}
+
+func badRequest(description string) error {
+	return osb.HTTPStatusCodeError{
+		StatusCode:  http.StatusBadRequest,
+		Description: &description,
+	}
+}
+
+// Client makes typed calls to the remote side through a Registry.
+type Client struct {
+	reg *Registry
+}
+
+// NewClient returns a Client that vents requests and waits for the replies
+// on reg.
+func NewClient(reg *Registry) *Client {
+	return &Client{
+		reg: reg,
+	}
+}
+
+// CallOptions tune a single Call.
+type CallOptions struct {
+	// Timeout replaces the registry's WaitForTimeout when set.
+	Timeout time.Duration
+	// APIVersion is the platform's OSB API version, passed on to the remote
+	// broker. Empty leaves it to the remote side.
+	APIVersion string
+	// Headers are passed on to the remote broker.
+	Headers map[string]string
+}
+
+// CallOption sets one of the CallOptions.
+type CallOption func(*CallOptions)
+
+// WithTimeout makes the call wait d for the reply.
+func WithTimeout(d time.Duration) CallOption {
+	return func(o *CallOptions) {
+		o.Timeout = d
+	}
+}
+
+// WithAPIVersion makes the remote side call its broker with version.
+func WithAPIVersion(version string) CallOption {
+	return func(o *CallOptions) {
+		o.APIVersion = version
+	}
+}
+
+// WithHeaders makes the remote side call its broker with headers.
+func WithHeaders(headers map[string]string) CallOption {
+	return func(o *CallOptions) {
+		o.Headers = headers
+	}
+}
+
+// Call sends request for op to the remote side and blocks until the reply
+// arrives or the call times out.
+func Call[Req, Resp any](c *Client, op Operation[Req, Resp], request *Req, opts ...CallOption) (*Resp, error) {
+	options := CallOptions{
+		Timeout: c.reg.WaitForTimeout,
+	}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	body, err := c.reg.RequestWithTimeout(op.Name, request, options.Timeout, func(msg *Message) {
+		msg.APIVersion = options.APIVersion
+		msg.Headers = options.Headers
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var reply Reply
+	if err := json.Unmarshal(body, &reply); err != nil {
+		glog.Error(err)
+		return nil, err
+	}
+
+	if reply.Error != nil {
+		return nil, reply.Error.Err()
+	}
+
+	response := new(Resp)
+	if len(reply.Response) != 0 {
+		if err := json.Unmarshal(reply.Response, response); err != nil {
+			glog.Error(err)
+			return nil, err
+		}
+	}
+	return response, nil
+}
+
+// DefaultHeartbeatInterval is how often a Server reports progress on a
+// request it is still serving.
+const DefaultHeartbeatInterval = 10 * time.Second
+
+// Server answers requests from the remote side by dispatching each
+// registered operation to a broker.Interface.
+type Server struct {
+	// HeartbeatInterval is how often a heartbeat is sent while a request is
+	// being served.
+	HeartbeatInterval time.Duration
+
+	reg    *Registry
+	broker broker.Interface
+}
+
+// NewServer returns a Server that serves requests arriving on reg with b.
+func NewServer(reg *Registry, b broker.Interface) *Server {
+	return &Server{
+		HeartbeatInterval: DefaultHeartbeatInterval,
+
+		reg:    reg,
+		broker: b,
+	}
+}
+
+// Register adds a sink for every declared operation.
+func (s *Server) Register() error {
+	for name, h := range operations {
+		if err := s.reg.Sink(name, s.serve(h)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Server) serve(h handler) Callback {
+	return func(msg *Message) {
+		glog.Info("serving ", h.name(), " ", msg.ID)
+
+		stop := s.heartbeat(msg.ID, h.name())
+		var reply Reply
+		response, err := s.handle(h, msg)
+		stop()
+		if err != nil {
+			reply.Error = newRemoteError(err)
+		} else if reply.Response, err = json.Marshal(response); err != nil {
+			reply.Error = newRemoteError(err)
+		}
+
+		if _, err := s.reg.VentWith(msg.ID, h.name(), reply); err != nil {
+			glog.Errorf("failed to reply to %s %s: %v", h.name(), msg.ID, err)
+		}
+	}
+}
+
+// handle serves msg with h. The broker sees the envelope as the headers of
+// the request in its broker.RequestContext, and validates the API version
+// first, the way the broker library does for HTTP requests.
+func (s *Server) handle(h handler, msg *Message) (interface{}, error) {
+	request := &http.Request{Header: http.Header{}}
+	for key, value := range msg.Headers {
+		request.Header.Set(key, value)
+	}
+	if msg.APIVersion != "" {
+		if err := s.broker.ValidateBrokerAPIVersion(msg.APIVersion); err != nil {
+			return nil, err
+		}
+		request.Header.Set(osb.APIVersionHeader, msg.APIVersion)
+	}
+	return h.handle(s.broker, msg.Body, &broker.RequestContext{Request: request})
+}
+
+// heartbeat sends heartbeats for id until the returned func is called.
+func (s *Server) heartbeat(id, event string) func() {
+	done := make(chan struct{})
+	go func() {
+		start := time.Now()
+		ticker := time.NewTicker(s.HeartbeatInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				progress := Progress{
+					Event:   event,
+					Elapsed: time.Since(start),
+				}
+				if err := s.reg.Heartbeat(id, progress); err != nil {
+					glog.Errorf("failed to send heartbeat for %s %s: %v", event, id, err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+	}
+}
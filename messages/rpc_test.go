@@ -0,0 +1,74 @@
+package messages
+
+import (
+	"net/http"
+	"testing"
+
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	"github.com/pmorie/osb-broker-lib/pkg/broker"
+)
+
+// versionBroker only supports API version 2.14, and names its service after
+// the version it was asked with and the request identity.
+type versionBroker struct {
+	broker.Interface
+}
+
+func (versionBroker) ValidateBrokerAPIVersion(version string) error {
+	if version != "2.14" {
+		return osb.HTTPStatusCodeError{StatusCode: http.StatusPreconditionFailed}
+	}
+	return nil
+}
+
+func (versionBroker) GetCatalog(c *broker.RequestContext) (*broker.CatalogResponse, error) {
+	return &broker.CatalogResponse{
+		CatalogResponse: osb.CatalogResponse{
+			Services: []osb.Service{{
+				ID:   c.Request.Header.Get("X-Broker-API-Request-Identity"),
+				Name: c.Request.Header.Get(osb.APIVersionHeader),
+			}},
+		},
+	}, nil
+}
+
+func TestCallCarriesAPIVersion(t *testing.T) {
+	proxySide, localSide := NewPipe()
+	proxy := NewRegistryWithTransport(proxySide)
+	local := NewRegistryWithTransport(localSide)
+	defer proxy.Stop()
+	defer local.Stop()
+	NewServer(local, versionBroker{}).Register()
+	client := NewClient(proxy)
+
+	catalog, err := Call(client, GetCatalog, &CatalogRequest{}, WithAPIVersion("2.14"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := catalog.Services[0].Name; name != "2.14" {
+		t.Errorf("expected the broker to see version 2.14, got %q", name)
+	}
+
+	_, err = Call(client, GetCatalog, &CatalogRequest{}, WithAPIVersion("2.11"))
+	if httpErr, ok := osb.IsHTTPError(err); !ok || httpErr.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("expected 412 for an unsupported version, got %v", err)
+	}
+}
+
+func TestCallCarriesHeaders(t *testing.T) {
+	proxySide, localSide := NewPipe()
+	proxy := NewRegistryWithTransport(proxySide)
+	local := NewRegistryWithTransport(localSide)
+	defer proxy.Stop()
+	defer local.Stop()
+	NewServer(local, versionBroker{}).Register()
+
+	catalog, err := Call(NewClient(proxy), GetCatalog, &CatalogRequest{},
+		WithHeaders(map[string]string{"X-Broker-API-Request-Identity": "request"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := catalog.Services[0].ID; id != "request" {
+		t.Errorf("expected the broker to see the request identity, got %q", id)
+	}
+}
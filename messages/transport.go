@@ -0,0 +1,69 @@
+package messages
+
+import (
+	"context"
+	"sync"
+)
+
+// Transport moves message payloads between the two sides of the tunnel.
+type Transport interface {
+	// Publish sends data to the other side.
+	Publish(ctx context.Context, data []byte) error
+
+	// Receive streams payloads from the other side to f until ctx is done or
+	// the stream fails. f may be called concurrently.
+	Receive(ctx context.Context, f func(ctx context.Context, d Delivery)) error
+}
+
+// Delivery is a received payload. Every delivery must be acked or nacked.
+type Delivery interface {
+	Data() []byte
+	Ack()
+	Nack()
+}
+
+// NewPipe returns two connected in-memory transports: whatever is published
+// on one is received on the other. It is intended for tests and for running
+// both sides of the tunnel in one process.
+func NewPipe() (Transport, Transport) {
+	a := make(chan []byte, 100)
+	b := make(chan []byte, 100)
+	return &pipe{in: a, out: b}, &pipe{in: b, out: a}
+}
+
+type pipe struct {
+	in  <-chan []byte
+	out chan<- []byte
+}
+
+func (p *pipe) Publish(ctx context.Context, data []byte) error {
+	select {
+	case p.out <- data:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *pipe) Receive(ctx context.Context, f func(ctx context.Context, d Delivery)) error {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		select {
+		case data := <-p.in:
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				f(ctx, pipeDelivery(data))
+			}()
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+type pipeDelivery []byte
+
+func (d pipeDelivery) Data() []byte { return d }
+func (d pipeDelivery) Ack()         {}
+func (d pipeDelivery) Nack()        {}
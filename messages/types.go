@@ -1,35 +1,68 @@
 package messages
 
 import (
+	"context"
+	"encoding/json"
 	"time"
 
 	"sync"
-
-	"cloud.google.com/go/pubsub"
 )
 
 type Registry struct {
 	WaitForTimeout time.Duration
-	SinkPollTime   time.Duration
+	// WaitForMaxTimeout caps how far heartbeats can extend WaitForTimeout.
+	WaitForMaxTimeout time.Duration
+
+	// MinBackoff and MaxBackoff bound the delay before the receiver
+	// reconnects after the receive stream fails.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// VentInterceptors wrap every message published by the registry and
+	// SinkInterceptors wrap every message dispatched to a sink, first one
+	// outermost. Both default to logging and must be set before use.
+	VentInterceptors []VentInterceptor
+	SinkInterceptors []SinkInterceptor
 
-	client       *pubsub.Client
-	topic        *pubsub.Topic
-	subscription *pubsub.Subscription
+	transport Transport
 
 	sinks     map[string]*Subscription // mapping the Key to a Subscription
-	sinking   bool
-	sinkMutex sync.Mutex
+	sinkMutex sync.RWMutex
+
+	status      ReceiverStatus
+	statusMutex sync.RWMutex
+	startOnce   sync.Once
+	stop        context.CancelFunc
 }
 
-type Callback func(id string, body interface{})
+type Callback func(msg *Message)
 
 type Subscription struct {
 	Key      string
 	Callback Callback
 }
 
+// HeartbeatEvent is the event of messages that report a request is still
+// being worked on.
+const HeartbeatEvent = "Heartbeat"
+
+// Progress is the body of a heartbeat message.
+type Progress struct {
+	Event   string        `json:"event"`
+	Elapsed time.Duration `json:"elapsed"`
+}
+
 type Message struct {
-	ID    string      `json:"id"`
-	Event string      `json:"event"`
-	Body  interface{} `json:"body"`
+	ID    string          `json:"id"`
+	Event string          `json:"event"`
+	Body  json.RawMessage `json:"body"`
+
+	// APIVersion is the OSB API version the platform sent the request with.
+	APIVersion string `json:"apiVersion,omitempty"`
+	// Headers are the platform's request headers forwarded by the proxy, such
+	// as the originating identity.
+	Headers map[string]string `json:"headers,omitempty"`
 }
+
+// MessageOption sets envelope fields of a message before it is vented.
+type MessageOption func(msg *Message)
@@ -0,0 +1,121 @@
+// Package apiversion checks OSB API versions, as sent by platforms in the
+// X-Broker-API-Version header, against a supported range.
+package apiversion
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+)
+
+// Version is an OSB API version such as 2.13.
+type Version struct {
+	Major int
+	Minor int
+}
+
+// Parse parses a "major.minor" version.
+func Parse(s string) (Version, error) {
+	parts := strings.Split(strings.TrimSpace(s), ".")
+	if len(parts) != 2 {
+		return Version{}, fmt.Errorf("invalid API version %q", s)
+	}
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return Version{}, fmt.Errorf("invalid API version %q", s)
+	}
+	minor, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return Version{}, fmt.Errorf("invalid API version %q", s)
+	}
+	return Version{Major: major, Minor: minor}, nil
+}
+
+func (v Version) String() string {
+	return fmt.Sprintf("%d.%d", v.Major, v.Minor)
+}
+
+// Less tells whether v is older than o.
+func (v Version) Less(o Version) bool {
+	if v.Major != o.Major {
+		return v.Major < o.Major
+	}
+	return v.Minor < o.Minor
+}
+
+// Range is the inclusive range of API versions a broker supports.
+type Range struct {
+	Min Version
+	Max Version
+}
+
+// NewRange parses the bounds of a Range.
+func NewRange(lowest, highest string) (Range, error) {
+	r := Range{}
+	var err error
+	if r.Min, err = Parse(lowest); err != nil {
+		return Range{}, err
+	}
+	if r.Max, err = Parse(highest); err != nil {
+		return Range{}, err
+	}
+	if r.Max.Less(r.Min) {
+		return Range{}, fmt.Errorf("API version range %s-%s is empty", r.Min, r.Max)
+	}
+	return r, nil
+}
+
+// Contains tells whether v is in the range.
+func (r Range) Contains(v Version) bool {
+	return !v.Less(r.Min) && !r.Max.Less(v)
+}
+
+func (r Range) String() string {
+	return r.Min.String() + "-" + r.Max.String()
+}
+
+// Check validates the X-Broker-API-Version header value against the range.
+// The OSB spec asks for 412 Precondition Failed when a platform sends a
+// version the broker does not support.
+func (r Range) Check(header string) error {
+	if header == "" {
+		return PreconditionFailed(fmt.Sprintf("missing %s header, supported versions are %s", osb.APIVersionHeader, r))
+	}
+	v, err := Parse(header)
+	if err != nil {
+		return PreconditionFailed(err.Error())
+	}
+	if !r.Contains(v) {
+		return PreconditionFailed(fmt.Sprintf("API version %s is not supported, supported versions are %s", v, r))
+	}
+	return nil
+}
+
+// PreconditionFailed is the OSB error for an unsupported API version.
+func PreconditionFailed(description string) error {
+	return osb.HTTPStatusCodeError{
+		StatusCode:  http.StatusPreconditionFailed,
+		Description: &description,
+	}
+}
+
+// ClientVersions are the versions the OSB client can speak, oldest first.
+var ClientVersions = []osb.APIVersion{
+	osb.Version2_11(),
+	osb.Version2_12(),
+	osb.Version2_13(),
+	osb.Version2_14(),
+}
+
+// ClientVersion returns the client's APIVersion for v.
+func ClientVersion(v Version) (osb.APIVersion, bool) {
+	for _, version := range ClientVersions {
+		if version.HeaderValue() == v.String() {
+			return version, true
+		}
+	}
+	return osb.APIVersion{}, false
+}
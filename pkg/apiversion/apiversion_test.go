@@ -0,0 +1,43 @@
+package apiversion
+
+import (
+	"net/http"
+	"testing"
+
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+)
+
+func TestRangeCheck(t *testing.T) {
+	r, err := NewRange("2.12", "2.14")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for header, ok := range map[string]bool{
+		"2.12": true,
+		"2.13": true,
+		"2.14": true,
+		"2.11": false,
+		"2.15": false,
+		"3.0":  false,
+		"":     false,
+		"two":  false,
+	} {
+		err := r.Check(header)
+		if ok && err != nil {
+			t.Errorf("%q: unexpected error %v", header, err)
+		}
+		if !ok {
+			httpErr, isHTTP := osb.IsHTTPError(err)
+			if !isHTTP || httpErr.StatusCode != http.StatusPreconditionFailed {
+				t.Errorf("%q: expected 412, got %v", header, err)
+			}
+		}
+	}
+}
+
+func TestNewRangeRejectsEmptyRange(t *testing.T) {
+	if _, err := NewRange("2.14", "2.13"); err == nil {
+		t.Error("expected an error for an empty range")
+	}
+}
@@ -22,59 +22,95 @@ type PubSubBindingObject struct {
 	TopicId        string `json:"topicId"`
 }
 
+// PubSubBinding reads a binding file and points the environment, the
+// application default credentials included, at it.
 func PubSubBinding(file string) (projectId, topicId, subscriptionId string, err error) {
-	data, err := ioutil.ReadFile(file)
+	projectId, topicId, subscriptionId, credsFile, err := PubSubBindingCredentials(file)
 	if err != nil {
 		return
 	}
 
-	var binding map[string]*json.RawMessage
+	os.Setenv(GCPProjectEnvName, projectId)
+	os.Setenv(PubSubTopicEnvName, topicId)
+	os.Setenv(PubSubSubscriptionEnvName, subscriptionId)
+	os.Setenv(GCPApplicationCreds, credsFile)
+	return
+}
 
-	err = json.Unmarshal(data, &binding)
+// PubSubBindingCredentials reads a binding file, leaving the environment
+// alone, and writes its private key to credsFile. Several bindings can be
+// used side by side this way, each with its own credentials.
+func PubSubBindingCredentials(file string) (projectId, topicId, subscriptionId, credsFile string, err error) {
+	pubsubBinding, err := readPubSubBinding(file)
 	if err != nil {
 		return
 	}
-
-	var pubsubBinding PubSubBindingObject
-	json.Unmarshal(*binding["data"], &pubsubBinding)
-	if err != nil {
+	if projectId, topicId, subscriptionId, err = pubsubBinding.ids(); err != nil {
 		return
 	}
 
+	f, err := ioutil.TempFile(os.TempDir(), "ledhouse")
 	if err != nil {
 		return
 	}
+	defer f.Close()
 
-	projectIdBytes, err := base64.StdEncoding.DecodeString(pubsubBinding.ProjectId)
+	creds, err := base64.StdEncoding.DecodeString(pubsubBinding.PrivateKeyData)
 	if err != nil {
+		fmt.Println("decode error:", err)
 		return
 	}
-	projectId = string(projectIdBytes)
+	if _, err = f.Write(creds); err != nil {
+		return
+	}
+	credsFile = f.Name()
+	return
+}
 
-	topicIdBytes, err := base64.StdEncoding.DecodeString(pubsubBinding.TopicId)
+// PubSubBindingIDs reads the project, topic and subscription of a binding
+// file, leaving its private key alone.
+func PubSubBindingIDs(file string) (projectId, topicId, subscriptionId string, err error) {
+	pubsubBinding, err := readPubSubBinding(file)
 	if err != nil {
 		return
 	}
-	topicId = string(topicIdBytes)
+	return pubsubBinding.ids()
+}
 
-	subscriptionIdBytes, err := base64.StdEncoding.DecodeString(pubsubBinding.SubscriptionId)
+func readPubSubBinding(file string) (*PubSubBindingObject, error) {
+	data, err := ioutil.ReadFile(file)
 	if err != nil {
-		return
+		return nil, err
 	}
-	subscriptionId = string(subscriptionIdBytes)
 
-	credsFile, err := ioutil.TempFile(os.TempDir(), "ledhouse")
+	var binding map[string]*json.RawMessage
+	if err := json.Unmarshal(data, &binding); err != nil {
+		return nil, err
+	}
+	if binding["data"] == nil {
+		return nil, fmt.Errorf("%s: no data", file)
+	}
 
-	creds, err := base64.StdEncoding.DecodeString(pubsubBinding.PrivateKeyData)
+	var pubsubBinding PubSubBindingObject
+	if err := json.Unmarshal(*binding["data"], &pubsubBinding); err != nil {
+		return nil, err
+	}
+	return &pubsubBinding, nil
+}
+
+// ids decodes the project, topic and subscription of the binding.
+func (b *PubSubBindingObject) ids() (projectId, topicId, subscriptionId string, err error) {
+	projectIdBytes, err := base64.StdEncoding.DecodeString(b.ProjectId)
 	if err != nil {
-		fmt.Println("decode error:", err)
 		return
 	}
-	credsFile.Write(creds)
-
-	os.Setenv(GCPProjectEnvName, projectId)
-	os.Setenv(PubSubTopicEnvName, topicId)
-	os.Setenv(PubSubSubscriptionEnvName, subscriptionId)
-	os.Setenv(GCPApplicationCreds, credsFile.Name())
-	return
+	topicIdBytes, err := base64.StdEncoding.DecodeString(b.TopicId)
+	if err != nil {
+		return
+	}
+	subscriptionIdBytes, err := base64.StdEncoding.DecodeString(b.SubscriptionId)
+	if err != nil {
+		return
+	}
+	return string(projectIdBytes), string(topicIdBytes), string(subscriptionIdBytes), nil
 }
@@ -0,0 +1,67 @@
+// Package catalog merges the catalogs of several brokers into the one served
+// to platforms.
+package catalog
+
+import (
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+)
+
+// Source is the catalog of a broker, by the name of what reaches it.
+type Source struct {
+	Name    string
+	Catalog *osb.CatalogResponse
+}
+
+// Conflict is a service of Source left out of a merged catalog, as its
+// service ID, service name or plan ID, Field, is Value, which Owner already
+// serves.
+type Conflict struct {
+	Source  string
+	Service string
+	Field   string
+	Value   string
+	Owner   string
+}
+
+// Merge merges the catalogs of sources, in order, and returns which source
+// serves each service. Services conflicting with one merged before, by
+// service ID, service name or plan ID, are left out and returned as
+// conflicts. Sources without a catalog are skipped.
+func Merge(sources []Source) (*osb.CatalogResponse, map[string]string, []Conflict) {
+	merged := &osb.CatalogResponse{}
+	routes := make(map[string]string)
+	names := make(map[string]string)
+	plans := make(map[string]string)
+	var conflicts []Conflict
+
+	for _, source := range sources {
+		if source.Catalog == nil {
+			continue
+		}
+		for _, service := range source.Catalog.Services {
+			conflict := Conflict{Source: source.Name, Service: service.ID}
+			if owner, ok := routes[service.ID]; ok {
+				conflict.Field, conflict.Value, conflict.Owner = "service ID", service.ID, owner
+			} else if owner, ok := names[service.Name]; ok {
+				conflict.Field, conflict.Value, conflict.Owner = "service name", service.Name, owner
+			}
+			for _, plan := range service.Plans {
+				if owner, ok := plans[plan.ID]; ok && conflict.Owner == "" {
+					conflict.Field, conflict.Value, conflict.Owner = "plan ID", plan.ID, owner
+				}
+			}
+			if conflict.Owner != "" {
+				conflicts = append(conflicts, conflict)
+				continue
+			}
+
+			routes[service.ID] = source.Name
+			names[service.Name] = source.Name
+			for _, plan := range service.Plans {
+				plans[plan.ID] = source.Name
+			}
+			merged.Services = append(merged.Services, service)
+		}
+	}
+	return merged, routes, conflicts
+}
@@ -0,0 +1,50 @@
+package catalog
+
+import (
+	"testing"
+
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+)
+
+func service(id, name string, plans ...string) osb.Service {
+	s := osb.Service{ID: id, Name: name}
+	for _, plan := range plans {
+		s.Plans = append(s.Plans, osb.Plan{ID: plan, Name: plan})
+	}
+	return s
+}
+
+func TestMerge(t *testing.T) {
+	merged, routes, conflicts := Merge([]Source{
+		{Name: "first", Catalog: &osb.CatalogResponse{Services: []osb.Service{
+			service("db", "database", "small"),
+		}}},
+		{Name: "down"},
+		{Name: "second", Catalog: &osb.CatalogResponse{Services: []osb.Service{
+			service("db", "other-database", "large"),
+			service("db2", "database", "medium"),
+			service("cache", "cache", "small"),
+			service("queue", "queue", "standard"),
+		}}},
+	})
+
+	if len(merged.Services) != 2 || merged.Services[0].ID != "db" || merged.Services[1].ID != "queue" {
+		t.Fatalf("expected db and queue to be merged, got %+v", merged.Services)
+	}
+	if routes["db"] != "first" || routes["queue"] != "second" || len(routes) != 2 {
+		t.Errorf("expected db from first and queue from second, got %v", routes)
+	}
+	expected := []Conflict{
+		{Source: "second", Service: "db", Field: "service ID", Value: "db", Owner: "first"},
+		{Source: "second", Service: "db2", Field: "service name", Value: "database", Owner: "first"},
+		{Source: "second", Service: "cache", Field: "plan ID", Value: "small", Owner: "first"},
+	}
+	if len(conflicts) != len(expected) {
+		t.Fatalf("expected %d conflicts, got %+v", len(expected), conflicts)
+	}
+	for i := range expected {
+		if conflicts[i] != expected[i] {
+			t.Errorf("expected %+v, got %+v", expected[i], conflicts[i])
+		}
+	}
+}
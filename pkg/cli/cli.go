@@ -2,12 +2,17 @@ package cli
 
 import (
 	"flag"
+	"net/http"
+	"strings"
+	"time"
 )
 
 // Options holds the options specified by the broker's code on the command
 // line. Users should add their own options here and add flags for them in
 // AddFlags.
 type Options struct {
+	// A YAML or JSON catalog file the proxy serves, or overlays onto the
+	// remote catalog.
 	CatalogPath string
 	Async       bool
 
@@ -19,14 +24,94 @@ type Options struct {
 	// Alt Pub/Sub config from a binding file.
 	Binding string
 
+	// A YAML or JSON file listing several tunnels, each to its own local
+	// side, instead of the one above.
+	Tunnels string
+	// A YAML or JSON file listing the tenants served under /tenants, each
+	// with brokers of its own.
+	Tenants string
+
 	BrokerUrl string
+	// A YAML or JSON file listing several backend brokers for the local side
+	// to front, instead of BrokerUrl.
+	Backends string
+	// How often the local side checks the replicas of its backends, and the
+	// proxy asks the local sides for their health.
+	HealthInterval time.Duration
+
+	// How the local side authenticates to the broker at BrokerUrl and
+	// verifies it: files holding each value, filled in from the directory a
+	// Kubernetes secret is mounted in.
+	BrokerSecret       string
+	BrokerUsernameFile string
+	BrokerPasswordFile string
+	BrokerTokenFile    string
+	BrokerCAFile       string
+	BrokerCertFile     string
+	BrokerKeyFile      string
+	BrokerInsecure     bool
+	// How often the proxy rereads the platform credentials, and the local
+	// side those of its backends.
+	CredentialsReload time.Duration
+
+	// The OSB API versions, "major.minor", accepted from the platform by the
+	// proxy and passed on to the broker by the local side.
+	MinAPIVersion string
+	MaxAPIVersion string
+
+	// The comma separated platform request headers the proxy forwards to the
+	// broker, and the local side passes on to it.
+	ForwardHeaders string
+
+	// How often the local side reports progress on a request it is serving.
+	HeartbeatInterval time.Duration
+	// The most heartbeats can extend the proxy's wait for a reply.
+	MaxWait time.Duration
+
+	// How long the proxy waits for a reply, unless TimeoutConfig says
+	// otherwise for the operation, service or plan.
+	Timeout       time.Duration
+	TimeoutConfig string
+
+	// How long a request with accepts_incomplete=true may wait before the
+	// proxy answers 202 Accepted and keeps waiting in the background.
+	AsyncBudget time.Duration
+
+	// Where the proxy keeps its instance and binding inventory: "memory" or
+	// "bolt", with InventoryPath the bolt database file.
+	Inventory     string
+	InventoryPath string
+	// A file with the 32 byte key that encrypts secrets in the inventory.
+	InventoryKey string
+
+	// Answer fetch instance and binding from the inventory when the backend
+	// broker cannot.
+	EmulateRetrieval bool
+
+	// How often the proxy refreshes its cached catalog, 0 to fetch it on every
+	// request, and the file it keeps a copy in.
+	CatalogRefresh time.Duration
+	CatalogCache   string
+	// A YAML or JSON file with rules filtering and rewriting the catalog.
+	CatalogRules string
+
+	// A YAML or JSON file with the credentials platforms authenticate to the
+	// proxy with, by route.
+	Auth string
+	// A YAML or JSON file mapping client certificates to the platforms they
+	// stand for, and what those may call.
+	ClientAuthz string
+
+	// What the proxy does with responses that break the OSB spec:
+	// "permissive", "fixup" or "reject".
+	Conformance string
 }
 
 // AddFlags is a hook called to initialize the CLI flags for broker options.
 // It is called after the flags are added for the skeleton and before flag
 // parse is called.
 func AddFlags(o *Options) {
-	flag.StringVar(&o.CatalogPath, "catalogPath", "", "The path to the catalog")
+	flag.StringVar(&o.CatalogPath, "catalogPath", "", "The path to a YAML or JSON catalog file to serve as is or overlay onto the remote catalog")
 	flag.BoolVar(&o.Async, "async", false, "Indicates whether the broker is handling the requests asynchronously.")
 
 	flag.StringVar(&o.ProjectID, "projectId", "", "specify the gcp projectId")
@@ -34,7 +119,50 @@ func AddFlags(o *Options) {
 	flag.StringVar(&o.Subscription, "subscription", "", "specify the pub/sub subscription")
 
 	flag.StringVar(&o.Binding, "binding", "", "Pub/Sub binding to use from Service Catalog")
+	flag.StringVar(&o.Tenants, "tenants", "", "path to a YAML or JSON file listing the tenants served under /tenants/{tenant}, each with its own brokers")
+	flag.StringVar(&o.Tunnels, "tunnels", "", "path to a YAML or JSON file listing the tunnels to several local sides, routed to by service")
+
+	flag.StringVar(&o.BrokerUrl, "broker", "", "URL of the local broker, or comma separated URLs of its replicas")
+	flag.StringVar(&o.Backends, "backends", "", "path to a YAML or JSON file listing several backend brokers, routed to by service")
+	flag.DurationVar(&o.HealthInterval, "healthInterval", 10*time.Second, "how often the local side checks the replicas of its backend brokers, and the proxy asks the local sides for their health, 0 disables")
+	flag.StringVar(&o.BrokerSecret, "brokerSecret", "", "directory of a mounted Kubernetes secret with the username, password, token, ca.crt, tls.crt and tls.key of the broker")
+	flag.StringVar(&o.BrokerUsernameFile, "brokerUsernameFile", "", "path to a file with the basic auth username of the broker")
+	flag.StringVar(&o.BrokerPasswordFile, "brokerPasswordFile", "", "path to a file with the basic auth password of the broker")
+	flag.StringVar(&o.BrokerTokenFile, "brokerTokenFile", "", "path to a file with the bearer token of the broker")
+	flag.StringVar(&o.BrokerCAFile, "brokerCAFile", "", "path to the PEM CA bundle verifying the broker")
+	flag.StringVar(&o.BrokerCertFile, "brokerCertFile", "", "path to the PEM client certificate presented to the broker")
+	flag.StringVar(&o.BrokerKeyFile, "brokerKeyFile", "", "path to the PEM key of the client certificate")
+	flag.BoolVar(&o.BrokerInsecure, "brokerInsecure", false, "skip verifying the certificate of the broker")
+	flag.DurationVar(&o.CredentialsReload, "credentialsReload", 30*time.Second, "how often the proxy rereads the platform credentials, and the local side those of its backend brokers, 0 disables")
+	flag.StringVar(&o.MinAPIVersion, "minApiVersion", "2.11", "the oldest OSB API version supported")
+	flag.StringVar(&o.MaxAPIVersion, "maxApiVersion", "2.14", "the newest OSB API version supported")
+	flag.StringVar(&o.ForwardHeaders, "forwardHeaders", "X-Broker-API-Originating-Identity,X-Broker-API-Request-Identity", "comma separated platform request headers the proxy forwards, and the local side passes on to the broker")
 
-	flag.StringVar(&o.BrokerUrl, "broker", "", "URL of the local broker")
+	flag.DurationVar(&o.HeartbeatInterval, "heartbeatInterval", 10*time.Second, "how often the local side reports progress on a long-running request")
+	flag.DurationVar(&o.MaxWait, "maxWait", 10*time.Minute, "the longest the proxy waits for a request that keeps sending heartbeats")
+	flag.DurationVar(&o.Timeout, "timeout", 30*time.Second, "how long the proxy waits for a reply by default")
+	flag.StringVar(&o.TimeoutConfig, "timeoutConfig", "", "path to a YAML or JSON file with per operation, service and plan timeouts")
+	flag.StringVar(&o.Inventory, "inventory", "memory", "where the proxy keeps its instance and binding inventory, memory or bolt")
+	flag.StringVar(&o.InventoryPath, "inventoryPath", "", "the database file of a bolt inventory")
+	flag.StringVar(&o.InventoryKey, "inventoryKey", "", "path to a file with the 32 byte key, raw or base64, that encrypts parameters and credentials in the inventory")
+	flag.BoolVar(&o.EmulateRetrieval, "emulateRetrieval", false, "answer fetch instance and fetch binding from the inventory for backends that do not support them, needs --inventoryKey")
+	flag.DurationVar(&o.CatalogRefresh, "catalogRefresh", 5*time.Minute, "how often the proxy refreshes its cached catalog, 0 fetches it on every request")
+	flag.StringVar(&o.CatalogCache, "catalogCache", "", "file where the proxy keeps a copy of the catalog for when the remote side is down")
+	flag.StringVar(&o.CatalogRules, "catalogRules", "", "path to a YAML or JSON file with rules filtering and rewriting the catalog")
+	flag.StringVar(&o.Conformance, "conformance", "permissive", "what to do with broker responses that break the OSB spec: permissive logs them, fixup repairs what it can, reject answers 502")
+	flag.StringVar(&o.Auth, "auth", "", "path to a YAML or JSON file with the basic auth and bearer token credentials platforms authenticate with, by route")
+	flag.StringVar(&o.ClientAuthz, "clientAuthz", "", "path to a YAML or JSON file mapping client certificate subjects and SANs to platforms and the operations they may call. Needs '--tlsClientCA'.")
+	flag.DurationVar(&o.AsyncBudget, "asyncBudget", 10*time.Second, "how long a request that accepts an incomplete answer waits before the proxy turns it asynchronous, 0 disables")
+}
 
+// HeaderNames parses a comma separated list of header names, such as
+// ForwardHeaders.
+func HeaderNames(list string) []string {
+	var headers []string
+	for _, header := range strings.Split(list, ",") {
+		if header = strings.TrimSpace(header); header != "" {
+			headers = append(headers, http.CanonicalHeaderKey(header))
+		}
+	}
+	return headers
 }
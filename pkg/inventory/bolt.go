@@ -0,0 +1,185 @@
+package inventory
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+var (
+	instancesBucket = []byte("instances")
+	bindingsBucket  = []byte("bindings")
+)
+
+// boltStore keeps the inventory in an embedded bolt database file. The
+// bindings of an instance are kept in a bucket of their own, named after the
+// instance, in the bindings bucket, as instance IDs may hold any character.
+type boltStore struct {
+	db *bolt.DB
+}
+
+// NewBoltStore opens, or creates, the bolt database at path.
+func NewBoltStore(path string) (Store, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{instancesBucket, bindingsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltStore{db: db}, nil
+}
+
+func (s *boltStore) put(bucket, key []byte, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).Put(key, data)
+	})
+}
+
+func (s *boltStore) get(bucket, key []byte, v interface{}) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(bucket).Get(key)
+		if data == nil {
+			return ErrNotFound
+		}
+		return json.Unmarshal(data, v)
+	})
+}
+
+func (s *boltStore) PutInstance(instance *Instance) error {
+	return s.put(instancesBucket, []byte(instance.ID), instance)
+}
+
+func (s *boltStore) GetInstance(id string) (*Instance, error) {
+	instance := &Instance{}
+	if err := s.get(instancesBucket, []byte(id), instance); err != nil {
+		return nil, err
+	}
+	return instance, nil
+}
+
+func (s *boltStore) DeleteInstance(id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(instancesBucket).Delete([]byte(id)); err != nil {
+			return err
+		}
+		err := tx.Bucket(bindingsBucket).DeleteBucket([]byte(id))
+		if err == bolt.ErrBucketNotFound {
+			return nil
+		}
+		return err
+	})
+}
+
+func (s *boltStore) ListInstances() ([]*Instance, error) {
+	var instances []*Instance
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(instancesBucket).ForEach(func(k, v []byte) error {
+			instance := &Instance{}
+			if err := json.Unmarshal(v, instance); err != nil {
+				return err
+			}
+			instances = append(instances, instance)
+			return nil
+		})
+	})
+	return instances, err
+}
+
+func (s *boltStore) PutBinding(binding *Binding) error {
+	data, err := json.Marshal(binding)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bindings, err := tx.Bucket(bindingsBucket).CreateBucketIfNotExists([]byte(binding.InstanceID))
+		if err != nil {
+			return err
+		}
+		return bindings.Put([]byte(binding.ID), data)
+	})
+}
+
+func (s *boltStore) GetBinding(instanceID, bindingID string) (*Binding, error) {
+	binding := &Binding{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bindings := tx.Bucket(bindingsBucket).Bucket([]byte(instanceID))
+		if bindings == nil {
+			return ErrNotFound
+		}
+		data := bindings.Get([]byte(bindingID))
+		if data == nil {
+			return ErrNotFound
+		}
+		return json.Unmarshal(data, binding)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return binding, nil
+}
+
+func (s *boltStore) DeleteBinding(instanceID, bindingID string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bindings := tx.Bucket(bindingsBucket).Bucket([]byte(instanceID))
+		if bindings == nil {
+			return nil
+		}
+		if err := bindings.Delete([]byte(bindingID)); err != nil {
+			return err
+		}
+		if k, _ := bindings.Cursor().First(); k == nil {
+			return tx.Bucket(bindingsBucket).DeleteBucket([]byte(instanceID))
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) ListBindings(instanceID string) ([]*Binding, error) {
+	var bindings []*Binding
+	list := func(b *bolt.Bucket) error {
+		return b.ForEach(func(k, v []byte) error {
+			binding := &Binding{}
+			if err := json.Unmarshal(v, binding); err != nil {
+				return err
+			}
+			bindings = append(bindings, binding)
+			return nil
+		})
+	}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		all := tx.Bucket(bindingsBucket)
+		if instanceID != "" {
+			if b := all.Bucket([]byte(instanceID)); b != nil {
+				return list(b)
+			}
+			return nil
+		}
+		return all.ForEach(func(k, v []byte) error {
+			if v != nil {
+				// Not the bucket of an instance.
+				return nil
+			}
+			return list(all.Bucket(k))
+		})
+	})
+	return bindings, err
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,58 @@
+package inventory
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func newTestBoltStore(t *testing.T, path string) Store {
+	s, err := NewBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestBoltStoreDeleteInstanceDropsBindings(t *testing.T) {
+	testDeleteInstanceDropsBindings(t, newTestBoltStore(t, filepath.Join(t.TempDir(), "inventory.db")))
+}
+
+func TestBoltStoreDeleteBinding(t *testing.T) {
+	s := newTestBoltStore(t, filepath.Join(t.TempDir(), "inventory.db"))
+	s.PutBinding(&Binding{ID: "binding", InstanceID: "instance"})
+
+	if err := s.DeleteBinding("instance", "binding"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetBinding("instance", "binding"); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+	if err := s.DeleteBinding("instance", "binding"); err != nil {
+		t.Errorf("expected deleting a binding twice to succeed, got %v", err)
+	}
+	if err := s.DeleteInstance("instance"); err != nil {
+		t.Errorf("expected deleting an instance without bindings to succeed, got %v", err)
+	}
+}
+
+func TestBoltStoreKeepsTheInventory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "inventory.db")
+	s, err := NewBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.PutInstance(&Instance{ID: "instance", ServiceID: "service"})
+	s.PutBinding(&Binding{ID: "binding", InstanceID: "instance"})
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s = newTestBoltStore(t, path)
+	if instance, err := s.GetInstance("instance"); err != nil || instance.ServiceID != "service" {
+		t.Errorf("expected the instance to be kept, got %+v, %v", instance, err)
+	}
+	if _, err := s.GetBinding("instance", "binding"); err != nil {
+		t.Errorf("expected the binding to be kept, got %v", err)
+	}
+}
@@ -0,0 +1,125 @@
+package inventory
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrNotFound is returned when a store has no record for an ID.
+var ErrNotFound = errors.New("not found")
+
+// State is the state of the last operation on an instance or binding. It
+// uses the values of the OSB last operation states.
+type State string
+
+const (
+	StateInProgress State = "in progress"
+	StateSucceeded  State = "succeeded"
+	StateFailed     State = "failed"
+)
+
+// Instance is what the proxy knows about a service instance.
+type Instance struct {
+	ID             string                 `json:"id"`
+	ServiceID      string                 `json:"serviceId"`
+	PlanID         string                 `json:"planId"`
+	Context        map[string]interface{} `json:"context,omitempty"`
+	ParametersHash string                 `json:"parametersHash,omitempty"`
+	DashboardURL   string                 `json:"dashboardUrl,omitempty"`
+
+	// Secret is the sealed InstanceSecret, when the proxy has a Sealer.
+	Secret []byte `json:"secret,omitempty"`
+
+	// Operation is the last operation on the instance, e.g. "Provision", and
+	// State how it went.
+	Operation string `json:"operation"`
+	State     State  `json:"state"`
+
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+}
+
+// Binding is what the proxy knows about a service binding.
+type Binding struct {
+	ID             string                 `json:"id"`
+	InstanceID     string                 `json:"instanceId"`
+	ServiceID      string                 `json:"serviceId"`
+	PlanID         string                 `json:"planId"`
+	Context        map[string]interface{} `json:"context,omitempty"`
+	ParametersHash string                 `json:"parametersHash,omitempty"`
+
+	SyslogDrainURL  string        `json:"syslogDrainUrl,omitempty"`
+	RouteServiceURL string        `json:"routeServiceUrl,omitempty"`
+	VolumeMounts    []interface{} `json:"volumeMounts,omitempty"`
+
+	// Secret is the sealed BindingSecret, when the proxy has a Sealer.
+	Secret []byte `json:"secret,omitempty"`
+
+	Operation string `json:"operation"`
+	State     State  `json:"state"`
+
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+}
+
+// InstanceSecret holds the parts of an instance that are only stored sealed.
+type InstanceSecret struct {
+	Parameters map[string]interface{} `json:"parameters,omitempty"`
+}
+
+// BindingSecret holds the parts of a binding that are only stored sealed.
+type BindingSecret struct {
+	Credentials map[string]interface{} `json:"credentials,omitempty"`
+	Parameters  map[string]interface{} `json:"parameters,omitempty"`
+}
+
+// Store keeps the inventory. Get methods return ErrNotFound for unknown IDs.
+type Store interface {
+	PutInstance(instance *Instance) error
+	GetInstance(id string) (*Instance, error)
+	DeleteInstance(id string) error
+	ListInstances() ([]*Instance, error)
+
+	PutBinding(binding *Binding) error
+	GetBinding(instanceID, bindingID string) (*Binding, error)
+	DeleteBinding(instanceID, bindingID string) error
+	// ListBindings lists the bindings of instanceID, or all bindings when
+	// instanceID is empty.
+	ListBindings(instanceID string) ([]*Binding, error)
+
+	Close() error
+}
+
+// Open returns the store of the given kind, "memory" or "bolt". path is the
+// database file of a bolt store.
+func Open(kind, path string) (Store, error) {
+	switch kind {
+	case "", "memory":
+		return NewMemoryStore(), nil
+	case "bolt":
+		if path == "" {
+			return nil, errors.New("a bolt inventory needs a path")
+		}
+		return NewBoltStore(path)
+	}
+	return nil, fmt.Errorf("unknown inventory store %q", kind)
+}
+
+// HashParameters returns a digest of parameters, so changes can be spotted
+// without storing values that may be secret.
+func HashParameters(parameters map[string]interface{}) string {
+	if len(parameters) == 0 {
+		return ""
+	}
+	// encoding/json sorts map keys, so equal parameters hash equally.
+	data, err := json.Marshal(parameters)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,110 @@
+package inventory
+
+import (
+	"sort"
+	"sync"
+)
+
+type memoryStore struct {
+	mutex     sync.RWMutex
+	instances map[string]Instance
+	bindings  map[string]map[string]Binding // by instance ID, then binding ID
+}
+
+// NewMemoryStore returns a Store that keeps the inventory in memory only.
+func NewMemoryStore() Store {
+	return &memoryStore{
+		instances: make(map[string]Instance),
+		bindings:  make(map[string]map[string]Binding),
+	}
+}
+
+func (s *memoryStore) PutInstance(instance *Instance) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.instances[instance.ID] = *instance
+	return nil
+}
+
+func (s *memoryStore) GetInstance(id string) (*Instance, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	instance, ok := s.instances[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &instance, nil
+}
+
+func (s *memoryStore) DeleteInstance(id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.instances, id)
+	delete(s.bindings, id)
+	return nil
+}
+
+func (s *memoryStore) ListInstances() ([]*Instance, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	instances := make([]*Instance, 0, len(s.instances))
+	for id := range s.instances {
+		instance := s.instances[id]
+		instances = append(instances, &instance)
+	}
+	sort.Slice(instances, func(i, j int) bool { return instances[i].ID < instances[j].ID })
+	return instances, nil
+}
+
+func (s *memoryStore) PutBinding(binding *Binding) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.bindings[binding.InstanceID] == nil {
+		s.bindings[binding.InstanceID] = make(map[string]Binding)
+	}
+	s.bindings[binding.InstanceID][binding.ID] = *binding
+	return nil
+}
+
+func (s *memoryStore) GetBinding(instanceID, bindingID string) (*Binding, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	binding, ok := s.bindings[instanceID][bindingID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &binding, nil
+}
+
+func (s *memoryStore) DeleteBinding(instanceID, bindingID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.bindings[instanceID], bindingID)
+	return nil
+}
+
+func (s *memoryStore) ListBindings(instanceID string) ([]*Binding, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	var bindings []*Binding
+	for id, byID := range s.bindings {
+		if instanceID != "" && id != instanceID {
+			continue
+		}
+		for bindingID := range byID {
+			binding := byID[bindingID]
+			bindings = append(bindings, &binding)
+		}
+	}
+	sort.Slice(bindings, func(i, j int) bool {
+		if bindings[i].InstanceID != bindings[j].InstanceID {
+			return bindings[i].InstanceID < bindings[j].InstanceID
+		}
+		return bindings[i].ID < bindings[j].ID
+	})
+	return bindings, nil
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
@@ -0,0 +1,53 @@
+package inventory
+
+import (
+	"testing"
+)
+
+func TestMemoryStoreDeleteInstanceDropsBindings(t *testing.T) {
+	testDeleteInstanceDropsBindings(t, NewMemoryStore())
+}
+
+// testDeleteInstanceDropsBindings runs the cases every Store has to pass
+// about the bindings of a deleted instance.
+func testDeleteInstanceDropsBindings(t *testing.T, s Store) {
+	s.PutInstance(&Instance{ID: "instance"})
+	s.PutBinding(&Binding{ID: "binding", InstanceID: "instance"})
+	s.PutBinding(&Binding{ID: "other", InstanceID: "other-instance"})
+	// An instance ID that starts with the one of another instance.
+	s.PutBinding(&Binding{ID: "nested", InstanceID: "instance/nested"})
+
+	if bindings, _ := s.ListBindings(""); len(bindings) != 3 {
+		t.Fatalf("expected 3 bindings, got %d", len(bindings))
+	}
+	if bindings, _ := s.ListBindings("instance"); len(bindings) != 1 || bindings[0].ID != "binding" {
+		t.Errorf("expected only the binding of the instance, got %v", bindings)
+	}
+
+	if err := s.DeleteInstance("instance"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetInstance("instance"); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+	if _, err := s.GetBinding("instance", "binding"); err != ErrNotFound {
+		t.Errorf("expected the binding to go with its instance, got %v", err)
+	}
+	if _, err := s.GetBinding("instance/nested", "nested"); err != nil {
+		t.Errorf("expected the binding of another instance to be kept, got %v", err)
+	}
+	if bindings, _ := s.ListBindings(""); len(bindings) != 2 {
+		t.Errorf("expected 2 bindings left, got %d", len(bindings))
+	}
+}
+
+func TestHashParameters(t *testing.T) {
+	a := HashParameters(map[string]interface{}{"color": "Clear", "size": 1})
+	b := HashParameters(map[string]interface{}{"size": 1, "color": "Clear"})
+	if a == "" || a != b {
+		t.Errorf("expected equal parameters to hash equally, got %q and %q", a, b)
+	}
+	if HashParameters(nil) != "" {
+		t.Errorf("expected no hash without parameters")
+	}
+}
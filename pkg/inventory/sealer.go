@@ -0,0 +1,75 @@
+package inventory
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// Sealer encrypts the secret parts of inventory records, such as binding
+// credentials, with AES-256-GCM so they are never stored in the clear.
+type Sealer struct {
+	aead cipher.AEAD
+}
+
+// NewSealer returns a Sealer using a 32 byte key.
+func NewSealer(key []byte) (*Sealer, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("inventory key must be 32 bytes, got %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Sealer{aead: aead}, nil
+}
+
+// LoadSealer reads the key of a Sealer from a file holding either the 32 raw
+// bytes or their base64 encoding.
+func LoadSealer(path string) (*Sealer, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if key, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(data))); err == nil && len(key) == 32 {
+		return NewSealer(key)
+	}
+	return NewSealer(data)
+}
+
+// Seal encrypts the JSON encoding of v.
+func (s *Sealer) Seal(v interface{}) ([]byte, error) {
+	plaintext, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return s.aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// Open decrypts data sealed by Seal into v.
+func (s *Sealer) Open(data []byte, v interface{}) error {
+	size := s.aead.NonceSize()
+	if len(data) < size {
+		return errors.New("sealed data is too short")
+	}
+	plaintext, err := s.aead.Open(nil, data[:size], data[size:], nil)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(plaintext, v)
+}
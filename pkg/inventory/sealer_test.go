@@ -0,0 +1,33 @@
+package inventory
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSealerRoundTrip(t *testing.T) {
+	s, err := NewSealer(bytes.Repeat([]byte{7}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := s.Seal(BindingSecret{Credentials: map[string]interface{}{"password": "hunter2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(sealed, []byte("hunter2")) {
+		t.Fatal("sealed data contains the credentials in the clear")
+	}
+
+	var secret BindingSecret
+	if err := s.Open(sealed, &secret); err != nil {
+		t.Fatal(err)
+	}
+	if secret.Credentials["password"] != "hunter2" {
+		t.Errorf("expected the credentials back, got %v", secret.Credentials)
+	}
+
+	sealed[len(sealed)-1] ^= 1
+	if err := s.Open(sealed, &secret); err == nil {
+		t.Error("expected tampered data to fail to open")
+	}
+}
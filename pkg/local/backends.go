@@ -0,0 +1,359 @@
+package local
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+	"github.com/n3wscott/k8s-broker-proxy/pkg/apiversion"
+	"github.com/n3wscott/k8s-broker-proxy/pkg/catalog"
+	"github.com/n3wscott/k8s-broker-proxy/pkg/cli"
+	"github.com/n3wscott/k8s-broker-proxy/pkg/config"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	"github.com/pmorie/osb-broker-lib/pkg/broker"
+)
+
+// The local side can front several backend brokers. Their catalogs are
+// merged into one, and each request goes to the backend whose catalog has
+// its service.
+
+// defaultBackend names the backend set up by --broker.
+const defaultBackend = "default"
+
+// BackendsConfig lists the backend brokers of the local side, in order of
+// precedence: a service or plan ID already served by one backend is left out
+// of the catalogs of the backends after it.
+type BackendsConfig struct {
+	Backends []BackendConfig `json:"backends"`
+}
+
+// BackendConfig sets up a backend broker, served by URL or the replicas at
+// URLs, in order of preference.
+type BackendConfig struct {
+	Name string      `json:"name"`
+	URL  string      `json:"url,omitempty"`
+	URLs []string    `json:"urls,omitempty"`
+	Auth *ClientAuth `json:"auth,omitempty"`
+}
+
+func (c BackendConfig) urls() []string {
+	if c.URL != "" {
+		return append([]string{c.URL}, c.URLs...)
+	}
+	return c.URLs
+}
+
+// LoadBackends reads the backends from a YAML or JSON file.
+func LoadBackends(path string) ([]BackendConfig, error) {
+	c := &BackendsConfig{}
+	if err := config.Load(path, c); err != nil {
+		return nil, err
+	}
+	if len(c.Backends) == 0 {
+		return nil, fmt.Errorf("%s: no backends", path)
+	}
+	names := make(map[string]bool)
+	for _, backend := range c.Backends {
+		if backend.Name == "" || len(backend.urls()) == 0 {
+			return nil, fmt.Errorf("%s: backends need a name and a url", path)
+		}
+		if names[backend.Name] {
+			return nil, fmt.Errorf("%s: backend %s is listed twice", path, backend.Name)
+		}
+		names[backend.Name] = true
+	}
+	return c.Backends, nil
+}
+
+// backendConfigs returns the backends listed in o.Backends, or the one at
+// the comma separated replicas of o.BrokerUrl.
+func backendConfigs(o cli.Options) ([]BackendConfig, error) {
+	if o.Backends != "" {
+		return LoadBackends(o.Backends)
+	}
+	c := BackendConfig{Name: defaultBackend, Auth: clientAuth(o)}
+	for _, url := range strings.Split(o.BrokerUrl, ",") {
+		if url = strings.TrimSpace(url); url != "" {
+			c.URLs = append(c.URLs, url)
+		}
+	}
+	if len(c.URLs) == 0 {
+		c.URLs = []string{""}
+	}
+	return []BackendConfig{c}, nil
+}
+
+// backend is a broker the local side forwards to, run as one or more
+// replicas.
+type backend struct {
+	name     string
+	replicas []*replica
+	// next spreads reads over the replicas.
+	next uint32
+
+	auth        *ClientAuth
+	mutex       sync.Mutex
+	credentials *credentials
+}
+
+func newBackend(c BackendConfig, apiVersions apiversion.Range) (*backend, error) {
+	credentials, err := loadCredentials(c.Auth)
+	if err != nil {
+		return nil, fmt.Errorf("backend %s: %v", c.Name, err)
+	}
+	b := &backend{name: c.Name, auth: c.Auth, credentials: credentials}
+	for _, url := range c.urls() {
+		r, err := newReplica(c.Name, url, apiVersions, credentials)
+		if err != nil {
+			return nil, fmt.Errorf("backend %s: %v", c.Name, err)
+		}
+		b.replicas = append(b.replicas, r)
+	}
+	return b, nil
+}
+
+// clientFor returns the client speaking the API version of the request, and
+// sending header on with it.
+func (b *backend) clientFor(c *broker.RequestContext, apiVersions apiversion.Range, header http.Header) (versionedClient, error) {
+	version := ""
+	if c != nil && c.Request != nil {
+		version = c.Request.Header.Get(osb.APIVersionHeader)
+	}
+	client, ok := b.replicas[0].clientFor(version, header)
+	if !ok {
+		return versionedClient{}, apiversion.PreconditionFailed(fmt.Sprintf("API version %s is not supported, supported versions are %s", version, apiVersions))
+	}
+	if len(b.replicas) == 1 {
+		return client, nil
+	}
+	return versionedClient{
+		Client:  &failoverClient{Client: client.Client, backend: b, version: version, header: header},
+		version: client.version,
+	}, nil
+}
+
+// close stops the header forwarders of the replicas.
+func (b *backend) close() {
+	for _, r := range b.replicas {
+		if err := r.close(); err != nil {
+			glog.Warningf("backend %s: closing the header forwarder of replica %s: %v", b.name, r.url, err)
+		}
+	}
+}
+
+// backendRoutes tells which backend serves each service, from the merged
+// catalog, and each instance, from the requests seen. The instances are only
+// remembered until they are deprovisioned or the local side restarts; the
+// backends are probed for those it does not know.
+type backendRoutes struct {
+	mutex     sync.RWMutex
+	services  map[string]*backend
+	instances map[string]*backend
+	// deleting are the instances being deprovisioned asynchronously, whose
+	// route goes once their last operation tells they are gone.
+	deleting map[string]bool
+}
+
+func (r *backendRoutes) get(serviceID, instanceID string) (*backend, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	if backend, ok := r.services[serviceID]; ok && serviceID != "" {
+		return backend, true
+	}
+	backend, ok := r.instances[instanceID]
+	return backend, ok && instanceID != ""
+}
+
+func (r *backendRoutes) loaded() bool {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.services != nil
+}
+
+func (r *backendRoutes) setServices(services map[string]*backend) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.services = services
+}
+
+func (r *backendRoutes) setInstance(instanceID string, to *backend) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.instances == nil {
+		r.instances = make(map[string]*backend)
+	}
+	r.instances[instanceID] = to
+}
+
+func (r *backendRoutes) forgetInstance(instanceID string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.instances, instanceID)
+	delete(r.deleting, instanceID)
+}
+
+// setDeleting marks instanceID as being deprovisioned, or not anymore.
+func (r *backendRoutes) setDeleting(instanceID string, deleting bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if !deleting {
+		delete(r.deleting, instanceID)
+		return
+	}
+	if r.deleting == nil {
+		r.deleting = make(map[string]bool)
+	}
+	r.deleting[instanceID] = true
+}
+
+func (r *backendRoutes) isDeleting(instanceID string) bool {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.deleting[instanceID]
+}
+
+// backendFor returns the backend serving serviceID, or instanceID when the
+// request does not say its service. With a single backend, that is the one;
+// otherwise the catalogs tell, and are fetched if they were not yet.
+func (b *BusinessLogic) backendFor(c *broker.RequestContext, serviceID, instanceID string) (*backend, error) {
+	if len(b.backends) == 1 {
+		return b.backends[0], nil
+	}
+	backend, ok := b.routes.get(serviceID, instanceID)
+	if !ok && serviceID != "" && !b.routes.loaded() {
+		if _, err := b.mergeCatalogs(c); err != nil {
+			return nil, err
+		}
+		backend, ok = b.routes.get(serviceID, instanceID)
+	}
+	if !ok {
+		return nil, unknownBackend(serviceID, instanceID)
+	}
+	if instanceID != "" {
+		b.routes.setInstance(instanceID, backend)
+	}
+	return backend, nil
+}
+
+func unknownBackend(serviceID, instanceID string) error {
+	description := fmt.Sprintf("no backend broker serves service %q", serviceID)
+	if serviceID == "" {
+		description = fmt.Sprintf("the backend broker of instance %s is unknown", instanceID)
+	}
+	return osb.HTTPStatusCodeError{
+		StatusCode:  http.StatusBadRequest,
+		Description: &description,
+	}
+}
+
+// clientFor returns the client of the backend serving the request, speaking
+// its API version.
+func (b *BusinessLogic) clientFor(c *broker.RequestContext, serviceID, instanceID string) (versionedClient, error) {
+	backend, err := b.backendFor(c, serviceID, instanceID)
+	if err != nil {
+		return versionedClient{}, err
+	}
+	return backend.clientFor(c, b.apiVersions, b.forwardedHeaders(c))
+}
+
+// mergeCatalogs fetches the catalogs of all backends and merges them, in the
+// order of b.backends. It fails if any backend does, as a partial catalog
+// would look like services went away.
+func (b *BusinessLogic) mergeCatalogs(c *broker.RequestContext) (*osb.CatalogResponse, error) {
+	var sources []catalog.Source
+	for _, backend := range b.backends {
+		client, err := backend.clientFor(c, b.apiVersions, b.forwardedHeaders(c))
+		if err != nil {
+			return nil, err
+		}
+		resp, err := client.GetCatalog()
+		if err != nil {
+			glog.Errorf("backend %s: GetCatalog failed with %v", backend.name, err)
+			return nil, err
+		}
+
+		// Only advertise fetching instances and bindings when the backend
+		// says it supports it and the client is able to ask.
+		if !client.retrievable() {
+			for i := range resp.Services {
+				resp.Services[i].InstancesRetrievable = false
+				resp.Services[i].BindingsRetrievable = false
+			}
+		}
+		sources = append(sources, catalog.Source{Name: backend.name, Catalog: resp})
+	}
+
+	merged, routes, conflicts := catalog.Merge(sources)
+	for _, c := range conflicts {
+		glog.Errorf("backend %s: leaving service %s out of the catalog, %s %s is served by backend %s", c.Source, c.Service, c.Field, c.Value, c.Owner)
+	}
+	services := make(map[string]*backend)
+	for serviceID, name := range routes {
+		services[serviceID] = b.backendNamed(name)
+	}
+	b.routes.setServices(services)
+	return merged, nil
+}
+
+func (b *BusinessLogic) backendNamed(name string) *backend {
+	for _, backend := range b.backends {
+		if backend.name == name {
+			return backend
+		}
+	}
+	return nil
+}
+
+// call calls f with the client of the backend serving the request. The
+// backends are probed for it when the request does not say its service and
+// the instance is one the local side has not seen, such as one provisioned
+// before it restarted.
+func (b *BusinessLogic) call(c *broker.RequestContext, serviceID, instanceID string, f func(client versionedClient) error) error {
+	if serviceID == "" && len(b.backends) > 1 {
+		if _, ok := b.routes.get("", instanceID); !ok {
+			return b.probe(c, instanceID, f)
+		}
+	}
+	client, err := b.clientFor(c, serviceID, instanceID)
+	if err != nil {
+		return err
+	}
+	return f(client)
+}
+
+// probe calls f with the client of each backend in turn until one does not
+// answer 404 Not Found or 410 Gone. Since a 410 tells the backend knew the
+// instance and deleted it, it is returned over the 404 of the others.
+func (b *BusinessLogic) probe(c *broker.RequestContext, instanceID string, f func(client versionedClient) error) error {
+	var err, goneErr error
+	for _, backend := range b.backends {
+		var client versionedClient
+		if client, err = backend.clientFor(c, b.apiVersions, b.forwardedHeaders(c)); err != nil {
+			return err
+		}
+		err = f(client)
+		if httpErr, ok := osb.IsHTTPError(err); ok && httpErr.StatusCode == http.StatusNotFound {
+			continue
+		}
+		if gone(err) {
+			goneErr = err
+			continue
+		}
+		if err == nil {
+			b.routes.setInstance(instanceID, backend)
+		}
+		return err
+	}
+	if goneErr != nil {
+		return goneErr
+	}
+	return err
+}
+
+// gone tells whether err is a backend's 410 Gone.
+func gone(err error) bool {
+	httpErr, ok := osb.IsHTTPError(err)
+	return ok && httpErr.StatusCode == http.StatusGone
+}
@@ -0,0 +1,158 @@
+package local
+
+import (
+	"net/http"
+	"testing"
+
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+)
+
+// fakeClient serves one service, and knows of the instances it provisioned.
+type fakeClient struct {
+	osb.Client
+	service   string
+	instances map[string]bool
+}
+
+func (c *fakeClient) GetCatalog() (*osb.CatalogResponse, error) {
+	return &osb.CatalogResponse{Services: []osb.Service{{
+		ID:    c.service,
+		Name:  c.service,
+		Plans: []osb.Plan{{ID: c.service + "-plan", Name: "plan"}},
+	}}}, nil
+}
+
+func (c *fakeClient) ProvisionInstance(r *osb.ProvisionRequest) (*osb.ProvisionResponse, error) {
+	c.instances[r.InstanceID] = true
+	return &osb.ProvisionResponse{}, nil
+}
+
+func (c *fakeClient) GetInstance(r *osb.GetInstanceRequest) (*osb.GetInstanceResponse, error) {
+	if !c.instances[r.InstanceID] {
+		return nil, osb.HTTPStatusCodeError{StatusCode: http.StatusNotFound}
+	}
+	return &osb.GetInstanceResponse{ServiceID: c.service}, nil
+}
+
+func (c *fakeClient) DeprovisionInstance(r *osb.DeprovisionRequest) (*osb.DeprovisionResponse, error) {
+	if !c.instances[r.InstanceID] {
+		return nil, osb.HTTPStatusCodeError{StatusCode: http.StatusGone}
+	}
+	delete(c.instances, r.InstanceID)
+	return &osb.DeprovisionResponse{Async: r.AcceptsIncomplete}, nil
+}
+
+func (c *fakeClient) PollLastOperation(r *osb.LastOperationRequest) (*osb.LastOperationResponse, error) {
+	if !c.instances[r.InstanceID] {
+		return nil, osb.HTTPStatusCodeError{StatusCode: http.StatusGone}
+	}
+	return &osb.LastOperationResponse{State: osb.StateSucceeded}, nil
+}
+
+func newFakeReplica(url string, client osb.Client) *replica {
+	return &replica{url: url, client: versionedClient{Client: client, version: osb.Version2_14()}, healthy: true}
+}
+
+func newFakeBackend(name, service string) (*backend, *fakeClient) {
+	client := &fakeClient{service: service, instances: make(map[string]bool)}
+	return &backend{name: name, replicas: []*replica{newFakeReplica(name, client)}}, client
+}
+
+func TestBackendsDispatchByService(t *testing.T) {
+	first, firstClient := newFakeBackend("first", "mysql")
+	second, secondClient := newFakeBackend("second", "redis")
+	conflicting, _ := newFakeBackend("third", "mysql")
+	b := &BusinessLogic{backends: []*backend{first, second, conflicting}}
+
+	catalog, err := b.GetCatalog(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(catalog.Services) != 2 {
+		t.Fatalf("expected the conflicting service to be left out, got %+v", catalog.Services)
+	}
+
+	if _, err := b.Provision(&osb.ProvisionRequest{InstanceID: "cache", ServiceID: "redis", PlanID: "redis-plan"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if firstClient.instances["cache"] || !secondClient.instances["cache"] {
+		t.Error("expected the backend serving the service to provision")
+	}
+
+	if _, err := b.Provision(&osb.ProvisionRequest{InstanceID: "other", ServiceID: "unknown", PlanID: "plan"}, nil); err == nil {
+		t.Error("expected a service no backend serves to be refused")
+	}
+}
+
+func TestBackendsProbeUnknownInstances(t *testing.T) {
+	first, _ := newFakeBackend("first", "mysql")
+	second, secondClient := newFakeBackend("second", "redis")
+	secondClient.instances["cache"] = true
+	b := &BusinessLogic{backends: []*backend{first, second}}
+
+	instance, err := b.GetInstance(&osb.GetInstanceRequest{InstanceID: "cache"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if instance.ServiceID != "redis" {
+		t.Errorf("expected the instance of the second backend, got %+v", instance)
+	}
+	if backend, ok := b.routes.get("", "cache"); !ok || backend != second {
+		t.Error("expected the backend of the instance to be remembered")
+	}
+}
+
+func TestBackendsProbeLastOperationAfterRestart(t *testing.T) {
+	first, _ := newFakeBackend("first", "mysql")
+	second, secondClient := newFakeBackend("second", "redis")
+	secondClient.instances["cache"] = true
+	// A fresh local side has not seen the instance provisioned before.
+	b := &BusinessLogic{backends: []*backend{first, second}}
+
+	response, err := b.LastOperation(&osb.LastOperationRequest{InstanceID: "cache"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.State != osb.StateSucceeded {
+		t.Errorf("expected the last operation of the second backend, got %+v", response)
+	}
+	if backend, ok := b.routes.get("", "cache"); !ok || backend != second {
+		t.Error("expected the backend of the instance to be remembered")
+	}
+}
+
+func TestBackendsForgetDeprovisionedInstances(t *testing.T) {
+	first, _ := newFakeBackend("first", "mysql")
+	second, secondClient := newFakeBackend("second", "redis")
+	b := &BusinessLogic{backends: []*backend{first, second}}
+
+	for _, id := range []string{"sync", "async"} {
+		if _, err := b.Provision(&osb.ProvisionRequest{InstanceID: id, ServiceID: "redis", PlanID: "redis-plan"}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := b.Deprovision(&osb.DeprovisionRequest{InstanceID: "sync", ServiceID: "redis", PlanID: "redis-plan"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := b.routes.get("", "sync"); ok {
+		t.Error("expected the route of a deprovisioned instance to be forgotten")
+	}
+
+	if _, err := b.Deprovision(&osb.DeprovisionRequest{InstanceID: "async", ServiceID: "redis", PlanID: "redis-plan", AcceptsIncomplete: true}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := b.routes.get("", "async"); !ok {
+		t.Fatal("expected the route to be kept while the deprovision is polled")
+	}
+	_, err := b.LastOperation(&osb.LastOperationRequest{InstanceID: "async"}, nil)
+	if !gone(err) {
+		t.Fatalf("expected the deprovisioned instance to be gone, got %v", err)
+	}
+	if _, ok := b.routes.get("", "async"); ok || b.routes.isDeleting("async") {
+		t.Error("expected the route to be forgotten once the deprovision is done")
+	}
+	if len(secondClient.instances) != 0 {
+		t.Errorf("expected both instances to be deprovisioned, got %v", secondClient.instances)
+	}
+}
@@ -0,0 +1,225 @@
+package local
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/n3wscott/k8s-broker-proxy/pkg/cli"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+)
+
+// Backends may need credentials and TLS settings to be reached. Every value
+// is read from a file, so that it can come from a mounted Kubernetes secret,
+// and the files are reread as they change; the clients of a backend are
+// rebuilt with what they hold, and requests already under way finish with
+// the clients they started with.
+
+// The keys of a mounted secret, as Kubernetes names them for basic-auth and
+// TLS secrets.
+const (
+	secretUsername = "username"
+	secretPassword = "password"
+	secretToken    = "token"
+	secretCA       = "ca.crt"
+	secretCert     = "tls.crt"
+	secretKey      = "tls.key"
+)
+
+// ClientAuth sets up how the local side authenticates to a backend and
+// verifies it. Secret is the directory a Kubernetes secret is mounted in,
+// whose keys fill in the files not set.
+type ClientAuth struct {
+	Secret       string `json:"secret,omitempty"`
+	UsernameFile string `json:"usernameFile,omitempty"`
+	PasswordFile string `json:"passwordFile,omitempty"`
+	TokenFile    string `json:"tokenFile,omitempty"`
+	CAFile       string `json:"caFile,omitempty"`
+	CertFile     string `json:"certFile,omitempty"`
+	KeyFile      string `json:"keyFile,omitempty"`
+	// Insecure skips verifying the backend's certificate.
+	Insecure bool `json:"insecure,omitempty"`
+}
+
+// clientAuth returns the ClientAuth of the backend at o.BrokerUrl.
+func clientAuth(o cli.Options) *ClientAuth {
+	a := &ClientAuth{
+		Secret:       o.BrokerSecret,
+		UsernameFile: o.BrokerUsernameFile,
+		PasswordFile: o.BrokerPasswordFile,
+		TokenFile:    o.BrokerTokenFile,
+		CAFile:       o.BrokerCAFile,
+		CertFile:     o.BrokerCertFile,
+		KeyFile:      o.BrokerKeyFile,
+		Insecure:     o.BrokerInsecure,
+	}
+	if *a == (ClientAuth{}) {
+		return nil
+	}
+	return a
+}
+
+// file returns the file holding key: the one set, or the key of the secret.
+// Keys missing from the secret are not set.
+func (a *ClientAuth) file(set, key string) string {
+	if set != "" || a.Secret == "" {
+		return set
+	}
+	path := filepath.Join(a.Secret, key)
+	if _, err := os.Stat(path); err != nil {
+		return ""
+	}
+	return path
+}
+
+// credentials is what the files of a ClientAuth held when last read.
+type credentials struct {
+	auth      *osb.AuthConfig
+	tls       *tls.Config
+	insecure  bool
+	signature []byte
+}
+
+// loadCredentials reads the files of a. A nil ClientAuth has no
+// credentials.
+func loadCredentials(a *ClientAuth) (*credentials, error) {
+	if a == nil {
+		return &credentials{}, nil
+	}
+	read := make(map[string][]byte)
+	signature := sha256.New()
+	for key, set := range map[string]string{
+		secretUsername: a.UsernameFile,
+		secretPassword: a.PasswordFile,
+		secretToken:    a.TokenFile,
+		secretCA:       a.CAFile,
+		secretCert:     a.CertFile,
+		secretKey:      a.KeyFile,
+	} {
+		path := a.file(set, key)
+		if path == "" {
+			continue
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		read[key] = data
+	}
+	for _, key := range []string{secretUsername, secretPassword, secretToken, secretCA, secretCert, secretKey} {
+		fmt.Fprintf(signature, "%s:%d:", key, len(read[key]))
+		signature.Write(read[key])
+	}
+
+	c := &credentials{insecure: a.Insecure, signature: signature.Sum(nil)}
+
+	username := string(bytes.TrimSpace(read[secretUsername]))
+	token := string(bytes.TrimSpace(read[secretToken]))
+	switch {
+	case username != "" && token != "":
+		return nil, fmt.Errorf("both basic auth and a bearer token are set up")
+	case username != "":
+		c.auth = &osb.AuthConfig{BasicAuthConfig: &osb.BasicAuthConfig{
+			Username: username,
+			Password: string(bytes.TrimSpace(read[secretPassword])),
+		}}
+	case token != "":
+		c.auth = &osb.AuthConfig{BearerConfig: &osb.BearerConfig{Token: token}}
+	}
+
+	cert, key := read[secretCert], read[secretKey]
+	if ca := read[secretCA]; ca != nil || cert != nil || key != nil {
+		c.tls = &tls.Config{}
+	}
+	if ca := read[secretCA]; ca != nil {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates in the CA bundle")
+		}
+		c.tls.RootCAs = pool
+	}
+	if cert != nil || key != nil {
+		pair, err := tls.X509KeyPair(cert, key)
+		if err != nil {
+			return nil, fmt.Errorf("client certificate: %v", err)
+		}
+		c.tls.Certificates = []tls.Certificate{pair}
+	}
+	return c, nil
+}
+
+// configure sets up config with c.
+func (c *credentials) configure(config *osb.ClientConfiguration) {
+	config.AuthConfig = c.auth
+	config.Insecure = c.insecure
+	if c.tls != nil {
+		config.TLSConfig = c.tls.Clone()
+	}
+}
+
+// transport returns the transport the header forwarder reaches a backend
+// with.
+func (c *credentials) transport() http.RoundTripper {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if c.tls != nil {
+		transport.TLSClientConfig = c.tls.Clone()
+	}
+	if c.insecure {
+		if transport.TLSClientConfig == nil {
+			transport.TLSClientConfig = &tls.Config{}
+		}
+		transport.TLSClientConfig.InsecureSkipVerify = true
+	}
+	return transport
+}
+
+// reloadCredentials rereads the credentials of the backend, and rebuilds the
+// clients of its replicas when they changed.
+func (b *backend) reloadCredentials() (bool, error) {
+	c, err := loadCredentials(b.auth)
+	if err != nil {
+		return false, err
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if bytes.Equal(c.signature, b.credentials.signature) {
+		return false, nil
+	}
+	for _, r := range b.replicas {
+		if err := r.build(c); err != nil {
+			return false, err
+		}
+	}
+	b.credentials = c
+	return true, nil
+}
+
+// startCredentialReload rereads the credentials of the backends every
+// interval.
+func (b *BusinessLogic) startCredentialReload(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			for _, backend := range b.backends {
+				changed, err := backend.reloadCredentials()
+				if err != nil {
+					glog.Errorf("backend %s: keeping the previous credentials: %v", backend.name, err)
+				} else if changed {
+					glog.Infof("backend %s: reloaded the credentials", backend.name)
+				}
+			}
+		}
+	}()
+}
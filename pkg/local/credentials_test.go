@@ -0,0 +1,82 @@
+package local
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/n3wscott/k8s-broker-proxy/pkg/apiversion"
+)
+
+func writeSecret(t *testing.T, dir, key, value string) {
+	if err := ioutil.WriteFile(filepath.Join(dir, key), []byte(value), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCredentialsFromSecret(t *testing.T) {
+	secret := t.TempDir()
+	writeSecret(t, secret, secretUsername, "admin\n")
+	writeSecret(t, secret, secretPassword, "secret\n")
+
+	c, err := loadCredentials(&ClientAuth{Secret: secret})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.auth == nil || c.auth.BasicAuthConfig == nil || c.auth.BasicAuthConfig.Username != "admin" || c.auth.BasicAuthConfig.Password != "secret" {
+		t.Errorf("expected basic auth from the secret, got %+v", c.auth)
+	}
+	if c.tls != nil {
+		t.Errorf("expected no TLS settings, got %+v", c.tls)
+	}
+
+	// A file set explicitly wins over the secret.
+	token := filepath.Join(t.TempDir(), "token")
+	if err := ioutil.WriteFile(token, []byte("t0ken"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadCredentials(&ClientAuth{Secret: secret, TokenFile: token}); err == nil {
+		t.Error("expected basic auth and a bearer token together to be refused")
+	}
+	c, err = loadCredentials(&ClientAuth{TokenFile: token})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.auth == nil || c.auth.BearerConfig == nil || c.auth.BearerConfig.Token != "t0ken" {
+		t.Errorf("expected a bearer token, got %+v", c.auth)
+	}
+
+	writeSecret(t, secret, secretCA, "not a certificate")
+	if _, err := loadCredentials(&ClientAuth{Secret: secret}); err == nil {
+		t.Error("expected a CA bundle without certificates to be refused")
+	}
+}
+
+func TestCredentialsReload(t *testing.T) {
+	secret := t.TempDir()
+	writeSecret(t, secret, secretToken, "first")
+	backend, err := newBackend(BackendConfig{Name: "mysql", URL: "http://mysql", Auth: &ClientAuth{Secret: secret}}, apiversion.Range{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if changed, err := backend.reloadCredentials(); err != nil || changed {
+		t.Errorf("expected unchanged credentials, got %v, %v", changed, err)
+	}
+
+	writeSecret(t, secret, secretToken, "second")
+	if changed, err := backend.reloadCredentials(); err != nil || !changed {
+		t.Errorf("expected the new token to be picked up, got %v, %v", changed, err)
+	}
+	if token := backend.credentials.auth.BearerConfig.Token; token != "second" {
+		t.Errorf("expected the new token, got %q", token)
+	}
+
+	writeSecret(t, secret, secretCA, "not a certificate")
+	if _, err := backend.reloadCredentials(); err == nil {
+		t.Error("expected broken credentials to be refused")
+	}
+	if token := backend.credentials.auth.BearerConfig.Token; token != "second" {
+		t.Errorf("expected the previous credentials to be kept, got %q", token)
+	}
+}
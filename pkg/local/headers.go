@@ -0,0 +1,342 @@
+package local
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	"github.com/pmorie/osb-broker-lib/pkg/broker"
+)
+
+// The osb client sends the headers of the OSB spec it knows of, and no
+// others. The rest of the headers the proxy forwards, such as the request
+// identity, are added by a forwarder on the loopback interface: a request
+// that carries them is sent by a client of the forwarder, whose URL holds a
+// random token, and the forwarder passes it on to the replica with the
+// headers registered under the token for as long as the request lasts. A
+// token that is not in use is refused, so that nothing else on the host can
+// use the forwarder to reach the backend as the local side.
+
+// The errors the forwarder answers with when it cannot reach the replica,
+// telling failing to connect apart from failing later on.
+const (
+	backendUnreachable = "BackendUnreachable"
+	backendUnavailable = "BackendUnavailable"
+)
+
+// maxIdleForwardingClients is how many clients of the forwarder a replica
+// keeps for reuse, per API version.
+const maxIdleForwardingClients = 8
+
+// unforwardable are the headers never sent on to the backend, whatever the
+// allowlist says: those the client sets itself, and those about the
+// connection or the body of the request from the proxy.
+var unforwardable = headerSet(
+	osb.APIVersionHeader,
+	osb.OriginatingIdentityHeader,
+	"Authorization",
+	"Connection",
+	"Host",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+)
+
+func headerSet(keys ...string) map[string]bool {
+	set := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		set[http.CanonicalHeaderKey(key)] = true
+	}
+	return set
+}
+
+// forwardedHeaders returns the headers of the request to send on to the
+// backend, besides those the client sets: the ones in b.forwardHeaders.
+func (b *BusinessLogic) forwardedHeaders(c *broker.RequestContext) http.Header {
+	if c == nil || c.Request == nil {
+		return nil
+	}
+	var header http.Header
+	for _, key := range b.forwardHeaders {
+		key = http.CanonicalHeaderKey(key)
+		values := c.Request.Header[key]
+		if len(values) == 0 || unforwardable[key] || strings.HasPrefix(key, "Content-") {
+			continue
+		}
+		if header == nil {
+			header = make(http.Header)
+		}
+		header[key] = values
+	}
+	return header
+}
+
+// headerForwarder passes the requests of a replica's forwarding clients on,
+// with the headers registered under the token of their URL.
+type headerForwarder struct {
+	url    string
+	target string
+	proxy  *httputil.ReverseProxy
+	server *http.Server
+
+	mutex     sync.RWMutex
+	transport http.RoundTripper
+	headers   map[string]http.Header
+}
+
+// newHeaderForwarder serves the forwarder of the replica at target on a
+// loopback port.
+func newHeaderForwarder(target string, transport http.RoundTripper) (*headerForwarder, error) {
+	to, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	f := &headerForwarder{
+		url:       "http://" + listener.Addr().String(),
+		target:    target,
+		transport: transport,
+		headers:   make(map[string]http.Header),
+	}
+	f.proxy = httputil.NewSingleHostReverseProxy(to)
+	f.proxy.Transport = f
+	f.proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		code := backendUnavailable
+		var opErr *net.OpError
+		if errors.As(err, &opErr) && opErr.Op == "dial" {
+			code = backendUnreachable
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadGateway)
+		json.NewEncoder(w).Encode(map[string]string{"error": code, "description": err.Error()})
+	}
+
+	// The connections of clients that are not kept for reuse are closed
+	// once idle.
+	f.server = &http.Server{Handler: f, ReadHeaderTimeout: 10 * time.Second, IdleTimeout: time.Minute}
+	go func() {
+		if err := f.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			glog.Errorf("header forwarder for %s stopped: %v", target, err)
+		}
+	}()
+	return f, nil
+}
+
+// newToken returns a token for a client of the forwarder.
+func newToken() (string, error) {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(token), nil
+}
+
+// clientURL returns the URL of the client with token.
+func (f *headerForwarder) clientURL(token string) string {
+	return f.url + "/" + token
+}
+
+// register has the forwarder send header with the requests of the client
+// with token, until unregistered.
+func (f *headerForwarder) register(token string, header http.Header) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.headers[token] = header
+}
+
+func (f *headerForwarder) unregister(token string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	delete(f.headers, token)
+}
+
+// redact takes the URL of the client with token out of err, as errors are
+// logged and sent back through the tunnel.
+func (f *headerForwarder) redact(err error, token string) error {
+	urlErr, ok := err.(*url.Error)
+	if !ok {
+		return err
+	}
+	redacted := *urlErr
+	redacted.URL = strings.Replace(urlErr.URL, f.clientURL(token), f.target, 1)
+	return &redacted
+}
+
+func (f *headerForwarder) close() error {
+	return f.server.Close()
+}
+
+func (f *headerForwarder) setTransport(transport http.RoundTripper) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.transport = transport
+}
+
+func (f *headerForwarder) RoundTrip(r *http.Request) (*http.Response, error) {
+	f.mutex.RLock()
+	transport := f.transport
+	f.mutex.RUnlock()
+	return transport.RoundTrip(r)
+}
+
+func (f *headerForwarder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	f.mutex.RLock()
+	header, ok := f.headers[parts[0]]
+	f.mutex.RUnlock()
+	if len(parts) != 2 || !ok {
+		http.NotFound(w, r)
+		return
+	}
+	// The headers the client set, such as its credentials, are its own.
+	for key, values := range header {
+		if _, set := r.Header[key]; !set {
+			r.Header[key] = values
+		}
+	}
+	r.URL.Path = "/" + parts[1]
+	r.URL.RawPath = ""
+	f.proxy.ServeHTTP(w, r)
+}
+
+// forwardingClient is a client of a forwarder, with the token of its URL.
+type forwardingClient struct {
+	osb.Client
+	forwarder *headerForwarder
+	token     string
+	// generation is the one of the replica's clients it was built with.
+	generation int
+}
+
+// headerClient is the osb.Client of a replica for a request with headers to
+// forward. Each call borrows a client of the forwarder and registers the
+// headers under its token while the call lasts.
+type headerClient struct {
+	replica *replica
+	version string
+	header  http.Header
+}
+
+func (h *headerClient) do(call func(client osb.Client) error) error {
+	client, err := h.replica.borrow(h.version)
+	if err != nil {
+		return err
+	}
+	defer h.replica.release(h.version, client)
+
+	client.forwarder.register(client.token, h.header)
+	defer client.forwarder.unregister(client.token)
+	return client.forwarder.redact(call(client.Client), client.token)
+}
+
+func (h *headerClient) GetCatalog() (resp *osb.CatalogResponse, err error) {
+	err = h.do(func(client osb.Client) error {
+		resp, err = client.GetCatalog()
+		return err
+	})
+	return resp, err
+}
+
+func (h *headerClient) ProvisionInstance(r *osb.ProvisionRequest) (resp *osb.ProvisionResponse, err error) {
+	err = h.do(func(client osb.Client) error {
+		resp, err = client.ProvisionInstance(r)
+		return err
+	})
+	return resp, err
+}
+
+func (h *headerClient) UpdateInstance(r *osb.UpdateInstanceRequest) (resp *osb.UpdateInstanceResponse, err error) {
+	err = h.do(func(client osb.Client) error {
+		resp, err = client.UpdateInstance(r)
+		return err
+	})
+	return resp, err
+}
+
+func (h *headerClient) DeprovisionInstance(r *osb.DeprovisionRequest) (resp *osb.DeprovisionResponse, err error) {
+	err = h.do(func(client osb.Client) error {
+		resp, err = client.DeprovisionInstance(r)
+		return err
+	})
+	return resp, err
+}
+
+func (h *headerClient) PollLastOperation(r *osb.LastOperationRequest) (resp *osb.LastOperationResponse, err error) {
+	err = h.do(func(client osb.Client) error {
+		resp, err = client.PollLastOperation(r)
+		return err
+	})
+	return resp, err
+}
+
+func (h *headerClient) PollBindingLastOperation(r *osb.BindingLastOperationRequest) (resp *osb.LastOperationResponse, err error) {
+	err = h.do(func(client osb.Client) error {
+		resp, err = client.PollBindingLastOperation(r)
+		return err
+	})
+	return resp, err
+}
+
+func (h *headerClient) Bind(r *osb.BindRequest) (resp *osb.BindResponse, err error) {
+	err = h.do(func(client osb.Client) error {
+		resp, err = client.Bind(r)
+		return err
+	})
+	return resp, err
+}
+
+func (h *headerClient) Unbind(r *osb.UnbindRequest) (resp *osb.UnbindResponse, err error) {
+	err = h.do(func(client osb.Client) error {
+		resp, err = client.Unbind(r)
+		return err
+	})
+	return resp, err
+}
+
+func (h *headerClient) GetInstance(r *osb.GetInstanceRequest) (resp *osb.GetInstanceResponse, err error) {
+	err = h.do(func(client osb.Client) error {
+		resp, err = client.GetInstance(r)
+		return err
+	})
+	return resp, err
+}
+
+func (h *headerClient) GetBinding(r *osb.GetBindingRequest) (resp *osb.GetBindingResponse, err error) {
+	err = h.do(func(client osb.Client) error {
+		resp, err = client.GetBinding(r)
+		return err
+	})
+	return resp, err
+}
+
+// forwarderError tells whether err is the forwarder's answer with code.
+func forwarderError(err error, codes ...string) bool {
+	httpErr, ok := osb.IsHTTPError(err)
+	if !ok || httpErr.StatusCode != http.StatusBadGateway || httpErr.ErrorMessage == nil {
+		return false
+	}
+	for _, code := range codes {
+		if *httpErr.ErrorMessage == code {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,172 @@
+package local
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/n3wscott/k8s-broker-proxy/pkg/apiversion"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	"github.com/pmorie/osb-broker-lib/pkg/broker"
+)
+
+func TestForwardedHeadersAreAllowlisted(t *testing.T) {
+	b := &BusinessLogic{forwardHeaders: []string{"X-Broker-API-Request-Identity", osb.OriginatingIdentityHeader, "Authorization", "Connection", "Content-Type"}}
+	request := httptest.NewRequest("GET", "/", nil)
+	request.Header.Set("X-Broker-API-Request-Identity", "e26cfe5e-e9e7-4b32-b9f4-1e1f2bdaebd6")
+	request.Header.Set(osb.OriginatingIdentityHeader, "kubernetes e30=")
+	request.Header.Set("Authorization", "Bearer proxy")
+	request.Header.Set("Connection", "close")
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("X-Unlisted", "value")
+
+	header := b.forwardedHeaders(&broker.RequestContext{Request: request})
+	if len(header) != 1 || header.Get("X-Broker-API-Request-Identity") == "" {
+		t.Errorf("expected only the request identity to be forwarded, got %v", header)
+	}
+}
+
+func TestForwardedHeadersReachTheBackend(t *testing.T) {
+	received := make(chan *http.Request, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r
+		w.Write([]byte(`{"services": []}`))
+	}))
+	defer backend.Close()
+
+	f, err := newHeaderForwarder(backend.URL, http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.close()
+	token, err := newToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.register(token, http.Header{
+		"X-Broker-Api-Request-Identity": {"e26cfe5e-e9e7-4b32-b9f4-1e1f2bdaebd6"},
+		"Authorization":                 {"Bearer forwarded"},
+	})
+
+	// Send the request the way the client would.
+	request, err := http.NewRequest("GET", f.clientURL(token)+"/v2/catalog", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Set("Authorization", "Bearer client")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	got := <-received
+	if got.URL.Path != "/v2/catalog" {
+		t.Errorf("expected the catalog to be fetched, got %s", got.URL.Path)
+	}
+	if id := got.Header.Get("X-Broker-API-Request-Identity"); id != "e26cfe5e-e9e7-4b32-b9f4-1e1f2bdaebd6" {
+		t.Errorf("expected the request identity to reach the backend, got %q", id)
+	}
+	if auth := got.Header.Get("Authorization"); auth != "Bearer client" {
+		t.Errorf("expected the client's credentials to be kept, got %q", auth)
+	}
+
+	// Nothing but the local side's clients, while they are making a request,
+	// can use the forwarder.
+	f.unregister(token)
+	for _, url := range []string{f.clientURL(token), f.clientURL(strings.Repeat("0", len(token)))} {
+		response, err := http.Get(url + "/v2/catalog")
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		if response.StatusCode != http.StatusNotFound {
+			t.Errorf("expected a token not in use to be refused, got %d", response.StatusCode)
+		}
+	}
+}
+
+func TestForwardingClientsAreReused(t *testing.T) {
+	r, err := newReplica("backend", "http://127.0.0.1:1", apiversion.Range{}, &credentials{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.close()
+	if _, ok := r.clientFor("", http.Header{"X-Broker-Api-Request-Identity": {"id"}}); !ok {
+		t.Fatal("expected a client")
+	}
+
+	first, err := r.borrow("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := r.borrow("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.token == second.token {
+		t.Fatal("expected concurrent requests to use clients of their own")
+	}
+	r.release("", first)
+	if again, _ := r.borrow(""); again != first {
+		t.Error("expected an idle client to be reused")
+	}
+
+	// Clients built with credentials that changed since are dropped.
+	if err := r.build(&credentials{}); err != nil {
+		t.Fatal(err)
+	}
+	r.release("", second)
+	if again, _ := r.borrow(""); again == second {
+		t.Error("expected a client from before the rebuild not to be reused")
+	}
+}
+
+func TestForwarderURLIsRedacted(t *testing.T) {
+	f, err := newHeaderForwarder("https://broker.example.com", http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.close()
+
+	err = f.redact(&url.Error{Op: "Get", URL: f.clientURL("token") + "/v2/catalog", Err: errors.New("EOF")}, "token")
+	if strings.Contains(err.Error(), "token") || !strings.Contains(err.Error(), "https://broker.example.com/v2/catalog") {
+		t.Errorf("expected the replica's URL in the error, got %v", err)
+	}
+}
+
+func TestForwarderTellsConnectionErrorsApart(t *testing.T) {
+	// A port nothing listens on.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := "http://" + listener.Addr().String()
+	listener.Close()
+
+	f, err := newHeaderForwarder(target, http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.close()
+	f.register("token", http.Header{"X-Broker-Api-Request-Identity": {"id"}})
+	response, err := http.Get(f.clientURL("token") + "/v2/catalog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	body := map[string]string{}
+	if err := json.NewDecoder(response.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+
+	code := body["error"]
+	err = osb.HTTPStatusCodeError{StatusCode: response.StatusCode, ErrorMessage: &code}
+	if !isConnectionError(err) || !isTransportError(err) {
+		t.Errorf("expected a connection error, got %d %q", response.StatusCode, code)
+	}
+}
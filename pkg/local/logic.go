@@ -1,13 +1,17 @@
 package local
 
 import (
+	"encoding/base64"
+	"strings"
+
 	"github.com/golang/glog"
 	"github.com/gorilla/mux"
 	"github.com/n3wscott/k8s-broker-proxy/messages"
+	"github.com/n3wscott/k8s-broker-proxy/pkg/apiversion"
 	"github.com/n3wscott/k8s-broker-proxy/pkg/cli"
 	"github.com/pmorie/osb-broker-lib/pkg/broker"
 
-	"encoding/json"
+	"time"
 
 	"github.com/n3wscott/k8s-broker-proxy/pkg/binding"
 	osb "github.com/pmorie/go-open-service-broker-client/v2"
@@ -29,22 +33,36 @@ func NewBusinessLogic(o cli.Options) (*BusinessLogic, error) {
 		glog.Fatal(err)
 	}
 
-	config := osb.DefaultClientConfiguration()
-	config.URL = o.BrokerUrl
+	apiVersions, err := apiversion.NewRange(o.MinAPIVersion, o.MaxAPIVersion)
+	if err != nil {
+		return nil, err
+	}
 
-	client, err := osb.NewClient(config)
+	configs, err := backendConfigs(o)
 	if err != nil {
-		glog.Fatal(err)
 		return nil, err
 	}
+	var backends []*backend
+	for _, c := range configs {
+		backend, err := newBackend(c, apiVersions)
+		if err != nil {
+			return nil, err
+		}
+		backends = append(backends, backend)
+	}
 
 	b := &BusinessLogic{
-		async:  o.Async,
-		reg:    reg,
-		client: client,
+		async:             o.Async,
+		heartbeatInterval: o.HeartbeatInterval,
+		reg:               reg,
+		apiVersions:       apiVersions,
+		forwardHeaders:    cli.HeaderNames(o.ForwardHeaders),
+		backends:          backends,
 	}
 
 	b.RegisterSinks()
+	b.startHealthChecks(o.HealthInterval)
+	b.startCredentialReload(o.CredentialsReload)
 
 	return b, nil
 }
@@ -55,110 +73,49 @@ type BusinessLogic struct {
 	// Indicates if the broker should handle the requests asynchronously.
 	async bool
 
-	reg *messages.Registry
-
-	client osb.Client
-}
-
-type ResponseBody struct {
-	Response interface{} `json:"response"`
-	Error    interface{} `json:"error"`
-}
-
-func (b *BusinessLogic) RegisterSinks() {
-	glog.Info("RegisterSinks")
-	b.reg.Sink("GetCatalog", b.sinkGetCatalog)
-	b.reg.Sink("Provision", b.sinkProvision)
-	b.reg.Sink("Deprovision", b.sinkDeprovision)
-	b.reg.Sink("LastOperation", b.sinkLastOperation)
-	b.reg.Sink("Bind", b.sinkBind)
-	b.reg.Sink("Unbind", b.sinkUnbind)
-	b.reg.Sink("Update", b.sinkUpdate)
-}
-
-func convertBodyTo(body interface{}, req interface{}) {
-	if body != nil {
-		if data, err := json.Marshal(body); err != nil {
-			glog.Error(err)
-		} else if err := json.Unmarshal(data, req); err != nil {
-			glog.Error(err)
-		}
-	}
-}
+	// How often to report progress on a request that is still being served.
+	heartbeatInterval time.Duration
 
-func (b *BusinessLogic) sinkGetCatalog(id string, body interface{}) {
-	glog.Info("sinkGetCatalog ", id)
-	resp, err := b.GetCatalog(nil)
-	b.reg.VentWith(id, "GetCatalog", ResponseBody{
-		Response: resp,
-		Error:    err,
-	})
-}
-
-func (b *BusinessLogic) sinkProvision(id string, body interface{}) {
-	var request osb.ProvisionRequest
-	convertBodyTo(body, &request)
-
-	resp, err := b.Provision(&request, nil)
-	b.reg.VentWith(id, "Provision", ResponseBody{
-		Response: resp,
-		Error:    err,
-	})
-}
+	reg *messages.Registry
 
-func (b *BusinessLogic) sinkDeprovision(id string, body interface{}) {
-	var request osb.DeprovisionRequest
-	convertBodyTo(body, &request)
+	// The OSB API versions passed on to the broker.
+	apiVersions apiversion.Range
+	// The headers forwarded by the proxy that are passed on to the broker.
+	forwardHeaders []string
 
-	resp, err := b.Deprovision(&request, nil)
-	b.reg.VentWith(id, "Deprovision", ResponseBody{
-		Response: resp,
-		Error:    err,
-	})
+	// The brokers requests are forwarded to, and which serves what.
+	backends []*backend
+	routes   backendRoutes
 }
 
-func (b *BusinessLogic) sinkLastOperation(id string, body interface{}) {
-	var request osb.LastOperationRequest
-	convertBodyTo(body, &request)
-
-	resp, err := b.LastOperation(&request, nil)
-	b.reg.VentWith(id, "LastOperation", ResponseBody{
-		Response: resp,
-		Error:    err,
-	})
+// versionedClient is an osb.Client with the API version it speaks.
+type versionedClient struct {
+	osb.Client
+	version osb.APIVersion
 }
 
-func (b *BusinessLogic) sinkBind(id string, body interface{}) {
-	var request osb.BindRequest
-	convertBodyTo(body, &request)
-
-	resp, err := b.Bind(&request, nil)
-	b.reg.VentWith(id, "Bind", ResponseBody{
-		Response: resp,
-		Error:    err,
-	})
+// retrievable tells whether the client can fetch instances and bindings.
+func (c versionedClient) retrievable() bool {
+	return c.version.AtLeast(osb.Version2_14())
 }
 
-func (b *BusinessLogic) sinkUnbind(id string, body interface{}) {
-	var request osb.UnbindRequest
-	convertBodyTo(body, &request)
-
-	resp, err := b.Unbind(&request, nil)
-	b.reg.VentWith(id, "Unbind", ResponseBody{
-		Response: resp,
-		Error:    err,
-	})
+// Close stops the header forwarders of the backends.
+func (b *BusinessLogic) Close() {
+	for _, backend := range b.backends {
+		backend.close()
+	}
 }
 
-func (b *BusinessLogic) sinkUpdate(id string, body interface{}) {
-	var request osb.UpdateInstanceRequest
-	convertBodyTo(body, &request)
-
-	resp, err := b.Update(&request, nil)
-	b.reg.VentWith(id, "Update", ResponseBody{
-		Response: resp,
-		Error:    err,
-	})
+// RegisterSinks serves every tunneled operation from this BusinessLogic.
+func (b *BusinessLogic) RegisterSinks() {
+	glog.Info("RegisterSinks")
+	server := messages.NewServer(b.reg, b)
+	if b.heartbeatInterval > 0 {
+		server.HeartbeatInterval = b.heartbeatInterval
+	}
+	if err := server.Register(); err != nil {
+		glog.Error(err)
+	}
 }
 
 func (b *BusinessLogic) AdditionalRouting(router *mux.Router) {
@@ -173,7 +130,7 @@ func truePtr() *bool {
 }
 
 func (b *BusinessLogic) GetCatalog(c *broker.RequestContext) (*broker.CatalogResponse, error) {
-	resp, err := b.client.GetCatalog()
+	resp, err := b.mergeCatalogs(c)
 
 	if err != nil {
 		glog.Error("GetCatalog failed with ", err)
@@ -186,7 +143,15 @@ func (b *BusinessLogic) GetCatalog(c *broker.RequestContext) (*broker.CatalogRes
 }
 
 func (b *BusinessLogic) Provision(request *osb.ProvisionRequest, c *broker.RequestContext) (*broker.ProvisionResponse, error) {
-	resp, err := b.client.ProvisionInstance(request)
+	client, err := b.clientFor(c, request.ServiceID, request.InstanceID)
+	if err != nil {
+		return nil, err
+	}
+	if identity := originatingIdentity(c); identity != nil {
+		request.OriginatingIdentity = identity
+	}
+
+	resp, err := client.ProvisionInstance(request)
 
 	if err != nil {
 		glog.Error("ProvisionInstance failed with ", err)
@@ -199,12 +164,28 @@ func (b *BusinessLogic) Provision(request *osb.ProvisionRequest, c *broker.Reque
 }
 
 func (b *BusinessLogic) Deprovision(request *osb.DeprovisionRequest, c *broker.RequestContext) (*broker.DeprovisionResponse, error) {
-	resp, err := b.client.DeprovisionInstance(request)
+	client, err := b.clientFor(c, request.ServiceID, request.InstanceID)
+	if err != nil {
+		return nil, err
+	}
+	if identity := originatingIdentity(c); identity != nil {
+		request.OriginatingIdentity = identity
+	}
+
+	resp, err := client.DeprovisionInstance(request)
 
+	if gone(err) {
+		b.routes.forgetInstance(request.InstanceID)
+	}
 	if err != nil {
 		glog.Error("DeprovisionInstance failed with ", err)
 		return nil, err
 	}
+	if resp.Async {
+		b.routes.setDeleting(request.InstanceID, true)
+	} else {
+		b.routes.forgetInstance(request.InstanceID)
+	}
 
 	return &broker.DeprovisionResponse{
 		DeprovisionResponse: *resp,
@@ -212,8 +193,24 @@ func (b *BusinessLogic) Deprovision(request *osb.DeprovisionRequest, c *broker.R
 }
 
 func (b *BusinessLogic) LastOperation(request *osb.LastOperationRequest, c *broker.RequestContext) (*broker.LastOperationResponse, error) {
-	resp, err := b.client.PollLastOperation(request)
+	if identity := originatingIdentity(c); identity != nil {
+		request.OriginatingIdentity = identity
+	}
 
+	var resp *osb.LastOperationResponse
+	err := b.call(c, deref(request.ServiceID), request.InstanceID, func(client versionedClient) (err error) {
+		resp, err = client.PollLastOperation(request)
+		return err
+	})
+
+	if b.routes.isDeleting(request.InstanceID) {
+		switch {
+		case gone(err), err == nil && resp.State == osb.StateSucceeded:
+			b.routes.forgetInstance(request.InstanceID)
+		case err == nil && resp.State == osb.StateFailed:
+			b.routes.setDeleting(request.InstanceID, false)
+		}
+	}
 	if err != nil {
 		glog.Error("PollLastOperation failed with ", err)
 		return nil, err
@@ -225,7 +222,15 @@ func (b *BusinessLogic) LastOperation(request *osb.LastOperationRequest, c *brok
 }
 
 func (b *BusinessLogic) Bind(request *osb.BindRequest, c *broker.RequestContext) (*broker.BindResponse, error) {
-	resp, err := b.client.Bind(request)
+	client, err := b.clientFor(c, request.ServiceID, request.InstanceID)
+	if err != nil {
+		return nil, err
+	}
+	if identity := originatingIdentity(c); identity != nil {
+		request.OriginatingIdentity = identity
+	}
+
+	resp, err := client.Bind(request)
 
 	if err != nil {
 		glog.Error("Bind failed with ", err)
@@ -238,7 +243,15 @@ func (b *BusinessLogic) Bind(request *osb.BindRequest, c *broker.RequestContext)
 }
 
 func (b *BusinessLogic) Unbind(request *osb.UnbindRequest, c *broker.RequestContext) (*broker.UnbindResponse, error) {
-	resp, err := b.client.Unbind(request)
+	client, err := b.clientFor(c, request.ServiceID, request.InstanceID)
+	if err != nil {
+		return nil, err
+	}
+	if identity := originatingIdentity(c); identity != nil {
+		request.OriginatingIdentity = identity
+	}
+
+	resp, err := client.Unbind(request)
 
 	if err != nil {
 		glog.Error("Unbind failed with ", err)
@@ -251,7 +264,15 @@ func (b *BusinessLogic) Unbind(request *osb.UnbindRequest, c *broker.RequestCont
 }
 
 func (b *BusinessLogic) Update(request *osb.UpdateInstanceRequest, c *broker.RequestContext) (*broker.UpdateInstanceResponse, error) {
-	resp, err := b.client.UpdateInstance(request)
+	client, err := b.clientFor(c, request.ServiceID, request.InstanceID)
+	if err != nil {
+		return nil, err
+	}
+	if identity := originatingIdentity(c); identity != nil {
+		request.OriginatingIdentity = identity
+	}
+
+	resp, err := client.UpdateInstance(request)
 
 	if err != nil {
 		glog.Error("UpdateInstance failed with ", err)
@@ -263,7 +284,105 @@ func (b *BusinessLogic) Update(request *osb.UpdateInstanceRequest, c *broker.Req
 	}, err
 }
 
+var _ messages.InstanceRetriever = &BusinessLogic{}
+var _ messages.BindingRetriever = &BusinessLogic{}
+var _ messages.BindingOperationPoller = &BusinessLogic{}
+
+func (b *BusinessLogic) GetInstance(request *osb.GetInstanceRequest, c *broker.RequestContext) (*osb.GetInstanceResponse, error) {
+	var resp *osb.GetInstanceResponse
+	err := b.call(c, "", request.InstanceID, func(client versionedClient) (err error) {
+		resp, err = client.GetInstance(request)
+		return err
+	})
+
+	if err != nil {
+		glog.Error("GetInstance failed with ", err)
+		return nil, err
+	}
+
+	return resp, err
+}
+
+func (b *BusinessLogic) GetBinding(request *osb.GetBindingRequest, c *broker.RequestContext) (*osb.GetBindingResponse, error) {
+	var resp *osb.GetBindingResponse
+	err := b.call(c, "", request.InstanceID, func(client versionedClient) (err error) {
+		resp, err = client.GetBinding(request)
+		return err
+	})
+
+	if err != nil {
+		glog.Error("GetBinding failed with ", err)
+		return nil, err
+	}
+
+	return resp, err
+}
+
+func (b *BusinessLogic) BindingLastOperation(request *osb.BindingLastOperationRequest, c *broker.RequestContext) (*broker.LastOperationResponse, error) {
+	if identity := originatingIdentity(c); identity != nil {
+		request.OriginatingIdentity = identity
+	}
+
+	var resp *osb.LastOperationResponse
+	err := b.call(c, deref(request.ServiceID), request.InstanceID, func(client versionedClient) (err error) {
+		resp, err = client.PollBindingLastOperation(request)
+		return err
+	})
+
+	if err != nil {
+		glog.Error("PollBindingLastOperation failed with ", err)
+		return nil, err
+	}
+
+	return &broker.LastOperationResponse{
+		LastOperationResponse: *resp,
+	}, err
+}
+
+// originatingIdentity returns the platform's originating identity forwarded
+// by the proxy, or nil. The client sends it on from the request it is set on.
+func originatingIdentity(c *broker.RequestContext) *osb.OriginatingIdentity {
+	if c == nil || c.Request == nil {
+		return nil
+	}
+	header := c.Request.Header.Get(osb.OriginatingIdentityHeader)
+	if header == "" {
+		return nil
+	}
+	// The header is "<platform> <base64 encoded value>".
+	parts := strings.SplitN(header, " ", 2)
+	if len(parts) != 2 {
+		glog.Errorf("ignoring malformed %s header %q", osb.OriginatingIdentityHeader, header)
+		return nil
+	}
+	value, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		glog.Errorf("ignoring malformed %s header %q: %v", osb.OriginatingIdentityHeader, header, err)
+		return nil
+	}
+	return &osb.OriginatingIdentity{
+		Platform: parts[0],
+		Value:    string(value),
+	}
+}
+
+// ValidateBrokerAPIVersion rejects API versions outside of the configured
+// range, or that the client cannot speak, with 412 Precondition Failed.
 func (b *BusinessLogic) ValidateBrokerAPIVersion(version string) error {
-	glog.Info("ValidateBrokerAPIVersion")
+	if err := b.apiVersions.Check(version); err != nil {
+		return err
+	}
+	for _, backend := range b.backends {
+		if _, ok := backend.replicas[0].clientFor(version, nil); !ok {
+			return apiversion.PreconditionFailed("the broker client cannot speak API version " + version)
+		}
+	}
 	return nil
 }
+
+func deref(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
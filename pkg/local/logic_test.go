@@ -1 +1,28 @@
 package local
+
+import (
+	"net/http"
+	"testing"
+
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	"github.com/pmorie/osb-broker-lib/pkg/broker"
+)
+
+func TestOriginatingIdentity(t *testing.T) {
+	request := &http.Request{Header: http.Header{}}
+	c := &broker.RequestContext{Request: request}
+	if identity := originatingIdentity(c); identity != nil {
+		t.Errorf("expected no identity without the header, got %+v", identity)
+	}
+
+	request.Header.Set(osb.OriginatingIdentityHeader, "kubernetes eyJ1c2VybmFtZSI6ImFkbWluIn0=")
+	identity := originatingIdentity(c)
+	if identity == nil || identity.Platform != "kubernetes" || identity.Value != `{"username":"admin"}` {
+		t.Errorf("unexpected identity %+v", identity)
+	}
+
+	request.Header.Set(osb.OriginatingIdentityHeader, "kubernetes")
+	if identity := originatingIdentity(c); identity != nil {
+		t.Errorf("expected a malformed header to be ignored, got %+v", identity)
+	}
+}
@@ -0,0 +1,425 @@
+package local
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/n3wscott/k8s-broker-proxy/messages"
+	"github.com/n3wscott/k8s-broker-proxy/pkg/apiversion"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	"github.com/pmorie/osb-broker-lib/pkg/broker"
+)
+
+// A backend can run as several replicas of the same broker. They are health
+// checked by fetching their catalog. Reads are spread over the healthy
+// replicas and retried on the others when a replica cannot be reached;
+// mutations go to the first healthy replica, and move on to the next only
+// when it cannot be connected to, as only then is it certain the broker did
+// not act on them.
+
+// replica is one endpoint of a backend.
+type replica struct {
+	name        string
+	url         string
+	apiVersions apiversion.Range
+
+	mutex sync.Mutex
+	// client serves requests that do not say which API version to use, and
+	// clients, by version, the ones that do. configs are what they are built
+	// from, by version, empty for the default.
+	client  versionedClient
+	clients map[string]versionedClient
+	configs map[string]*osb.ClientConfiguration
+	// transport reaches the replica for the forwarder, started with the
+	// first request with headers to forward. idle are the clients of the
+	// forwarder kept for reuse, by version, from the generation of clients
+	// built last.
+	transport  http.RoundTripper
+	forwarder  *headerForwarder
+	idle       map[string][]*forwardingClient
+	generation int
+
+	healthy   bool
+	lastCheck time.Time
+	lastError string
+}
+
+func newReplica(name, url string, apiVersions apiversion.Range, c *credentials) (*replica, error) {
+	r := &replica{name: name, url: url, apiVersions: apiVersions, healthy: true}
+	if err := r.build(c); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// build sets up the clients of the replica with c.
+func (r *replica) build(c *credentials) error {
+	config := osb.DefaultClientConfiguration()
+	config.Name = r.name
+	config.URL = r.url
+	// Fetching instances and bindings are alpha features of the client, and
+	// need at least OSB 2.14.
+	config.EnableAlphaFeatures = true
+	c.configure(config)
+
+	client, err := osb.NewClient(config)
+	if err != nil {
+		return err
+	}
+	configs := map[string]*osb.ClientConfiguration{"": config}
+
+	// One client per supported version, for requests that carry the
+	// platform's version.
+	clients := make(map[string]versionedClient)
+	for _, version := range apiversion.ClientVersions {
+		v, err := apiversion.Parse(version.HeaderValue())
+		if err != nil || !r.apiVersions.Contains(v) {
+			continue
+		}
+		versioned := *config
+		versioned.APIVersion = version
+		c, err := osb.NewClient(&versioned)
+		if err != nil {
+			return err
+		}
+		clients[version.HeaderValue()] = versionedClient{Client: c, version: version}
+		configs[version.HeaderValue()] = &versioned
+	}
+	transport := c.transport()
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.client = versionedClient{Client: client, version: config.APIVersion}
+	r.clients = clients
+	r.configs = configs
+	r.transport = transport
+	r.generation++
+	r.idle = nil
+	if r.forwarder != nil {
+		r.forwarder.setTransport(transport)
+	}
+	return nil
+}
+
+// clientFor returns the client speaking version, empty for the default,
+// which sends header along with the request.
+func (r *replica) clientFor(version string, header http.Header) (versionedClient, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	client, ok := r.client, true
+	if version != "" {
+		client, ok = r.clients[version]
+	}
+	if !ok || len(header) == 0 || r.configs == nil {
+		return client, ok
+	}
+
+	if r.forwarder == nil {
+		forwarder, err := newHeaderForwarder(r.url, r.transport)
+		if err != nil {
+			glog.Errorf("backend %s: not forwarding headers to replica %s: %v", r.name, r.url, err)
+			return client, ok
+		}
+		r.forwarder = forwarder
+	}
+	return versionedClient{Client: &headerClient{replica: r, version: version, header: header}, version: client.version}, true
+}
+
+// borrow returns a client of the forwarder speaking version, to give back
+// with release.
+func (r *replica) borrow(version string) (*forwardingClient, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if idle := r.idle[version]; len(idle) > 0 {
+		client := idle[len(idle)-1]
+		r.idle[version] = idle[:len(idle)-1]
+		return client, nil
+	}
+
+	if r.forwarder == nil {
+		return nil, fmt.Errorf("the header forwarder of replica %s is closed", r.url)
+	}
+	token, err := newToken()
+	if err != nil {
+		return nil, err
+	}
+	config := *r.configs[version]
+	config.URL = r.forwarder.clientURL(token)
+	// The forwarder speaks TLS to the replica.
+	config.TLSConfig = nil
+	config.Insecure = false
+	client, err := osb.NewClient(&config)
+	if err != nil {
+		return nil, err
+	}
+	return &forwardingClient{Client: client, forwarder: r.forwarder, token: token, generation: r.generation}, nil
+}
+
+// release keeps client for reuse, unless the clients were rebuilt since it
+// was made or enough are kept already.
+func (r *replica) release(version string, client *forwardingClient) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if client.generation != r.generation || len(r.idle[version]) >= maxIdleForwardingClients {
+		return
+	}
+	if r.idle == nil {
+		r.idle = make(map[string][]*forwardingClient)
+	}
+	r.idle[version] = append(r.idle[version], client)
+}
+
+// close stops the forwarder of the replica.
+func (r *replica) close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.forwarder == nil {
+		return nil
+	}
+	err := r.forwarder.close()
+	r.forwarder = nil
+	r.idle = nil
+	r.generation++
+	return err
+}
+
+// observe records the outcome of a request to the replica. Only failures to
+// reach it make it unhealthy.
+func (r *replica) observe(backend string, err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.lastCheck = time.Now()
+	if err != nil && isTransportError(err) {
+		if r.healthy {
+			glog.Warningf("backend %s: replica %s is down: %v", backend, r.url, err)
+		}
+		r.healthy = false
+		r.lastError = err.Error()
+		return
+	}
+	if !r.healthy {
+		glog.Infof("backend %s: replica %s is back up", backend, r.url)
+	}
+	r.healthy = true
+	r.lastError = ""
+}
+
+func (r *replica) isHealthy() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.healthy
+}
+
+func (r *replica) health() messages.ReplicaHealth {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return messages.ReplicaHealth{
+		URL:       r.url,
+		Healthy:   r.healthy,
+		LastCheck: r.lastCheck,
+		LastError: r.lastError,
+	}
+}
+
+// isTransportError tells whether err is a failure to reach the broker, as
+// opposed to an answer from it.
+func isTransportError(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) || forwarderError(err, backendUnreachable, backendUnavailable)
+}
+
+// isConnectionError tells whether err is a failure to connect to the
+// broker, in which case it never saw the request.
+func isConnectionError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial" || forwarderError(err, backendUnreachable)
+}
+
+// order returns the replicas to try, the healthy ones first. Reads start at
+// the next healthy replica in turn, mutations at the first one.
+func (b *backend) order(read bool) []*replica {
+	var healthy, unhealthy []*replica
+	for _, r := range b.replicas {
+		if r.isHealthy() {
+			healthy = append(healthy, r)
+		} else {
+			unhealthy = append(unhealthy, r)
+		}
+	}
+	if read && len(healthy) > 1 {
+		start := int(atomic.AddUint32(&b.next, 1) % uint32(len(healthy)))
+		healthy = append(healthy[start:], healthy[:start]...)
+	}
+	return append(healthy, unhealthy...)
+}
+
+// checkHealth fetches the catalog of every replica.
+func (b *backend) checkHealth() {
+	for _, r := range b.replicas {
+		client, _ := r.clientFor("", nil)
+		_, err := client.GetCatalog()
+		r.observe(b.name, err)
+	}
+}
+
+func (b *backend) health() messages.BackendHealth {
+	health := messages.BackendHealth{Name: b.name}
+	for _, r := range b.replicas {
+		replica := r.health()
+		health.Healthy = health.Healthy || replica.Healthy
+		health.Replicas = append(health.Replicas, replica)
+	}
+	return health
+}
+
+// startHealthChecks checks the replicas of the backends every interval.
+func (b *BusinessLogic) startHealthChecks(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			for _, backend := range b.backends {
+				backend.checkHealth()
+			}
+		}
+	}()
+}
+
+var _ messages.HealthReporter = &BusinessLogic{}
+
+// Health reports the health of the backends to the proxy.
+func (b *BusinessLogic) Health(request *messages.HealthRequest, c *broker.RequestContext) (*messages.HealthResponse, error) {
+	response := &messages.HealthResponse{}
+	for _, backend := range b.backends {
+		response.Backends = append(response.Backends, backend.health())
+	}
+	return response, nil
+}
+
+// failoverClient is the osb.Client of a backend with several replicas. The
+// embedded client, the first replica's, serves what it does not override.
+type failoverClient struct {
+	osb.Client
+	backend *backend
+	version string
+	header  http.Header
+}
+
+// read calls f on the replicas in turn, until one can be reached.
+func (f *failoverClient) read(call func(client osb.Client) error) error {
+	var err error
+	for _, r := range f.backend.order(true) {
+		client, _ := r.clientFor(f.version, f.header)
+		err = call(client.Client)
+		r.observe(f.backend.name, err)
+		if !isTransportError(err) {
+			return err
+		}
+	}
+	return err
+}
+
+// mutate calls f on the replicas in turn, until one can be connected to.
+func (f *failoverClient) mutate(call func(client osb.Client) error) error {
+	var err error
+	for _, r := range f.backend.order(false) {
+		client, _ := r.clientFor(f.version, f.header)
+		err = call(client.Client)
+		r.observe(f.backend.name, err)
+		if !isConnectionError(err) {
+			return err
+		}
+		glog.Warningf("backend %s: failing over from replica %s: %v", f.backend.name, r.url, err)
+	}
+	return err
+}
+
+func (f *failoverClient) GetCatalog() (resp *osb.CatalogResponse, err error) {
+	err = f.read(func(client osb.Client) error {
+		resp, err = client.GetCatalog()
+		return err
+	})
+	return resp, err
+}
+
+func (f *failoverClient) ProvisionInstance(r *osb.ProvisionRequest) (resp *osb.ProvisionResponse, err error) {
+	err = f.mutate(func(client osb.Client) error {
+		resp, err = client.ProvisionInstance(r)
+		return err
+	})
+	return resp, err
+}
+
+func (f *failoverClient) UpdateInstance(r *osb.UpdateInstanceRequest) (resp *osb.UpdateInstanceResponse, err error) {
+	err = f.mutate(func(client osb.Client) error {
+		resp, err = client.UpdateInstance(r)
+		return err
+	})
+	return resp, err
+}
+
+func (f *failoverClient) DeprovisionInstance(r *osb.DeprovisionRequest) (resp *osb.DeprovisionResponse, err error) {
+	err = f.mutate(func(client osb.Client) error {
+		resp, err = client.DeprovisionInstance(r)
+		return err
+	})
+	return resp, err
+}
+
+func (f *failoverClient) PollLastOperation(r *osb.LastOperationRequest) (resp *osb.LastOperationResponse, err error) {
+	err = f.read(func(client osb.Client) error {
+		resp, err = client.PollLastOperation(r)
+		return err
+	})
+	return resp, err
+}
+
+func (f *failoverClient) PollBindingLastOperation(r *osb.BindingLastOperationRequest) (resp *osb.LastOperationResponse, err error) {
+	err = f.read(func(client osb.Client) error {
+		resp, err = client.PollBindingLastOperation(r)
+		return err
+	})
+	return resp, err
+}
+
+func (f *failoverClient) Bind(r *osb.BindRequest) (resp *osb.BindResponse, err error) {
+	err = f.mutate(func(client osb.Client) error {
+		resp, err = client.Bind(r)
+		return err
+	})
+	return resp, err
+}
+
+func (f *failoverClient) Unbind(r *osb.UnbindRequest) (resp *osb.UnbindResponse, err error) {
+	err = f.mutate(func(client osb.Client) error {
+		resp, err = client.Unbind(r)
+		return err
+	})
+	return resp, err
+}
+
+func (f *failoverClient) GetInstance(r *osb.GetInstanceRequest) (resp *osb.GetInstanceResponse, err error) {
+	err = f.read(func(client osb.Client) error {
+		resp, err = client.GetInstance(r)
+		return err
+	})
+	return resp, err
+}
+
+func (f *failoverClient) GetBinding(r *osb.GetBindingRequest) (resp *osb.GetBindingResponse, err error) {
+	err = f.read(func(client osb.Client) error {
+		resp, err = client.GetBinding(r)
+		return err
+	})
+	return resp, err
+}
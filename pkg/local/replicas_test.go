@@ -0,0 +1,85 @@
+package local
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/n3wscott/k8s-broker-proxy/pkg/apiversion"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+)
+
+var (
+	refused = &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	reset   = &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")}
+)
+
+// downClient fails every request with err.
+type downClient struct {
+	osb.Client
+	err   error
+	calls int
+}
+
+func (c *downClient) GetCatalog() (*osb.CatalogResponse, error) {
+	c.calls++
+	return nil, c.err
+}
+
+func (c *downClient) ProvisionInstance(r *osb.ProvisionRequest) (*osb.ProvisionResponse, error) {
+	c.calls++
+	return nil, c.err
+}
+
+func TestReplicasFailOverOnConnectionErrors(t *testing.T) {
+	down := &downClient{err: refused}
+	up := &fakeClient{service: "mysql", instances: make(map[string]bool)}
+	b := &BusinessLogic{backends: []*backend{{
+		name:     "mysql",
+		replicas: []*replica{newFakeReplica("down", down), newFakeReplica("up", up)},
+	}}}
+
+	if _, err := b.GetCatalog(nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Provision(&osb.ProvisionRequest{InstanceID: "db", ServiceID: "mysql", PlanID: "mysql-plan"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !up.instances["db"] {
+		t.Error("expected the provision to fail over to the healthy replica")
+	}
+
+	health := b.backends[0].health()
+	if !health.Healthy || health.Replicas[0].Healthy || !health.Replicas[1].Healthy {
+		t.Errorf("expected only the first replica to be down, got %+v", health)
+	}
+}
+
+func TestReplicasDoNotRetryMutationsThatMayHaveHappened(t *testing.T) {
+	first := &downClient{err: reset}
+	second := &downClient{}
+	backend := &backend{name: "mysql", replicas: []*replica{newFakeReplica("first", first), newFakeReplica("second", second)}}
+	client, err := backend.clientFor(nil, apiversion.Range{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.ProvisionInstance(&osb.ProvisionRequest{InstanceID: "db"}); err == nil {
+		t.Error("expected the error of the first replica")
+	}
+	if second.calls != 0 {
+		t.Error("expected a provision the broker may have seen not to be retried")
+	}
+
+	// Reads are safe to retry.
+	first.err = refused
+	first.calls, second.calls = 0, 0
+	for i := 0; i < 2; i++ {
+		if _, err := client.GetCatalog(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if first.calls != 0 || second.calls != 2 {
+		t.Errorf("expected reads to skip the unhealthy replica, got %d and %d calls", first.calls, second.calls)
+	}
+}
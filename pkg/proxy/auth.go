@@ -0,0 +1,312 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+	"github.com/n3wscott/k8s-broker-proxy/pkg/config"
+)
+
+// Platforms authenticate to the OSB API with basic auth or a bearer token.
+// Several credentials can be accepted at once, so that they can be rotated,
+// and they are read from files, such as the keys of a mounted Kubernetes
+// secret, which are reread as they change. A tenant without an auth file of
+// its own is served with the proxy's.
+
+// AuthConfig sets up how platforms authenticate to every route but the
+// metrics and health checks, and Routes how they do to the routes they
+// match, the first match winning.
+type AuthConfig struct {
+	PlatformAuth
+	Routes []RouteAuth `json:"routes,omitempty"`
+}
+
+// PlatformAuth lists the credentials accepted. Secrets are the directories
+// Kubernetes secrets are mounted in, each with a username and password, or a
+// token.
+type PlatformAuth struct {
+	Credentials []PlatformCredential `json:"credentials,omitempty"`
+	Secrets     []string             `json:"secrets,omitempty"`
+	// Anonymous lets requests without credentials through.
+	Anonymous bool `json:"anonymous,omitempty"`
+}
+
+// PlatformCredential is a username and the file with its password, or the
+// file with a bearer token.
+type PlatformCredential struct {
+	Username     string `json:"username,omitempty"`
+	PasswordFile string `json:"passwordFile,omitempty"`
+	TokenFile    string `json:"tokenFile,omitempty"`
+}
+
+// RouteAuth sets up authentication for the requests whose path, below the
+// tenant, starts with Prefix and whose method is one of Methods, any if none.
+type RouteAuth struct {
+	Prefix  string   `json:"prefix"`
+	Methods []string `json:"methods,omitempty"`
+	PlatformAuth
+}
+
+// LoadAuthConfig reads the platform authentication from a YAML or JSON file.
+func LoadAuthConfig(path string) (*AuthConfig, error) {
+	c := &AuthConfig{}
+	if err := config.Load(path, c); err != nil {
+		return nil, err
+	}
+	for _, route := range c.Routes {
+		if !strings.HasPrefix(route.Prefix, "/") {
+			return nil, fmt.Errorf("%s: route prefix %q does not start with /", path, route.Prefix)
+		}
+	}
+	return c, nil
+}
+
+// accepted is what a PlatformAuth held when last read. Only digests are
+// kept, so that they compare in constant time whatever their length.
+type accepted struct {
+	basic     [][]byte
+	tokens    [][]byte
+	anonymous bool
+}
+
+func digest(s string) []byte {
+	sum := sha256.Sum256([]byte(s))
+	return sum[:]
+}
+
+func readSecret(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return string(bytes.TrimSpace(data)), nil
+}
+
+func (p PlatformAuth) load() (*accepted, error) {
+	a := &accepted{anonymous: p.Anonymous}
+	add := func(username, password, token string) {
+		if username != "" {
+			a.basic = append(a.basic, digest(username+":"+password))
+		}
+		if token != "" {
+			a.tokens = append(a.tokens, digest(token))
+		}
+	}
+
+	for _, c := range p.Credentials {
+		var password, token string
+		var err error
+		if c.PasswordFile != "" {
+			if password, err = readSecret(c.PasswordFile); err != nil {
+				return nil, err
+			}
+		}
+		if c.TokenFile != "" {
+			if token, err = readSecret(c.TokenFile); err != nil {
+				return nil, err
+			}
+		}
+		if (c.Username == "") == (token == "") {
+			return nil, fmt.Errorf("credentials need either a username or a token")
+		}
+		add(c.Username, password, token)
+	}
+
+	for _, dir := range p.Secrets {
+		values := make(map[string]string)
+		for _, key := range []string{"username", "password", "token"} {
+			value, err := readSecret(filepath.Join(dir, key))
+			if err != nil && !os.IsNotExist(err) {
+				return nil, err
+			}
+			values[key] = value
+		}
+		if values["username"] == "" && values["token"] == "" {
+			return nil, fmt.Errorf("secret %s has neither a username nor a token", dir)
+		}
+		add(values["username"], values["password"], values["token"])
+	}
+	return a, nil
+}
+
+// allows tells whether r carries credentials a accepts. Every credential is
+// compared, so that the time taken does not tell which one came close.
+func (a *accepted) allows(r *http.Request) bool {
+	var candidates [][]byte
+	var presented []byte
+	if username, password, ok := r.BasicAuth(); ok {
+		candidates, presented = a.basic, digest(username+":"+password)
+	} else if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		candidates, presented = a.tokens, digest(strings.TrimSpace(strings.TrimPrefix(header, "Bearer ")))
+	} else {
+		return a.anonymous
+	}
+	match := 0
+	for _, candidate := range candidates {
+		match |= subtle.ConstantTimeCompare(candidate, presented)
+	}
+	return match == 1
+}
+
+// challenge is the WWW-Authenticate header of a 401 from a.
+func (a *accepted) challenge() string {
+	var schemes []string
+	if len(a.basic) != 0 {
+		schemes = append(schemes, `Basic realm="osb"`)
+	}
+	if len(a.tokens) != 0 {
+		schemes = append(schemes, `Bearer realm="osb"`)
+	}
+	return strings.Join(schemes, ", ")
+}
+
+// authenticator checks requests against an AuthConfig.
+type authenticator struct {
+	config *AuthConfig
+
+	mutex    sync.RWMutex
+	defaults *accepted
+	routes   []*accepted
+}
+
+func newAuthenticator(path string) (*authenticator, error) {
+	c, err := LoadAuthConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	a := &authenticator{config: c}
+	if err := a.reload(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return a, nil
+}
+
+// reload rereads the credentials, and keeps the previous ones if any of them
+// cannot be read.
+func (a *authenticator) reload() error {
+	defaults, err := a.config.load()
+	if err != nil {
+		return err
+	}
+	var routes []*accepted
+	for _, route := range a.config.Routes {
+		accepted, err := route.load()
+		if err != nil {
+			return fmt.Errorf("route %s: %v", route.Prefix, err)
+		}
+		routes = append(routes, accepted)
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.defaults, a.routes = defaults, routes
+	return nil
+}
+
+// acceptedFor returns what is accepted for a request with method to path,
+// nil when the route needs no authentication, which the metrics of a tenant
+// always do.
+func (a *authenticator) acceptedFor(method, path string, tenant bool) *accepted {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	for i, route := range a.config.Routes {
+		if strings.HasPrefix(path, route.Prefix) && (len(route.Methods) == 0 || hasMethod(route.Methods, method)) {
+			return a.routes[i]
+		}
+	}
+	if unauthenticated[path] && !(tenant && path == "/metrics") {
+		return nil
+	}
+	return a.defaults
+}
+
+// unauthenticated are the routes scraped and probed by the infrastructure
+// rather than called by platforms, which need no credentials unless a route
+// of the AuthConfig says otherwise. A tenant's metrics are its own, and need
+// its credentials.
+var unauthenticated = map[string]bool{
+	"/metrics": true,
+	"/healthz": true,
+	"/readyz":  true,
+	"/livez":   true,
+}
+
+func hasMethod(methods []string, method string) bool {
+	for _, m := range methods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// servedBy returns the proxy serving path, and path below its tenant.
+func (b *BusinessLogic) servedBy(path string) (*BusinessLogic, string) {
+	if rest := strings.TrimPrefix(path, "/tenants/"); rest != path {
+		name := rest
+		if i := strings.Index(rest, "/"); i >= 0 {
+			name = rest[:i]
+		}
+		if t, ok := b.tenants[name]; ok {
+			return t, strings.TrimPrefix(rest, name)
+		}
+	}
+	return b, path
+}
+
+// authRouting makes every route of router, the tenants' included, check the
+// credentials and client certificate of the platform.
+func (b *BusinessLogic) authRouting(router *mux.Router) {
+	router.Use(b.authenticate, b.authorize)
+}
+
+func (b *BusinessLogic) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxy, path := b.servedBy(r.URL.Path)
+		// CORS preflight requests carry no credentials.
+		if proxy.auth == nil || r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+		accepted := proxy.auth.acceptedFor(r.Method, path, proxy.tenant != "")
+		if accepted == nil || accepted.allows(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		glog.V(1).Infof("rejected %s %s from %s: bad or missing credentials", r.Method, r.URL.Path, r.RemoteAddr)
+		if challenge := accepted.challenge(); challenge != "" {
+			w.Header().Set("WWW-Authenticate", challenge)
+		}
+		writeJSON(w, http.StatusUnauthorized, osbError{
+			Error:       "Unauthorized",
+			Description: "the request carries no credentials the broker accepts",
+		})
+	})
+}
+
+// startAuthReload rereads the platform credentials every interval.
+func (b *BusinessLogic) startAuthReload(interval time.Duration) {
+	if b.auth == nil || interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := b.auth.reload(); err != nil {
+				glog.Errorf("keeping the previous platform credentials: %v", err)
+			}
+		}
+	}()
+}
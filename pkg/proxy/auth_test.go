@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// authenticated serves r through b.authenticate.
+func authenticated(b *BusinessLogic, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	b.authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})).ServeHTTP(w, r)
+	return w
+}
+
+func TestAuthenticate(t *testing.T) {
+	dir := t.TempDir()
+	secret := t.TempDir()
+	writeFile(t, filepath.Join(secret, "username"), "admin\n")
+	writeFile(t, filepath.Join(secret, "password"), "secret\n")
+	oldToken := writeFile(t, filepath.Join(dir, "old"), "old-token")
+	newToken := writeFile(t, filepath.Join(dir, "new"), "new-token")
+	path := writeFile(t, filepath.Join(dir, "auth.json"), `{
+		"secrets": ["`+secret+`"],
+		"credentials": [{"tokenFile": "`+oldToken+`"}, {"tokenFile": "`+newToken+`"}],
+		"routes": [{"prefix": "/v2/catalog", "methods": ["GET"], "anonymous": true}]
+	}`)
+	auth, err := newAuthenticator(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tenantToken := writeFile(t, filepath.Join(dir, "tenant"), "tenant-token")
+	tenantPath := writeFile(t, filepath.Join(dir, "tenant.json"), `{"credentials": [{"tokenFile": "`+tenantToken+`"}]}`)
+	tenantAuth, err := newAuthenticator(tenantPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &BusinessLogic{auth: auth, tenants: map[string]*BusinessLogic{"acme": {tenant: "acme", auth: tenantAuth}}}
+
+	cases := []struct {
+		name     string
+		path     string
+		username string
+		password string
+		token    string
+		code     int
+	}{
+		{name: "no credentials", path: "/v2/service_instances/i", code: http.StatusUnauthorized},
+		{name: "basic auth", path: "/v2/service_instances/i", username: "admin", password: "secret", code: http.StatusOK},
+		{name: "wrong password", path: "/v2/service_instances/i", username: "admin", password: "secrets", code: http.StatusUnauthorized},
+		{name: "old token", path: "/v2/service_instances/i", token: "old-token", code: http.StatusOK},
+		{name: "new token", path: "/v2/service_instances/i", token: "new-token", code: http.StatusOK},
+		{name: "anonymous route", path: "/v2/catalog", code: http.StatusOK},
+		{name: "health check", path: "/healthz", code: http.StatusOK},
+		{name: "metrics", path: "/metrics", code: http.StatusOK},
+		{name: "admin route", path: "/admin/instances", code: http.StatusUnauthorized},
+		{name: "other route", path: "/v3/catalog", code: http.StatusUnauthorized},
+		{name: "tenant admin route", path: "/tenants/acme/admin/instances", token: "new-token", code: http.StatusUnauthorized},
+		{name: "tenant token", path: "/tenants/acme/v2/catalog", token: "tenant-token", code: http.StatusOK},
+		{name: "proxy token at a tenant", path: "/tenants/acme/v2/catalog", token: "new-token", code: http.StatusUnauthorized},
+		{name: "tenant metrics", path: "/tenants/acme/metrics", token: "tenant-token", code: http.StatusOK},
+		{name: "tenant metrics without credentials", path: "/tenants/acme/metrics", code: http.StatusUnauthorized},
+		{name: "tenant health check", path: "/tenants/acme/healthz", code: http.StatusOK},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", tc.path, nil)
+			if tc.username != "" {
+				r.SetBasicAuth(tc.username, tc.password)
+			}
+			if tc.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tc.token)
+			}
+			w := authenticated(b, r)
+			if w.Code != tc.code {
+				t.Fatalf("expected %d, got %d", tc.code, w.Code)
+			}
+			if w.Code != http.StatusUnauthorized {
+				return
+			}
+			if w.Header().Get("WWW-Authenticate") == "" {
+				t.Error("expected a WWW-Authenticate challenge")
+			}
+			body := osbError{}
+			if err := json.NewDecoder(w.Body).Decode(&body); err != nil || body.Error != "Unauthorized" {
+				t.Errorf("expected an OSB error body, got %q, %v", body.Error, err)
+			}
+		})
+	}
+
+	// A rotated token is picked up on reload.
+	writeFile(t, oldToken, "rotated-token")
+	if err := auth.reload(); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("DELETE", "/v2/service_instances/i", nil)
+	r.Header.Set("Authorization", "Bearer old-token")
+	if w := authenticated(b, r); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected the replaced token to be refused, got %d", w.Code)
+	}
+	r.Header.Set("Authorization", "Bearer rotated-token")
+	if w := authenticated(b, r); w.Code != http.StatusOK {
+		t.Errorf("expected the rotated token to be accepted, got %d", w.Code)
+	}
+}
+
+func TestAdminAPINeedsAuth(t *testing.T) {
+	serve := func(b *BusinessLogic) int {
+		router := mux.NewRouter()
+		b.AdditionalRouting(router)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/admin/instances", nil))
+		return w.Code
+	}
+
+	if code := serve(newTestBusinessLogic(t, slowBroker{})); code != http.StatusNotFound {
+		t.Errorf("expected no admin API without auth, got %d", code)
+	}
+
+	dir := t.TempDir()
+	token := writeFile(t, filepath.Join(dir, "token"), "token")
+	auth, err := newAuthenticator(writeFile(t, filepath.Join(dir, "auth.json"), `{"credentials": [{"tokenFile": "`+token+`"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := newTestBusinessLogic(t, slowBroker{})
+	b.auth = auth
+	if code := serve(b); code != http.StatusUnauthorized {
+		t.Errorf("expected the admin API to need credentials, got %d", code)
+	}
+}
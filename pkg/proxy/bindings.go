@@ -0,0 +1,203 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+	"github.com/n3wscott/k8s-broker-proxy/messages"
+	"github.com/n3wscott/k8s-broker-proxy/pkg/inventory"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	"github.com/pmorie/osb-broker-lib/pkg/broker"
+)
+
+// Bindings are asynchronous when the remote broker answers 202 Accepted, or
+// when the proxy does so on its behalf because the remote side is slow. The
+// platform then polls the binding's last operation and, once it succeeded,
+// fetches the binding for its credentials.
+
+var _ messages.BindingOperationPoller = &BusinessLogic{}
+
+// bindingRouting mounts the OSB binding last operation endpoint, which the
+// broker library does not serve.
+func (b *BusinessLogic) bindingRouting(router *mux.Router) {
+	router.HandleFunc("/v2/service_instances/{instance_id}/service_bindings/{binding_id}/last_operation", b.bindingLastOperationHandler).Methods("GET")
+}
+
+// acceptIncomplete sets accepts from the accepts_incomplete query parameter
+// when the broker library left it unset.
+func acceptIncomplete(accepts *bool, c *broker.RequestContext) {
+	if *accepts || c == nil || c.Request == nil {
+		return
+	}
+	if value, err := strconv.ParseBool(c.Request.URL.Query().Get("accepts_incomplete")); err == nil {
+		*accepts = value
+	}
+}
+
+// canDeferBind tells whether the proxy may answer a bind to serviceID with
+// 202 Accepted on its own. The platform will fetch the binding afterwards, so
+// either the backend has to serve it or the proxy has to emulate it.
+func (b *BusinessLogic) canDeferBind(serviceID string) bool {
+	return b.retrievable.get(serviceID).bindings || (b.emulateRetrieval && b.sealer != nil)
+}
+
+func (b *BusinessLogic) bind(request *osb.BindRequest, c *broker.RequestContext) (*broker.BindResponse, error) {
+	if !request.AcceptsIncomplete || b.asyncBudget <= 0 || !b.canDeferBind(request.ServiceID) {
+		return ventAndWait(b, messages.Bind, request, request.ServiceID, request.PlanID, c)
+	}
+
+	response, key, err := ventOrDefer(b, messages.Bind, request, request.ServiceID, request.PlanID, c, func(r *broker.BindResponse) (bool, *osb.OperationKey) {
+		return r.Async, r.OperationKey
+	})
+	if key != nil {
+		response = &broker.BindResponse{}
+		response.Async = true
+		response.OperationKey = key
+	}
+	return response, err
+}
+
+func (b *BusinessLogic) unbind(request *osb.UnbindRequest, c *broker.RequestContext) (*broker.UnbindResponse, error) {
+	if !request.AcceptsIncomplete || b.asyncBudget <= 0 {
+		return ventAndWait(b, messages.Unbind, request, request.ServiceID, request.PlanID, c)
+	}
+
+	response, key, err := ventOrDefer(b, messages.Unbind, request, request.ServiceID, request.PlanID, c, func(r *broker.UnbindResponse) (bool, *osb.OperationKey) {
+		return r.Async, r.OperationKey
+	})
+	if key != nil {
+		response = &broker.UnbindResponse{}
+		response.Async = true
+		response.OperationKey = key
+	}
+	return response, err
+}
+
+func (b *BusinessLogic) BindingLastOperation(request *osb.BindingLastOperationRequest, c *broker.RequestContext) (*broker.LastOperationResponse, error) {
+	response, err := b.bindingLastOperation(request, c)
+	response, err = conform(b, messages.BindingLastOperation.Name, response, err, checkLastOperation)
+	b.recordBindingLastOperation(request, response, err)
+	return response, err
+}
+
+func (b *BusinessLogic) bindingLastOperation(request *osb.BindingLastOperationRequest, c *broker.RequestContext) (*broker.LastOperationResponse, error) {
+	serviceID, planID := b.requestIDs(request.InstanceID, request.ServiceID, request.PlanID)
+	// The remote broker is told the service and plan found in the
+	// inventory when the platform did not say them.
+	remote := *request
+	if serviceID != "" {
+		remote.ServiceID = &serviceID
+	}
+	if planID != "" {
+		remote.PlanID = &planID
+	}
+	if isProxyOperation(request.OperationKey) {
+		return b.proxyLastOperation(*request.OperationKey, func(remoteKey *osb.OperationKey) (*broker.LastOperationResponse, error) {
+			polled := remote
+			polled.OperationKey = remoteKey
+			return ventAndWait(b, messages.BindingLastOperation, &polled, serviceID, planID, c)
+		})
+	}
+	return ventAndWait(b, messages.BindingLastOperation, &remote, serviceID, planID, c)
+}
+
+// recordBindingLastOperation updates the inventory once an asynchronous bind
+// or unbind is over. A finished bind is recorded with what the remote broker
+// answered, or fetched from it if it answered asynchronously itself.
+func (b *BusinessLogic) recordBindingLastOperation(request *osb.BindingLastOperationRequest, response *broker.LastOperationResponse, err error) {
+	binding, getErr := b.inventory.GetBinding(request.InstanceID, request.BindingID)
+	if getErr != nil {
+		return
+	}
+	if isGone(err) || (err == nil && binding.Operation == messages.Unbind.Name && response.State == osb.StateSucceeded) {
+		if err := b.inventory.DeleteBinding(request.InstanceID, request.BindingID); err != nil {
+			glog.Errorf("failed to forget binding %s: %v", request.BindingID, err)
+		}
+		return
+	}
+	if err != nil {
+		return
+	}
+
+	if binding.Operation == messages.Bind.Name && response.State == osb.StateSucceeded && binding.State != inventory.StateSucceeded {
+		if isProxyOperation(request.OperationKey) {
+			if op, ok := b.operations.get(*request.OperationKey); ok && !op.remoteAsync {
+				bindRequest, _ := op.request.(*osb.BindRequest)
+				bindResponse, _ := op.response.(*broker.BindResponse)
+				if bindRequest != nil && bindResponse != nil {
+					b.recordBind(bindRequest, bindResponse, nil)
+					return
+				}
+			}
+		}
+		b.fetchBinding(binding)
+	}
+
+	binding, getErr = b.inventory.GetBinding(request.InstanceID, request.BindingID)
+	if getErr != nil {
+		return
+	}
+	binding.State = inventory.State(response.State)
+	binding.Updated = time.Now()
+	if err := b.inventory.PutBinding(binding); err != nil {
+		glog.Errorf("failed to record binding %s: %v", request.BindingID, err)
+	}
+}
+
+// fetchBinding completes binding with what the remote broker returns for it.
+func (b *BusinessLogic) fetchBinding(binding *inventory.Binding) {
+	fetched, err := ventAndWait(b, messages.GetBinding, &osb.GetBindingRequest{
+		InstanceID: binding.InstanceID,
+		BindingID:  binding.ID,
+	}, binding.ServiceID, binding.PlanID, nil)
+	if err != nil {
+		glog.Errorf("failed to fetch binding %s: %v", binding.ID, err)
+		return
+	}
+
+	binding.VolumeMounts = fetched.VolumeMounts
+	binding.SyslogDrainURL = deref(fetched.SyslogDrainURL)
+	binding.RouteServiceURL = deref(fetched.RouteServiceURL)
+	binding.Secret = b.seal(inventory.BindingSecret{
+		Credentials: fetched.Credentials,
+		Parameters:  fetched.Parameters,
+	})
+	if err := b.inventory.PutBinding(binding); err != nil {
+		glog.Errorf("failed to record binding %s: %v", binding.ID, err)
+	}
+}
+
+func optionalQuery(r *http.Request, key string) *string {
+	if value := r.URL.Query().Get(key); value != "" {
+		return &value
+	}
+	return nil
+}
+
+func (b *BusinessLogic) bindingLastOperationHandler(w http.ResponseWriter, r *http.Request) {
+	if err := b.ValidateBrokerAPIVersion(r.Header.Get(osb.APIVersionHeader)); err != nil {
+		writeOSBError(w, err)
+		return
+	}
+
+	vars := mux.Vars(r)
+	request := &osb.BindingLastOperationRequest{
+		InstanceID: vars["instance_id"],
+		BindingID:  vars["binding_id"],
+		ServiceID:  optionalQuery(r, "service_id"),
+		PlanID:     optionalQuery(r, "plan_id"),
+	}
+	if key := optionalQuery(r, "operation"); key != nil {
+		operationKey := osb.OperationKey(*key)
+		request.OperationKey = &operationKey
+	}
+	response, err := b.BindingLastOperation(request, &broker.RequestContext{Writer: w, Request: r})
+	if err != nil {
+		writeOSBError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, response)
+}
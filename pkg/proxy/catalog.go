@@ -0,0 +1,391 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+	"github.com/n3wscott/k8s-broker-proxy/messages"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	"github.com/pmorie/osb-broker-lib/pkg/broker"
+)
+
+// The proxy serves the catalog from a cache instead of asking the remote side
+// each time. The cache is refreshed in the background, and kept on disk so a
+// restarted proxy can serve the catalog while the remote side is down. A copy
+// that failed to revalidate is still served, with a Warning header.
+
+// staleWarning is the RFC 7234 warning for a stale response.
+const staleWarning = `110 - "Response is Stale"`
+
+// catalogCache holds the last good catalog.
+type catalogCache struct {
+	mutex sync.RWMutex
+	// tunnels holds the catalog of each tunnel as its remote side returned
+	// it, and remote the merge of them, with the tunnels' IDs mapped. served
+	// is the catalog given to the platform, which has the proxy's rewrites.
+	tunnels map[string]*broker.CatalogResponse
+	remote  *broker.CatalogResponse
+	served  *broker.CatalogResponse
+	etag    string
+	// routing tells the tunnel serving each service ID.
+	routing map[string]string
+	// stale is set when the copy could not be revalidated.
+	stale bool
+
+	// path is where the copy is kept on disk, empty for memory only.
+	path string
+	// refreshing is set while a background refresh is running.
+	refreshing bool
+}
+
+func (c *catalogCache) get() (catalog *broker.CatalogResponse, etag string, stale bool) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.served, c.etag, c.stale
+}
+
+func (c *catalogCache) getRemote() *broker.CatalogResponse {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.remote
+}
+
+func (c *catalogCache) getTunnels() map[string]*broker.CatalogResponse {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.tunnels
+}
+
+func (c *catalogCache) loaded() bool {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.served != nil
+}
+
+// route returns the tunnel serving serviceID.
+func (c *catalogCache) route(serviceID string) (string, bool) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	name, ok := c.routing[serviceID]
+	return name, ok
+}
+
+func (c *catalogCache) routes() map[string]string {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.routing
+}
+
+// set caches the catalogs of the tunnels, their merge remote with the
+// routing to them, and served made from it.
+func (c *catalogCache) set(tunnels map[string]*broker.CatalogResponse, remote, served *broker.CatalogResponse, routing map[string]string) {
+	etag := ""
+	if data, err := json.Marshal(served); err == nil {
+		sum := sha256.Sum256(data)
+		etag = `"` + hex.EncodeToString(sum[:16]) + `"`
+	}
+
+	c.mutex.Lock()
+	c.tunnels = tunnels
+	c.remote = remote
+	c.served = served
+	c.etag = etag
+	c.routing = routing
+	c.stale = false
+	c.mutex.Unlock()
+
+	if c.path != "" {
+		if err := writeFileAtomic(c.path, tunnels); err != nil {
+			glog.Errorf("failed to save the catalog to %s: %v", c.path, err)
+		}
+	}
+}
+
+func (c *catalogCache) markStale() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.stale = true
+}
+
+// load reads the copy on disk, the catalogs by tunnel, if there is one.
+func (c *catalogCache) load() (map[string]*broker.CatalogResponse, error) {
+	if c.path == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(c.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	catalogs := make(map[string]*broker.CatalogResponse)
+	if err := json.Unmarshal(data, &catalogs); err != nil {
+		return nil, err
+	}
+	return catalogs, nil
+}
+
+func writeFileAtomic(path string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// copyCatalog deep copies a catalog, so the proxy's rewrites leave the
+// remote one alone.
+func copyCatalog(catalog *broker.CatalogResponse) (*broker.CatalogResponse, error) {
+	data, err := json.Marshal(catalog)
+	if err != nil {
+		return nil, err
+	}
+	c := &broker.CatalogResponse{}
+	return c, json.Unmarshal(data, c)
+}
+
+// cacheCatalog maps the IDs of the remote catalogs of the tunnels and merges
+// them, rewrites the result for the platform and caches it all.
+func (b *BusinessLogic) cacheCatalog(tunnels map[string]*broker.CatalogResponse) (*broker.CatalogResponse, error) {
+	mapped := make(map[string]*broker.CatalogResponse, len(tunnels))
+	for name, catalog := range tunnels {
+		if t := b.tunnelNamed(name); t != nil && t.ids != nil {
+			var err error
+			if catalog, err = copyCatalog(catalog); err != nil {
+				return nil, err
+			}
+			t.ids.mapCatalog(catalog)
+		}
+		mapped[name] = catalog
+	}
+	remote, routing := b.mergeCatalogs(mapped)
+	served, err := copyCatalog(remote)
+	if err != nil {
+		return nil, err
+	}
+	b.overlay.apply(served)
+	b.rules.apply(served)
+	b.rewriteRetrievable(served)
+	b.catalogs.set(tunnels, remote, served, routing)
+	return served, nil
+}
+
+// refreshCatalog fetches the catalogs from the remote sides, or takes the
+// static one, into the cache. The cached copy is marked stale when that
+// fails for any tunnel.
+func (b *BusinessLogic) refreshCatalog(c *broker.RequestContext) (*broker.CatalogResponse, error) {
+	tunnels, stale, err := b.fetchCatalogs(c)
+	if err != nil {
+		b.catalogs.markStale()
+		return nil, err
+	}
+	served, err := b.cacheCatalog(tunnels)
+	if err != nil {
+		glog.Errorf("failed to cache the catalog: %v", err)
+		b.catalogs.markStale()
+		return nil, err
+	}
+	if stale {
+		b.catalogs.markStale()
+	}
+	return served, nil
+}
+
+// fetchCatalogs asks every tunnel for its catalog, or gives the static one
+// to the first tunnel. A tunnel that fails keeps its last good catalog, and
+// makes the result stale; only when no tunnel has a catalog is it an error.
+func (b *BusinessLogic) fetchCatalogs(c *broker.RequestContext) (map[string]*broker.CatalogResponse, bool, error) {
+	if len(b.tunnels) == 0 {
+		return nil, false, noTunnels()
+	}
+	if static := b.overlay.static(); static != nil {
+		return map[string]*broker.CatalogResponse{b.tunnels[0].name: static}, false, nil
+	}
+
+	type fetched struct {
+		tunnel  *tunnel
+		catalog *broker.CatalogResponse
+		err     error
+	}
+	results := make(chan fetched, len(b.tunnels))
+	for _, t := range b.tunnels {
+		go func(t *tunnel) {
+			catalog, err := ventAndWaitVia(b, t, messages.GetCatalog, &messages.CatalogRequest{}, "", "", c)
+			catalog, err = conform(b, messages.GetCatalog.Name, catalog, err, checkCatalog)
+			results <- fetched{t, catalog, err}
+		}(t)
+	}
+
+	previous := b.catalogs.getTunnels()
+	catalogs := make(map[string]*broker.CatalogResponse)
+	stale := false
+	var err error
+	for range b.tunnels {
+		result := <-results
+		if result.err != nil {
+			glog.Errorf("tunnel %s: failed to fetch the catalog: %v", result.tunnel.name, result.err)
+			stale, err = true, result.err
+			if catalog, ok := previous[result.tunnel.name]; ok {
+				catalogs[result.tunnel.name] = catalog
+			}
+			continue
+		}
+		catalogs[result.tunnel.name] = result.catalog
+	}
+	if len(catalogs) == 0 {
+		return nil, true, err
+	}
+	return catalogs, stale, nil
+}
+
+// revalidateCatalog refreshes the catalog in the background, once at a time.
+func (b *BusinessLogic) revalidateCatalog() {
+	b.catalogs.mutex.Lock()
+	if b.catalogs.refreshing {
+		b.catalogs.mutex.Unlock()
+		return
+	}
+	b.catalogs.refreshing = true
+	b.catalogs.mutex.Unlock()
+
+	go func() {
+		defer func() {
+			b.catalogs.mutex.Lock()
+			b.catalogs.refreshing = false
+			b.catalogs.mutex.Unlock()
+		}()
+		if _, err := b.refreshCatalog(nil); err != nil {
+			glog.Errorf("failed to refresh the catalog: %v", err)
+		}
+	}()
+}
+
+// startCatalogRefresh loads the copy on disk and refreshes the catalog every
+// interval.
+func (b *BusinessLogic) startCatalogRefresh(interval time.Duration) {
+	if len(b.tunnels) == 0 {
+		return
+	}
+	if tunnels, err := b.catalogs.load(); err != nil {
+		glog.Errorf("failed to load the catalog from %s: %v", b.catalogs.path, err)
+	} else if tunnels != nil {
+		if _, err := b.cacheCatalog(tunnels); err == nil {
+			// Not revalidated yet.
+			b.catalogs.markStale()
+		}
+	}
+
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		b.revalidateCatalog()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			b.revalidateCatalog()
+		}
+	}()
+}
+
+// currentCatalog returns the catalog from the cache when it has a copy, or
+// fetches it when it does not or background refreshes are off. A stale copy
+// is revalidated.
+func (b *BusinessLogic) currentCatalog(c *broker.RequestContext) (catalog *broker.CatalogResponse, etag string, stale bool, err error) {
+	catalog, etag, stale = b.catalogs.get()
+	if catalog == nil || b.catalogRefresh <= 0 {
+		if _, err := b.refreshCatalog(c); err == nil {
+			catalog, etag, stale = b.catalogs.get()
+		} else if catalog == nil {
+			return nil, "", false, err
+		} else {
+			glog.Errorf("serving the cached catalog: %v", err)
+			stale = true
+		}
+	} else if stale {
+		b.revalidateCatalog()
+	}
+	return catalog, etag, stale, nil
+}
+
+// GetCatalog answers with the current catalog, its ETag and, for a stale
+// copy, a Warning.
+func (b *BusinessLogic) GetCatalog(c *broker.RequestContext) (*broker.CatalogResponse, error) {
+	catalog, etag, stale, err := b.currentCatalog(c)
+	if err != nil {
+		return nil, err
+	}
+	if c != nil && c.Writer != nil {
+		setCatalogHeaders(c.Writer.Header(), etag, stale)
+	}
+	return catalog, nil
+}
+
+func setCatalogHeaders(header http.Header, etag string, stale bool) {
+	if stale {
+		header.Set("Warning", staleWarning)
+	}
+	if etag != "" {
+		header.Set("ETag", etag)
+	}
+}
+
+// catalogRouting answers relists with a matching If-None-Match with 304 Not
+// Modified, for the proxy and its tenants. The broker library only answers
+// the catalog with 200 OK, so this is done ahead of it.
+func (b *BusinessLogic) catalogRouting(router *mux.Router) {
+	router.Use(b.notModified)
+}
+
+func (b *BusinessLogic) notModified(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxy, route := b.servedBy(r.URL.Path)
+		ifNoneMatch := r.Header.Get("If-None-Match")
+		if r.Method != http.MethodGet || route != "/v2/catalog" || ifNoneMatch == "" ||
+			proxy.ValidateBrokerAPIVersion(r.Header.Get(osb.APIVersionHeader)) != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		_, etag, stale, err := proxy.currentCatalog(&broker.RequestContext{Writer: w, Request: r})
+		if err != nil || etag == "" || !matchesETag(ifNoneMatch, etag) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		setCatalogHeaders(w.Header(), etag, stale)
+		w.WriteHeader(http.StatusNotModified)
+	})
+}
+
+// matchesETag tells whether an If-None-Match header matches etag.
+func matchesETag(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/n3wscott/k8s-broker-proxy/pkg/apiversion"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	"github.com/pmorie/osb-broker-lib/pkg/broker"
+)
+
+func getCatalog(t *testing.T, b *BusinessLogic, ifNoneMatch string) (*httptest.ResponseRecorder, error) {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/v2/catalog", nil)
+	if ifNoneMatch != "" {
+		r.Header.Set("If-None-Match", ifNoneMatch)
+	}
+	_, err := b.GetCatalog(&broker.RequestContext{Writer: w, Request: r})
+	return w, err
+}
+
+// relist asks b for the catalog with If-None-Match set to etag, the way the
+// platform does over HTTP.
+func relist(b *BusinessLogic, etag string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/v2/catalog", nil)
+	r.Header.Set(osb.APIVersionHeader, "2.14")
+	r.Header.Set("If-None-Match", etag)
+	b.notModified(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := b.GetCatalog(&broker.RequestContext{Writer: w, Request: r}); err != nil {
+			writeOSBError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})).ServeHTTP(w, r)
+	return w
+}
+
+func TestCatalogServedStaleWhenRemoteIsDown(t *testing.T) {
+	down := &atomic.Bool{}
+	b := newTestBusinessLogic(t, flakyCatalogBroker{down: down})
+	b.catalogs = catalogCache{path: filepath.Join(t.TempDir(), "catalog.json")}
+	b.apiVersions = apiversion.Range{Min: apiversion.Version{Major: 2, Minor: 11}, Max: apiversion.Version{Major: 2, Minor: 14}}
+
+	w, err := getCatalog(t, b, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	etag := w.Header().Get("ETag")
+	if etag == "" || w.Header().Get("Warning") != "" {
+		t.Fatalf("expected a fresh catalog with an ETag, got %v", w.Header())
+	}
+
+	if w := relist(b, etag); w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("expected 304 without a body for a matching If-None-Match, got %d", w.Code)
+	}
+	if w := relist(b, `"other"`); w.Code != http.StatusOK {
+		t.Errorf("expected 200 for another ETag, got %d", w.Code)
+	}
+
+	down.Store(true)
+	if w, err = getCatalog(t, b, ""); err != nil {
+		t.Fatal(err)
+	}
+	if w.Header().Get("Warning") != staleWarning {
+		t.Errorf("expected a stale warning, got %v", w.Header())
+	}
+
+	// A restarted proxy serves the copy on disk.
+	restarted := newTestBusinessLogic(t, flakyCatalogBroker{down: down})
+	restarted.catalogs = catalogCache{path: b.catalogs.path}
+	restarted.startCatalogRefresh(0)
+	if w, err = getCatalog(t, restarted, ""); err != nil {
+		t.Fatal(err)
+	}
+	if w.Header().Get("Warning") != staleWarning {
+		t.Errorf("expected the copy on disk to be served stale, got %v", w.Header())
+	}
+}
+
+func TestBackgroundRefreshKeepsRetrieval(t *testing.T) {
+	b := newTestBusinessLogic(t, versionedCatalogBroker{slowBroker{delay: 100 * time.Millisecond}})
+	b.apiVersions = apiversion.Range{Min: apiversion.Version{Major: 2, Minor: 11}, Max: apiversion.Version{Major: 2, Minor: 14}}
+	b.asyncBudget = 10 * time.Millisecond
+
+	// The background refresh has no platform request to take a version from.
+	if _, err := b.refreshCatalog(nil); err != nil {
+		t.Fatal(err)
+	}
+	if !b.canDeferBind("service") {
+		t.Fatal("expected the refreshed catalog to keep bindings retrievable")
+	}
+
+	request := &osb.BindRequest{InstanceID: "instance", BindingID: "binding", ServiceID: "service", PlanID: "plan", AcceptsIncomplete: true}
+	response, err := b.Bind(request, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !response.Async {
+		t.Errorf("expected a slow bind to become asynchronous, got %+v", response)
+	}
+}
@@ -0,0 +1,232 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/golang/glog"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	"github.com/pmorie/osb-broker-lib/pkg/broker"
+)
+
+// ConformanceMode is what the proxy does with remote responses that break
+// the OSB spec.
+type ConformanceMode string
+
+const (
+	// ConformancePermissive only logs violations.
+	ConformancePermissive ConformanceMode = "permissive"
+	// ConformanceFixup repairs what it can, and rejects the rest.
+	ConformanceFixup ConformanceMode = "fixup"
+	// ConformanceReject answers 502 Bad Gateway to any violation.
+	ConformanceReject ConformanceMode = "reject"
+)
+
+// ParseConformanceMode validates a mode given on the command line.
+func ParseConformanceMode(s string) (ConformanceMode, error) {
+	switch mode := ConformanceMode(s); mode {
+	case ConformancePermissive, ConformanceFixup, ConformanceReject:
+		return mode, nil
+	case "":
+		return ConformancePermissive, nil
+	}
+	return "", fmt.Errorf("unknown conformance mode %q", s)
+}
+
+// maxOperationLength is the longest operation key the OSB spec allows.
+const maxOperationLength = 10000
+
+// violation is one way a response breaks the spec. fix repairs the response,
+// and is nil when it cannot be repaired.
+type violation struct {
+	problem string
+	fix     func()
+}
+
+// conform checks response with check and acts on the violations according
+// to the conformance mode. Errors and missing responses are passed through.
+func conform[Resp any](b *BusinessLogic, op string, response *Resp, err error, check func(*Resp) []violation) (*Resp, error) {
+	if err != nil || response == nil {
+		return response, err
+	}
+	violations := check(response)
+	if len(violations) == 0 {
+		return response, nil
+	}
+
+	var problems, unfixed []string
+	for _, v := range violations {
+		glog.Warningf("%s: non-conformant response: %s", op, v.problem)
+		b.metrics.violations.WithLabelValues(op).Inc()
+		problems = append(problems, v.problem)
+		if v.fix == nil {
+			unfixed = append(unfixed, v.problem)
+		}
+	}
+
+	switch b.conformance {
+	case ConformanceReject:
+		return nil, badGateway(op, problems)
+	case ConformanceFixup:
+		if len(unfixed) != 0 {
+			return nil, badGateway(op, unfixed)
+		}
+		// Fixes may remove list items by index, so later ones go first.
+		for i := len(violations) - 1; i >= 0; i-- {
+			violations[i].fix()
+		}
+	}
+	return response, nil
+}
+
+func badGateway(op string, problems []string) error {
+	message := "NonConformantResponse"
+	description := fmt.Sprintf("the broker's %s response does not conform to the OSB API: %s", op, strings.Join(problems, "; "))
+	return osb.HTTPStatusCodeError{
+		StatusCode:   http.StatusBadGateway,
+		ErrorMessage: &message,
+		Description:  &description,
+	}
+}
+
+// checkAsync checks the asynchronous answer rules common to all operations.
+func checkAsync(async, acceptsIncomplete bool, key **osb.OperationKey) []violation {
+	var violations []violation
+	if async && !acceptsIncomplete {
+		violations = append(violations, violation{
+			problem: "answered asynchronously to a request without accepts_incomplete=true",
+		})
+	}
+	if *key == nil {
+		return violations
+	}
+	if len(**key) > maxOperationLength {
+		violations = append(violations, violation{
+			problem: fmt.Sprintf("operation is longer than %d characters", maxOperationLength),
+		})
+	}
+	if !async {
+		violations = append(violations, violation{
+			problem: "operation is set on a synchronous answer",
+			fix:     func() { *key = nil },
+		})
+	}
+	return violations
+}
+
+func isAbsoluteURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// checkURL checks an optional URL field, which fix clears.
+func checkURL(field string, s *string, fix func()) []violation {
+	if s == nil || *s == "" || isAbsoluteURL(*s) {
+		return nil
+	}
+	v := violation{problem: fmt.Sprintf("%s %q is not an absolute http(s) URL", field, *s), fix: fix}
+	return []violation{v}
+}
+
+func checkLastOperation(response *broker.LastOperationResponse) []violation {
+	switch response.State {
+	case osb.StateInProgress, osb.StateSucceeded, osb.StateFailed:
+		return nil
+	}
+	return []violation{{problem: fmt.Sprintf("state %q is not one of in progress, succeeded or failed", response.State)}}
+}
+
+func checkProvision(request *osb.ProvisionRequest, response *broker.ProvisionResponse) []violation {
+	violations := checkAsync(response.Async, request.AcceptsIncomplete, &response.OperationKey)
+	return append(violations, checkURL("dashboard_url", response.DashboardURL, func() { response.DashboardURL = nil })...)
+}
+
+func checkUpdate(request *osb.UpdateInstanceRequest, response *broker.UpdateInstanceResponse) []violation {
+	violations := checkAsync(response.Async, request.AcceptsIncomplete, &response.OperationKey)
+	return append(violations, checkURL("dashboard_url", response.DashboardURL, func() { response.DashboardURL = nil })...)
+}
+
+func checkDeprovision(request *osb.DeprovisionRequest, response *broker.DeprovisionResponse) []violation {
+	return checkAsync(response.Async, request.AcceptsIncomplete, &response.OperationKey)
+}
+
+func checkBind(request *osb.BindRequest, response *broker.BindResponse) []violation {
+	violations := checkAsync(response.Async, request.AcceptsIncomplete, &response.OperationKey)
+	if response.Async && (response.Credentials != nil || response.SyslogDrainURL != nil || response.RouteServiceURL != nil || response.VolumeMounts != nil) {
+		violations = append(violations, violation{
+			problem: "asynchronous answer carries the binding, which has to be fetched once bound",
+			fix: func() {
+				response.Credentials = nil
+				response.SyslogDrainURL = nil
+				response.RouteServiceURL = nil
+				response.VolumeMounts = nil
+			},
+		})
+	}
+	violations = append(violations, checkURL("syslog_drain_url", response.SyslogDrainURL, nil)...)
+	return append(violations, checkURL("route_service_url", response.RouteServiceURL, nil)...)
+}
+
+func checkUnbind(request *osb.UnbindRequest, response *broker.UnbindResponse) []violation {
+	return checkAsync(response.Async, request.AcceptsIncomplete, &response.OperationKey)
+}
+
+func checkGetInstance(response *osb.GetInstanceResponse) []violation {
+	return checkURL("dashboard_url", &response.DashboardURL, func() { response.DashboardURL = "" })
+}
+
+// checkCatalog checks the fields the spec requires of services and plans,
+// and that IDs are unique. The fix for an invalid service or plan is to leave
+// it out.
+func checkCatalog(response *broker.CatalogResponse) []violation {
+	var violations []violation
+	ids := make(map[string]bool)
+	for i := range response.Services {
+		service := &response.Services[i]
+		var problems []string
+		if service.ID == "" || service.Name == "" || service.Description == "" {
+			problems = append(problems, "misses its id, name or description")
+		} else if ids[service.ID] {
+			problems = append(problems, "reuses an id")
+		}
+		ids[service.ID] = true
+
+		var planViolations []violation
+		for j := range service.Plans {
+			plan := &service.Plans[j]
+			var problem string
+			if plan.ID == "" || plan.Name == "" || plan.Description == "" {
+				problem = "misses its id, name or description"
+			} else if ids[plan.ID] {
+				problem = "reuses an id"
+			}
+			ids[plan.ID] = true
+			if problem != "" {
+				j := j
+				planViolations = append(planViolations, violation{
+					problem: fmt.Sprintf("plan %q of service %q %s", plan.Name, service.Name, problem),
+					fix: func() {
+						service.Plans = append(service.Plans[:j], service.Plans[j+1:]...)
+					},
+				})
+			}
+		}
+		if len(planViolations) == len(service.Plans) {
+			problems = append(problems, "has no valid plans")
+		}
+
+		if len(problems) != 0 {
+			i := i
+			violations = append(violations, violation{
+				problem: fmt.Sprintf("service %q %s", service.Name, strings.Join(problems, ", ")),
+				fix: func() {
+					response.Services = append(response.Services[:i], response.Services[i+1:]...)
+				},
+			})
+		}
+		violations = append(violations, planViolations...)
+	}
+	return violations
+}
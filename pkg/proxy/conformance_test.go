@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"net/http"
+	"testing"
+
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	"github.com/pmorie/osb-broker-lib/pkg/broker"
+)
+
+func TestConformProvision(t *testing.T) {
+	dashboard := "not a url"
+	key := osb.OperationKey("op")
+	cases := []struct {
+		name     string
+		mode     ConformanceMode
+		request  osb.ProvisionRequest
+		response osb.ProvisionResponse
+		wantErr  bool
+		wantFix  bool
+	}{
+		{name: "permissive", mode: ConformancePermissive, response: osb.ProvisionResponse{DashboardURL: &dashboard}},
+		{name: "fixup", mode: ConformanceFixup, response: osb.ProvisionResponse{DashboardURL: &dashboard, OperationKey: &key}, wantFix: true},
+		{name: "reject", mode: ConformanceReject, response: osb.ProvisionResponse{DashboardURL: &dashboard}, wantErr: true},
+		{name: "unfixable", mode: ConformanceFixup, response: osb.ProvisionResponse{Async: true}, wantErr: true},
+		{name: "async accepted", mode: ConformanceReject, request: osb.ProvisionRequest{AcceptsIncomplete: true}, response: osb.ProvisionResponse{Async: true, OperationKey: &key}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			b := &BusinessLogic{conformance: tc.mode, metrics: newMetrics("")}
+			response, err := conform(b, "Provision", &broker.ProvisionResponse{ProvisionResponse: tc.response}, nil, func(r *broker.ProvisionResponse) []violation {
+				return checkProvision(&tc.request, r)
+			})
+			if tc.wantErr {
+				if httpErr, ok := osb.IsHTTPError(err); !ok || httpErr.StatusCode != http.StatusBadGateway {
+					t.Errorf("expected 502, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fixed := response.DashboardURL == nil && response.OperationKey == nil; fixed != tc.wantFix {
+				t.Errorf("expected fixed %v, got %+v", tc.wantFix, response)
+			}
+		})
+	}
+}
+
+func TestConformCatalogFixup(t *testing.T) {
+	catalog := &broker.CatalogResponse{CatalogResponse: osb.CatalogResponse{Services: []osb.Service{
+		{ID: "a", Name: "a", Description: "a", Plans: []osb.Plan{
+			{ID: "a1", Name: "a1", Description: "a1"},
+			{ID: "a2", Name: "a2"},
+		}},
+		{ID: "b", Name: "b", Description: "b", Plans: []osb.Plan{{Name: "b1"}}},
+		{ID: "a", Name: "c", Description: "c", Plans: []osb.Plan{{ID: "c1", Name: "c1", Description: "c1"}}},
+	}}}
+
+	b := &BusinessLogic{conformance: ConformanceFixup, metrics: newMetrics("")}
+	catalog, err := conform(b, "GetCatalog", catalog, nil, checkCatalog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(catalog.Services) != 1 || len(catalog.Services[0].Plans) != 1 || catalog.Services[0].Plans[0].ID != "a1" {
+		t.Errorf("expected only service a with plan a1, got %+v", catalog.Services)
+	}
+}
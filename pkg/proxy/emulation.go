@@ -0,0 +1,159 @@
+package proxy
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/golang/glog"
+	"github.com/n3wscott/k8s-broker-proxy/messages"
+	"github.com/n3wscott/k8s-broker-proxy/pkg/inventory"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	"github.com/pmorie/osb-broker-lib/pkg/broker"
+)
+
+// When retrieval is emulated, the proxy answers fetch instance and fetch
+// binding itself for services whose backend does not support them, from the
+// inventory's record of the last successful Provision, Update and Bind.
+
+// retrievability is what the backend catalog says a service supports.
+type retrievability struct {
+	instances bool
+	bindings  bool
+}
+
+// retrievableServices remembers, by service ID, which services the backend
+// can fetch instances and bindings of.
+type retrievableServices struct {
+	mutex    sync.RWMutex
+	services map[string]retrievability
+}
+
+func (r *retrievableServices) get(serviceID string) retrievability {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.services[serviceID]
+}
+
+// retrievabilityOf tells what the backend of serviceID supports. The catalog
+// is fetched first when none is cached yet, so that a proxy that just started
+// does not emulate what the backend can serve.
+func (b *BusinessLogic) retrievabilityOf(serviceID string) retrievability {
+	if !b.catalogs.loaded() {
+		if _, err := b.refreshCatalog(nil); err != nil {
+			glog.Errorf("no catalog to tell whether service %s is retrievable: %v", serviceID, err)
+		}
+	}
+	return b.retrievable.get(serviceID)
+}
+
+// rewriteRetrievable records what the backend supports and, when emulating,
+// advertises retrieval for every service.
+func (b *BusinessLogic) rewriteRetrievable(catalog *broker.CatalogResponse) {
+	services := make(map[string]retrievability, len(catalog.Services))
+	for i := range catalog.Services {
+		service := &catalog.Services[i]
+		services[service.ID] = retrievability{
+			instances: service.InstancesRetrievable,
+			bindings:  service.BindingsRetrievable,
+		}
+		if b.emulateRetrieval {
+			service.InstancesRetrievable = true
+			service.BindingsRetrievable = true
+		}
+	}
+
+	b.retrievable.mutex.Lock()
+	b.retrievable.services = services
+	b.retrievable.mutex.Unlock()
+}
+
+// seal encrypts v for the inventory, or returns nil when there is no key.
+func (b *BusinessLogic) seal(v interface{}) []byte {
+	if b.sealer == nil {
+		return nil
+	}
+	sealed, err := b.sealer.Seal(v)
+	if err != nil {
+		glog.Errorf("failed to seal inventory secret: %v", err)
+		return nil
+	}
+	return sealed
+}
+
+func notFound(description string) error {
+	return osb.HTTPStatusCodeError{
+		StatusCode:  http.StatusNotFound,
+		Description: &description,
+	}
+}
+
+func concurrencyError(description string) error {
+	message := "ConcurrencyError"
+	return osb.HTTPStatusCodeError{
+		StatusCode:   http.StatusUnprocessableEntity,
+		ErrorMessage: &message,
+		Description:  &description,
+	}
+}
+
+func (b *BusinessLogic) emulatedGetInstance(request *osb.GetInstanceRequest) (*osb.GetInstanceResponse, error) {
+	instance, err := b.inventory.GetInstance(request.InstanceID)
+	if err == inventory.ErrNotFound {
+		return nil, notFound("unknown instance " + request.InstanceID)
+	} else if err != nil {
+		return nil, err
+	}
+	switch {
+	case instance.Operation == messages.Provision.Name && instance.State != inventory.StateSucceeded:
+		return nil, notFound("instance " + request.InstanceID + " is not provisioned")
+	case instance.Operation == messages.Update.Name && instance.State == inventory.StateInProgress:
+		return nil, concurrencyError("instance " + request.InstanceID + " is being updated")
+	}
+
+	response := &osb.GetInstanceResponse{
+		ServiceID:    instance.ServiceID,
+		PlanID:       instance.PlanID,
+		DashboardURL: instance.DashboardURL,
+	}
+	if len(instance.Secret) != 0 && b.sealer != nil {
+		var secret inventory.InstanceSecret
+		if err := b.sealer.Open(instance.Secret, &secret); err != nil {
+			return nil, err
+		}
+		response.Parameters = secret.Parameters
+	}
+	return response, nil
+}
+
+func (b *BusinessLogic) emulatedGetBinding(request *osb.GetBindingRequest) (*osb.GetBindingResponse, error) {
+	binding, err := b.inventory.GetBinding(request.InstanceID, request.BindingID)
+	if err == inventory.ErrNotFound {
+		return nil, notFound("unknown binding " + request.BindingID)
+	} else if err != nil {
+		return nil, err
+	}
+	if binding.Operation == messages.Bind.Name && binding.State != inventory.StateSucceeded {
+		return nil, notFound("binding " + request.BindingID + " is not bound")
+	}
+
+	response := &osb.GetBindingResponse{
+		VolumeMounts: binding.VolumeMounts,
+	}
+	if binding.SyslogDrainURL != "" {
+		response.SyslogDrainURL = &binding.SyslogDrainURL
+	}
+	if binding.RouteServiceURL != "" {
+		response.RouteServiceURL = &binding.RouteServiceURL
+	}
+	// A binding without its credentials would look empty to the platform.
+	if len(binding.Secret) == 0 || b.sealer == nil {
+		return nil, notFound("the credentials of binding " + request.BindingID + " are not kept")
+	}
+	var secret inventory.BindingSecret
+	if err := b.sealer.Open(binding.Secret, &secret); err != nil {
+		return nil, err
+	}
+	response.Credentials = secret.Credentials
+	response.Parameters = secret.Parameters
+	return response, nil
+}
@@ -0,0 +1,229 @@
+package proxy
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/n3wscott/k8s-broker-proxy/messages"
+	"github.com/n3wscott/k8s-broker-proxy/pkg/config"
+	"github.com/n3wscott/k8s-broker-proxy/pkg/inventory"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	"github.com/pmorie/osb-broker-lib/pkg/broker"
+)
+
+// The backends below embed broker.Interface and implement only what the tests
+// call through the tunnel.
+
+// slowBroker takes delay to provision and bind.
+type slowBroker struct {
+	broker.Interface
+	delay time.Duration
+}
+
+func (b slowBroker) ValidateBrokerAPIVersion(version string) error { return nil }
+
+func (b slowBroker) GetCatalog(c *broker.RequestContext) (*broker.CatalogResponse, error) {
+	return testCatalog(), nil
+}
+
+func (b slowBroker) Provision(request *osb.ProvisionRequest, c *broker.RequestContext) (*broker.ProvisionResponse, error) {
+	time.Sleep(b.delay)
+	return &broker.ProvisionResponse{}, nil
+}
+
+func (b slowBroker) Bind(request *osb.BindRequest, c *broker.RequestContext) (*broker.BindResponse, error) {
+	time.Sleep(b.delay)
+	response := &broker.BindResponse{}
+	response.Credentials = map[string]interface{}{"password": "secret"}
+	return response, nil
+}
+
+// flakyCatalogBroker serves testCatalog until down is set.
+type flakyCatalogBroker struct {
+	broker.Interface
+	down *atomic.Bool
+}
+
+func (b flakyCatalogBroker) ValidateBrokerAPIVersion(version string) error { return nil }
+
+func (b flakyCatalogBroker) GetCatalog(c *broker.RequestContext) (*broker.CatalogResponse, error) {
+	if b.down.Load() {
+		return nil, errors.New("down")
+	}
+	return testCatalog(), nil
+}
+
+// versionedCatalogBroker is a slowBroker whose catalog supports fetching
+// bindings only when asked with OSB 2.14, the way the local side's does.
+type versionedCatalogBroker struct {
+	slowBroker
+}
+
+func (b versionedCatalogBroker) GetCatalog(c *broker.RequestContext) (*broker.CatalogResponse, error) {
+	catalog := testCatalog()
+	if c != nil && c.Request != nil && c.Request.Header.Get(osb.APIVersionHeader) == "2.14" {
+		catalog.Services[0].BindingsRetrievable = true
+	}
+	return catalog, nil
+}
+
+// namedBroker serves a catalog and counts the instances it provisions.
+type namedBroker struct {
+	broker.Interface
+	catalog     *broker.CatalogResponse
+	provisioned *int
+}
+
+func (b namedBroker) GetCatalog(c *broker.RequestContext) (*broker.CatalogResponse, error) {
+	return b.catalog, nil
+}
+
+func (b namedBroker) Provision(request *osb.ProvisionRequest, c *broker.RequestContext) (*broker.ProvisionResponse, error) {
+	*b.provisioned++
+	return &broker.ProvisionResponse{}, nil
+}
+
+// recordingBroker serves testCatalog and keeps the last provision and last
+// operation requests.
+type recordingBroker struct {
+	broker.Interface
+	provisioned *osb.ProvisionRequest
+	polled      *osb.LastOperationRequest
+	polledBind  *osb.BindingLastOperationRequest
+}
+
+func (b *recordingBroker) ValidateBrokerAPIVersion(version string) error { return nil }
+
+func (b *recordingBroker) GetCatalog(c *broker.RequestContext) (*broker.CatalogResponse, error) {
+	return testCatalog(), nil
+}
+
+func (b *recordingBroker) Provision(request *osb.ProvisionRequest, c *broker.RequestContext) (*broker.ProvisionResponse, error) {
+	b.provisioned = request
+	return &broker.ProvisionResponse{}, nil
+}
+
+func (b *recordingBroker) LastOperation(request *osb.LastOperationRequest, c *broker.RequestContext) (*broker.LastOperationResponse, error) {
+	b.polled = request
+	return &broker.LastOperationResponse{LastOperationResponse: osb.LastOperationResponse{State: osb.StateInProgress}}, nil
+}
+
+func (b *recordingBroker) BindingLastOperation(request *osb.BindingLastOperationRequest, c *broker.RequestContext) (*broker.LastOperationResponse, error) {
+	b.polledBind = request
+	return &broker.LastOperationResponse{LastOperationResponse: osb.LastOperationResponse{State: osb.StateInProgress}}, nil
+}
+
+// reportingBroker reports one healthy backend.
+type reportingBroker struct {
+	broker.Interface
+}
+
+func (reportingBroker) Health(request *messages.HealthRequest, c *broker.RequestContext) (*messages.HealthResponse, error) {
+	return &messages.HealthResponse{Backends: []messages.BackendHealth{{Name: "backend", Healthy: true}}}, nil
+}
+
+// retrievingBroker serves a catalog that supports fetching instances, and
+// answers with dashboardURL.
+type retrievingBroker struct {
+	slowBroker
+	dashboardURL string
+}
+
+func (b retrievingBroker) GetCatalog(c *broker.RequestContext) (*broker.CatalogResponse, error) {
+	catalog := testCatalog()
+	catalog.Services[0].InstancesRetrievable = true
+	return catalog, nil
+}
+
+func (b retrievingBroker) GetInstance(request *osb.GetInstanceRequest, c *broker.RequestContext) (*osb.GetInstanceResponse, error) {
+	return &osb.GetInstanceResponse{ServiceID: "service", PlanID: "plan", DashboardURL: b.dashboardURL}, nil
+}
+
+// testCatalog has one bindable service with one plan.
+func testCatalog() *broker.CatalogResponse {
+	return serviceCatalog("service", "plan")
+}
+
+// serviceCatalog has one bindable service with one plan, both named after
+// their IDs.
+func serviceCatalog(serviceID, planID string) *broker.CatalogResponse {
+	return &broker.CatalogResponse{CatalogResponse: osb.CatalogResponse{Services: []osb.Service{{
+		ID:          serviceID,
+		Name:        serviceID,
+		Description: serviceID,
+		Bindable:    true,
+		Plans:       []osb.Plan{{ID: planID, Name: planID, Description: planID}},
+	}}}}
+}
+
+// newTestTunnel returns a tunnel through an in-memory pipe to a local side
+// served by backend.
+func newTestTunnel(t *testing.T, name string, backend broker.Interface) *tunnel {
+	proxySide, localSide := messages.NewPipe()
+	reg := messages.NewRegistryWithTransport(proxySide)
+	local := messages.NewRegistryWithTransport(localSide)
+	t.Cleanup(reg.Stop)
+	t.Cleanup(local.Stop)
+
+	if err := messages.NewServer(local, backend).Register(); err != nil {
+		t.Fatal(err)
+	}
+	return newTunnel(name, reg, nil)
+}
+
+// newTestBusinessLogic returns a proxy talking through an in-memory tunnel
+// to a local side served by backend.
+func newTestBusinessLogic(t *testing.T, backend broker.Interface) *BusinessLogic {
+	b := &BusinessLogic{
+		tunnels: []*tunnel{newTestTunnel(t, defaultTunnel, backend)},
+		timeouts: &TimeoutPolicy{
+			TimeoutRule: TimeoutRule{Default: config.Duration{Duration: time.Second}},
+		},
+		metrics:    newMetrics(""),
+		operations: newOperationTable(),
+		inventory:  inventory.NewMemoryStore(),
+	}
+	cacheTestCatalog(t, b, testCatalog())
+	return b
+}
+
+// cacheTestCatalog caches catalog as the one of the default tunnel.
+func cacheTestCatalog(t *testing.T, b *BusinessLogic, catalog *broker.CatalogResponse) {
+	if _, err := b.cacheCatalog(map[string]*broker.CatalogResponse{defaultTunnel: catalog}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// forgetTestCatalog drops the cached catalog, the way a restart does, so the
+// next request fetches it through the tunnels.
+func forgetTestCatalog(b *BusinessLogic) {
+	b.catalogs = catalogCache{}
+}
+
+// writeFile writes content to path and returns path.
+func writeFile(t *testing.T, path, content string) string {
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func loadOverlay(t *testing.T, content string) *CatalogOverlay {
+	overlay, err := LoadCatalogOverlay(writeFile(t, filepath.Join(t.TempDir(), "catalog.yaml"), content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return overlay
+}
+
+func loadRules(t *testing.T, content string) *CatalogRules {
+	rules, err := LoadCatalogRules(writeFile(t, filepath.Join(t.TempDir(), "rules.yaml"), content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rules
+}
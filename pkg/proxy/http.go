@@ -0,0 +1,45 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/golang/glog"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+)
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		glog.Error(err)
+	}
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"description": err.Error()})
+}
+
+// osbError is the error body of the OSB API.
+type osbError struct {
+	Error       string `json:"error,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// writeOSBError answers err the way the broker library does for the routes it
+// serves: OSB status code errors keep their status, anything else is a 500.
+func writeOSBError(w http.ResponseWriter, err error) {
+	httpErr, ok := osb.IsHTTPError(err)
+	if !ok {
+		writeJSON(w, http.StatusInternalServerError, osbError{Description: err.Error()})
+		return
+	}
+	body := osbError{}
+	if httpErr.ErrorMessage != nil {
+		body.Error = *httpErr.ErrorMessage
+	}
+	if httpErr.Description != nil {
+		body.Description = *httpErr.Description
+	}
+	writeJSON(w, httpErr.StatusCode, body)
+}
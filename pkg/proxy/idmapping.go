@@ -0,0 +1,186 @@
+package proxy
+
+import (
+	"sync"
+
+	"github.com/pborman/uuid"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	"github.com/pmorie/osb-broker-lib/pkg/broker"
+)
+
+// IDMapping gives the services and plans of a tunnel's broker IDs of their
+// own, so the same broker run in several sites can be registered once per
+// site. The platform sees version 5 UUIDs of the broker's IDs in Namespace,
+// which differ from site to site and stay the same across restarts; the
+// proxy maps them back before a request goes through the tunnel. Service
+// names have to be unique as well: NamePrefix and NameSuffix are added to
+// them.
+type IDMapping struct {
+	Namespace  string `json:"namespace"`
+	NamePrefix string `json:"namePrefix,omitempty"`
+	NameSuffix string `json:"nameSuffix,omitempty"`
+}
+
+// idMapper maps the IDs of one tunnel. It learns how to map IDs back from
+// the catalogs it maps, as the UUIDs cannot be reversed.
+type idMapper struct {
+	namespace              string
+	namePrefix, nameSuffix string
+
+	mutex sync.RWMutex
+	// Whether a catalog was mapped yet, and the broker's service and plan
+	// IDs by the platform's.
+	mapped   bool
+	services map[string]string
+	plans    map[string]string
+}
+
+func newIDMapper(c *IDMapping) *idMapper {
+	if c == nil {
+		return nil
+	}
+	return &idMapper{
+		namespace:  c.Namespace,
+		namePrefix: c.NamePrefix,
+		nameSuffix: c.NameSuffix,
+		services:   make(map[string]string),
+		plans:      make(map[string]string),
+	}
+}
+
+// platformID is the ID the platform sees for the broker's id.
+func (m *idMapper) platformID(id string) string {
+	return uuid.NewSHA1(uuid.NameSpace_URL, []byte(m.namespace+"/"+id)).String()
+}
+
+// mapCatalog gives the services and plans of catalog the platform's IDs,
+// and the services their names for the platform.
+func (m *idMapper) mapCatalog(catalog *broker.CatalogResponse) {
+	if m == nil {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.mapped = true
+	for i := range catalog.Services {
+		service := &catalog.Services[i]
+		id := m.platformID(service.ID)
+		m.services[id] = service.ID
+		service.ID = id
+		service.Name = m.namePrefix + service.Name + m.nameSuffix
+		for j := range service.Plans {
+			plan := &service.Plans[j]
+			id := m.platformID(plan.ID)
+			m.plans[id] = plan.ID
+			plan.ID = id
+		}
+	}
+}
+
+// learned tells whether the mapper has seen a catalog to map IDs back with.
+func (m *idMapper) learned() bool {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.mapped
+}
+
+// brokerID maps the platform's id back with ids. IDs the mapper has not
+// seen in a catalog are left alone, for the broker to refuse.
+func (m *idMapper) brokerID(ids map[string]string, id string) string {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	if brokerID, ok := ids[id]; ok {
+		return brokerID
+	}
+	return id
+}
+
+func (m *idMapper) brokerService(id string) string {
+	return m.brokerID(m.services, id)
+}
+
+func (m *idMapper) brokerPlan(id string) string {
+	return m.brokerID(m.plans, id)
+}
+
+func (m *idMapper) brokerServicePtr(id *string) *string {
+	if id == nil {
+		return nil
+	}
+	mapped := m.brokerService(*id)
+	return &mapped
+}
+
+func (m *idMapper) brokerPlanPtr(id *string) *string {
+	if id == nil {
+		return nil
+	}
+	mapped := m.brokerPlan(*id)
+	return &mapped
+}
+
+// mapRequest returns a copy of request with the broker's IDs.
+func mapRequest[Req any](m *idMapper, request *Req) *Req {
+	if m == nil || request == nil {
+		return request
+	}
+
+	var mapped interface{}
+	switch r := interface{}(request).(type) {
+	case *osb.ProvisionRequest:
+		c := *r
+		c.ServiceID, c.PlanID = m.brokerService(r.ServiceID), m.brokerPlan(r.PlanID)
+		mapped = &c
+	case *osb.UpdateInstanceRequest:
+		c := *r
+		c.ServiceID, c.PlanID = m.brokerService(r.ServiceID), m.brokerPlanPtr(r.PlanID)
+		if r.PreviousValues != nil {
+			previous := *r.PreviousValues
+			previous.ServiceID, previous.PlanID = m.brokerService(previous.ServiceID), m.brokerPlan(previous.PlanID)
+			c.PreviousValues = &previous
+		}
+		mapped = &c
+	case *osb.DeprovisionRequest:
+		c := *r
+		c.ServiceID, c.PlanID = m.brokerService(r.ServiceID), m.brokerPlan(r.PlanID)
+		mapped = &c
+	case *osb.LastOperationRequest:
+		c := *r
+		c.ServiceID, c.PlanID = m.brokerServicePtr(r.ServiceID), m.brokerPlanPtr(r.PlanID)
+		mapped = &c
+	case *osb.BindRequest:
+		c := *r
+		c.ServiceID, c.PlanID = m.brokerService(r.ServiceID), m.brokerPlan(r.PlanID)
+		mapped = &c
+	case *osb.UnbindRequest:
+		c := *r
+		c.ServiceID, c.PlanID = m.brokerService(r.ServiceID), m.brokerPlan(r.PlanID)
+		mapped = &c
+	case *osb.BindingLastOperationRequest:
+		c := *r
+		c.ServiceID, c.PlanID = m.brokerServicePtr(r.ServiceID), m.brokerPlanPtr(r.PlanID)
+		mapped = &c
+	default:
+		return request
+	}
+	return mapped.(*Req)
+}
+
+// mapResponse gives the IDs in a response of the broker the platform's.
+// Catalogs are mapped when they are cached.
+func mapResponse[Resp any](m *idMapper, response *Resp) *Resp {
+	if m == nil || response == nil {
+		return response
+	}
+	if r, ok := interface{}(response).(*osb.GetInstanceResponse); ok {
+		// The broker may leave out the IDs it has no reason to send.
+		if r.ServiceID != "" {
+			r.ServiceID = m.platformID(r.ServiceID)
+		}
+		if r.PlanID != "" {
+			r.PlanID = m.platformID(r.PlanID)
+		}
+	}
+	return response
+}
@@ -0,0 +1,127 @@
+package proxy
+
+import (
+	"testing"
+
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+)
+
+func TestIDMappingIsDeterministic(t *testing.T) {
+	site := newIDMapper(&IDMapping{Namespace: "site-a"})
+	if site.platformID("service") != newIDMapper(&IDMapping{Namespace: "site-a"}).platformID("service") {
+		t.Error("expected the same ID in the same namespace")
+	}
+	if site.platformID("service") == newIDMapper(&IDMapping{Namespace: "site-b"}).platformID("service") {
+		t.Error("expected different IDs in different namespaces")
+	}
+}
+
+func TestIDMappingLeavesMissingIDsOut(t *testing.T) {
+	ids := newIDMapper(&IDMapping{Namespace: "site-a"})
+	response := mapResponse(ids, &osb.GetInstanceResponse{ServiceID: "service"})
+	if response.ServiceID != ids.platformID("service") || response.PlanID != "" {
+		t.Errorf("expected only the service ID to be mapped, got service %q and plan %q", response.ServiceID, response.PlanID)
+	}
+}
+
+func TestIDMappingRoundTrip(t *testing.T) {
+	backend := &recordingBroker{}
+	b := newTestBusinessLogic(t, backend)
+	ids := newIDMapper(&IDMapping{Namespace: "site-a"})
+	b.tunnels[0].ids = ids
+	forgetTestCatalog(b)
+
+	catalog, err := b.GetCatalog(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	service := catalog.Services[0]
+	if service.ID != ids.platformID("service") || service.Plans[0].ID != ids.platformID("plan") {
+		t.Fatalf("expected mapped IDs, got service %s and plan %s", service.ID, service.Plans[0].ID)
+	}
+
+	request := &osb.ProvisionRequest{InstanceID: "instance", ServiceID: service.ID, PlanID: service.Plans[0].ID}
+	if _, err := b.Provision(request, nil); err != nil {
+		t.Fatal(err)
+	}
+	if backend.provisioned.ServiceID != "service" || backend.provisioned.PlanID != "plan" {
+		t.Errorf("expected the broker's IDs, got service %s and plan %s", backend.provisioned.ServiceID, backend.provisioned.PlanID)
+	}
+	if request.ServiceID != service.ID {
+		t.Error("expected the platform's request to be left alone")
+	}
+}
+
+func TestLastOperationSendsTheInventoryIDs(t *testing.T) {
+	backend := &recordingBroker{}
+	b := newTestBusinessLogic(t, backend)
+	ids := newIDMapper(&IDMapping{Namespace: "site-a"})
+	b.tunnels[0].ids = ids
+	forgetTestCatalog(b)
+	if _, err := b.GetCatalog(nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Provision(&osb.ProvisionRequest{InstanceID: "instance", ServiceID: ids.platformID("service"), PlanID: ids.platformID("plan")}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Platforms may poll without saying the service and plan.
+	if _, err := b.LastOperation(&osb.LastOperationRequest{InstanceID: "instance"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if polled := backend.polled; polled == nil || deref(polled.ServiceID) != "service" || deref(polled.PlanID) != "plan" {
+		t.Errorf("expected the broker's IDs of the instance, got %+v", polled)
+	}
+	if _, err := b.BindingLastOperation(&osb.BindingLastOperationRequest{InstanceID: "instance", BindingID: "binding"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if polled := backend.polledBind; polled == nil || deref(polled.ServiceID) != "service" || deref(polled.PlanID) != "plan" {
+		t.Errorf("expected the broker's IDs of the instance, got %+v", polled)
+	}
+}
+
+func TestIDMappingKeepsTheSameBrokerAtTwoSites(t *testing.T) {
+	var first, second int
+	b := newTestBusinessLogic(t, namedBroker{catalog: testCatalog(), provisioned: &first})
+	b.tunnels[0].name = "site-a"
+	b.tunnels[0].ids = newIDMapper(&IDMapping{Namespace: "site-a", NameSuffix: "-a"})
+	b.tunnels = append(b.tunnels, newTestTunnel(t, "site-b", namedBroker{catalog: testCatalog(), provisioned: &second}))
+	b.tunnels[1].ids = newIDMapper(&IDMapping{Namespace: "site-b", NameSuffix: "-b"})
+	forgetTestCatalog(b)
+
+	catalog, err := b.GetCatalog(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(catalog.Services) != 2 {
+		t.Fatalf("expected the service of both sites, got %+v", catalog.Services)
+	}
+	name := testCatalog().Services[0].Name
+	if catalog.Services[0].Name != name+"-a" || catalog.Services[1].Name != name+"-b" {
+		t.Errorf("expected the names of the sites, got %s and %s", catalog.Services[0].Name, catalog.Services[1].Name)
+	}
+
+	service := catalog.Services[1]
+	if _, err := b.Provision(&osb.ProvisionRequest{InstanceID: "instance", ServiceID: service.ID, PlanID: service.Plans[0].ID}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if first != 0 || second != 1 {
+		t.Errorf("expected the second site to provision, got %d and %d", first, second)
+	}
+}
+
+func TestIDMappingLearnsAfterRestart(t *testing.T) {
+	backend := &recordingBroker{}
+	b := newTestBusinessLogic(t, backend)
+	ids := newIDMapper(&IDMapping{Namespace: "site-a"})
+	b.tunnels[0].ids = ids
+	// A restarted proxy has no catalog to map the platform's IDs back with.
+	forgetTestCatalog(b)
+
+	if _, err := b.Provision(&osb.ProvisionRequest{InstanceID: "instance", ServiceID: ids.platformID("service"), PlanID: ids.platformID("plan")}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if backend.provisioned.ServiceID != "service" || backend.provisioned.PlanID != "plan" {
+		t.Errorf("expected the broker's IDs, got service %s and plan %s", backend.provisioned.ServiceID, backend.provisioned.PlanID)
+	}
+}
@@ -0,0 +1,266 @@
+package proxy
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+	"github.com/n3wscott/k8s-broker-proxy/messages"
+	"github.com/n3wscott/k8s-broker-proxy/pkg/inventory"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	"github.com/pmorie/osb-broker-lib/pkg/broker"
+)
+
+// The inventory is updated from successful responses only; failing requests
+// leave the records as they were. Store errors are logged, never returned to
+// the platform, since the remote side already did the work.
+
+func asyncState(async bool) inventory.State {
+	if async {
+		return inventory.StateInProgress
+	}
+	return inventory.StateSucceeded
+}
+
+func isGone(err error) bool {
+	httpErr, ok := osb.IsHTTPError(err)
+	return ok && httpErr.StatusCode == http.StatusGone
+}
+
+func (b *BusinessLogic) recordProvision(request *osb.ProvisionRequest, response *broker.ProvisionResponse, err error) {
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	instance := &inventory.Instance{
+		ID:             request.InstanceID,
+		ServiceID:      request.ServiceID,
+		PlanID:         request.PlanID,
+		Context:        request.Context,
+		ParametersHash: inventory.HashParameters(request.Parameters),
+		Secret:         b.seal(inventory.InstanceSecret{Parameters: request.Parameters}),
+		Operation:      messages.Provision.Name,
+		State:          asyncState(response.Async),
+		Created:        now,
+		Updated:        now,
+	}
+	if response.DashboardURL != nil {
+		instance.DashboardURL = *response.DashboardURL
+	}
+	if existing, err := b.inventory.GetInstance(request.InstanceID); err == nil {
+		instance.Created = existing.Created
+	}
+	if err := b.inventory.PutInstance(instance); err != nil {
+		glog.Errorf("failed to record instance %s: %v", request.InstanceID, err)
+	}
+}
+
+func (b *BusinessLogic) recordUpdate(request *osb.UpdateInstanceRequest, response *broker.UpdateInstanceResponse, err error) {
+	if err != nil {
+		return
+	}
+	instance, err := b.inventory.GetInstance(request.InstanceID)
+	if err != nil {
+		instance = &inventory.Instance{
+			ID:        request.InstanceID,
+			ServiceID: request.ServiceID,
+			Created:   time.Now(),
+		}
+	}
+	if request.PlanID != nil {
+		instance.PlanID = *request.PlanID
+	}
+	if request.Context != nil {
+		instance.Context = request.Context
+	}
+	if request.Parameters != nil {
+		instance.ParametersHash = inventory.HashParameters(request.Parameters)
+		instance.Secret = b.seal(inventory.InstanceSecret{Parameters: request.Parameters})
+	}
+	if response.DashboardURL != nil {
+		instance.DashboardURL = *response.DashboardURL
+	}
+	instance.Operation = messages.Update.Name
+	instance.State = asyncState(response.Async)
+	instance.Updated = time.Now()
+	if err := b.inventory.PutInstance(instance); err != nil {
+		glog.Errorf("failed to record instance %s: %v", request.InstanceID, err)
+	}
+}
+
+func (b *BusinessLogic) recordDeprovision(request *osb.DeprovisionRequest, response *broker.DeprovisionResponse, err error) {
+	if err == nil && response.Async {
+		b.recordInstanceState(request.InstanceID, messages.Deprovision.Name, inventory.StateInProgress)
+		return
+	}
+	if err == nil || isGone(err) {
+		b.forgetInstance(request.InstanceID)
+	}
+}
+
+func (b *BusinessLogic) recordLastOperation(request *osb.LastOperationRequest, response *broker.LastOperationResponse, err error) {
+	instance, getErr := b.inventory.GetInstance(request.InstanceID)
+	if getErr != nil {
+		return
+	}
+	if isGone(err) || (err == nil && instance.Operation == messages.Deprovision.Name && response.State == osb.StateSucceeded) {
+		b.forgetInstance(request.InstanceID)
+		return
+	}
+	if err != nil {
+		return
+	}
+	b.recordInstanceState(request.InstanceID, instance.Operation, inventory.State(response.State))
+}
+
+func (b *BusinessLogic) recordInstanceState(id, operation string, state inventory.State) {
+	instance, err := b.inventory.GetInstance(id)
+	if err != nil {
+		return
+	}
+	instance.Operation = operation
+	instance.State = state
+	instance.Updated = time.Now()
+	if err := b.inventory.PutInstance(instance); err != nil {
+		glog.Errorf("failed to record instance %s: %v", id, err)
+	}
+}
+
+// instanceIDs returns the service and plan of an instance, if it is known.
+func (b *BusinessLogic) instanceIDs(id string) (serviceID, planID string) {
+	if instance, err := b.inventory.GetInstance(id); err == nil {
+		return instance.ServiceID, instance.PlanID
+	}
+	return "", ""
+}
+
+// requestIDs returns the service and plan a request gives, or those of its
+// instance when it gives no service.
+func (b *BusinessLogic) requestIDs(instanceID string, serviceID, planID *string) (string, string) {
+	if deref(serviceID) == "" {
+		return b.instanceIDs(instanceID)
+	}
+	return *serviceID, deref(planID)
+}
+
+func (b *BusinessLogic) forgetInstance(id string) {
+	if err := b.inventory.DeleteInstance(id); err != nil {
+		glog.Errorf("failed to forget instance %s: %v", id, err)
+	}
+}
+
+func (b *BusinessLogic) recordBind(request *osb.BindRequest, response *broker.BindResponse, err error) {
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	binding := &inventory.Binding{
+		ID:             request.BindingID,
+		InstanceID:     request.InstanceID,
+		ServiceID:      request.ServiceID,
+		PlanID:         request.PlanID,
+		Context:        request.Context,
+		ParametersHash: inventory.HashParameters(request.Parameters),
+		VolumeMounts:   response.VolumeMounts,
+		Secret: b.seal(inventory.BindingSecret{
+			Credentials: response.Credentials,
+			Parameters:  request.Parameters,
+		}),
+		Operation: messages.Bind.Name,
+		State:     asyncState(response.Async),
+		Created:   now,
+		Updated:   now,
+	}
+	if response.SyslogDrainURL != nil {
+		binding.SyslogDrainURL = *response.SyslogDrainURL
+	}
+	if response.RouteServiceURL != nil {
+		binding.RouteServiceURL = *response.RouteServiceURL
+	}
+	if existing, err := b.inventory.GetBinding(request.InstanceID, request.BindingID); err == nil {
+		binding.Created = existing.Created
+	}
+	if err := b.inventory.PutBinding(binding); err != nil {
+		glog.Errorf("failed to record binding %s: %v", request.BindingID, err)
+	}
+}
+
+func (b *BusinessLogic) recordUnbind(request *osb.UnbindRequest, response *broker.UnbindResponse, err error) {
+	if err != nil && !isGone(err) {
+		return
+	}
+	if err == nil && response.Async {
+		binding, getErr := b.inventory.GetBinding(request.InstanceID, request.BindingID)
+		if getErr != nil {
+			return
+		}
+		binding.Operation = messages.Unbind.Name
+		binding.State = inventory.StateInProgress
+		binding.Updated = time.Now()
+		if err := b.inventory.PutBinding(binding); err != nil {
+			glog.Errorf("failed to record binding %s: %v", request.BindingID, err)
+		}
+		return
+	}
+	if err := b.inventory.DeleteBinding(request.InstanceID, request.BindingID); err != nil {
+		glog.Errorf("failed to forget binding %s: %v", request.BindingID, err)
+	}
+}
+
+// inventoryRouting mounts the read-only admin API over the inventory. Sealed
+// secrets are never part of its answers.
+func (b *BusinessLogic) inventoryRouting(router *mux.Router) {
+	router.HandleFunc("/admin/instances", b.adminListInstancesHandler).Methods("GET")
+	router.HandleFunc("/admin/instances/{instance_id}", b.adminGetInstanceHandler).Methods("GET")
+	router.HandleFunc("/admin/bindings", b.adminListBindingsHandler).Methods("GET")
+}
+
+func (b *BusinessLogic) adminListInstancesHandler(w http.ResponseWriter, r *http.Request) {
+	instances, err := b.inventory.ListInstances()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	for _, instance := range instances {
+		instance.Secret = nil
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"instances": instances})
+}
+
+func (b *BusinessLogic) adminGetInstanceHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["instance_id"]
+	instance, err := b.inventory.GetInstance(id)
+	if err == inventory.ErrNotFound {
+		writeError(w, http.StatusNotFound, err)
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	bindings, err := b.inventory.ListBindings(id)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	instance.Secret = nil
+	for _, binding := range bindings {
+		binding.Secret = nil
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"instance": instance,
+		"bindings": bindings,
+	})
+}
+
+func (b *BusinessLogic) adminListBindingsHandler(w http.ResponseWriter, r *http.Request) {
+	bindings, err := b.inventory.ListBindings(r.URL.Query().Get("instance_id"))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	for _, binding := range bindings {
+		binding.Secret = nil
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"bindings": bindings})
+}
@@ -3,53 +3,149 @@ package proxy
 import (
 	"github.com/golang/glog"
 	"github.com/gorilla/mux"
-	"github.com/n3wscott/k8s-broker-proxy/pkg/binding"
+	"github.com/n3wscott/k8s-broker-proxy/pkg/apiversion"
 	"github.com/n3wscott/k8s-broker-proxy/pkg/cli"
+	"github.com/n3wscott/k8s-broker-proxy/pkg/inventory"
 	"github.com/pmorie/osb-broker-lib/pkg/broker"
+	"github.com/pmorie/osb-broker-lib/pkg/rest"
 
-	"encoding/json"
-
-	"os"
+	"errors"
+	"net/http"
+	"time"
 
 	"github.com/n3wscott/k8s-broker-proxy/messages"
 	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	prom "github.com/prometheus/client_golang/prometheus"
 )
 
 func NewBusinessLogic(o cli.Options) (*BusinessLogic, error) {
+	var tenants []TenantConfig
+	if o.Tenants != "" {
+		var err error
+		if tenants, err = LoadTenants(o.Tenants); err != nil {
+			return nil, err
+		}
+		if err := checkTenantIsolation(o, tenants); err != nil {
+			return nil, err
+		}
+	}
 
-	// load a binding file
-	if o.Binding != "" {
-		projectId, topicId, subscriptionId, err := binding.PubSubBinding(o.Binding)
-		if err != nil {
+	configs, err := tunnelConfigs(o)
+	if err != nil {
+		return nil, err
+	}
+	if len(tenants) != 0 && o.Tunnels == "" && !defaultTunnelConfig(o).configured() {
+		// Only the tenants have brokers.
+		configs = nil
+	}
+	b, err := newBusinessLogic(o, "", configs)
+	if err != nil {
+		return nil, err
+	}
+
+	b.tenants = make(map[string]*BusinessLogic)
+	for _, t := range tenants {
+		if b.tenants[t.Name], err = newTenant(o, t); err != nil {
 			return nil, err
 		}
-		o.ProjectID = projectId
-		o.Topic = topicId
-		o.Subscription = subscriptionId
+	}
+	return b, nil
+}
+
+// newBusinessLogic returns the proxy of tenant, empty for the proxy's own,
+// reaching its brokers through the tunnels configs set up.
+func newBusinessLogic(o cli.Options, tenant string, configs []TunnelConfig) (*BusinessLogic, error) {
+	tunnels, err := openTunnels(configs, o)
+	if err != nil {
+		return nil, err
+	}
+
+	apiVersions, err := apiversion.NewRange(o.MinAPIVersion, o.MaxAPIVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	conformance, err := ParseConformanceMode(o.Conformance)
+	if err != nil {
+		return nil, err
 	}
 
-	// if stuff is still blank, look in the env
-	if o.ProjectID == "" {
-		o.ProjectID = os.Getenv(binding.GCPProjectEnvName)
+	var overlay *CatalogOverlay
+	if o.CatalogPath != "" {
+		if overlay, err = LoadCatalogOverlay(o.CatalogPath); err != nil {
+			return nil, err
+		}
 	}
 
-	if o.Topic == "" {
-		o.Topic = os.Getenv(binding.PubSubTopicEnvName)
+	var rules *CatalogRules
+	if o.CatalogRules != "" {
+		if rules, err = LoadCatalogRules(o.CatalogRules); err != nil {
+			return nil, err
+		}
 	}
 
-	if o.Subscription == "" {
-		o.Subscription = os.Getenv(binding.PubSubSubscriptionEnvName)
+	timeouts, err := LoadTimeoutPolicy(o.TimeoutConfig, o.Timeout)
+	if err != nil {
+		return nil, err
 	}
 
-	reg, err := messages.NewRegistry(o.ProjectID, o.Topic, o.Subscription)
+	store, err := inventory.Open(o.Inventory, o.InventoryPath)
 	if err != nil {
-		glog.Fatal(err)
+		return nil, err
+	}
+
+	var sealer *inventory.Sealer
+	if o.InventoryKey != "" {
+		if sealer, err = inventory.LoadSealer(o.InventoryKey); err != nil {
+			return nil, err
+		}
+	} else if o.EmulateRetrieval {
+		// Without the key no credentials are kept, and a fetched binding
+		// would look empty to the platform.
+		return nil, errors.New("--emulateRetrieval needs --inventoryKey")
+	}
+
+	var auth *authenticator
+	if o.Auth != "" {
+		if auth, err = newAuthenticator(o.Auth); err != nil {
+			return nil, err
+		}
+	}
+
+	var authz *ClientAuthz
+	if o.ClientAuthz != "" {
+		if authz, err = LoadClientAuthz(o.ClientAuthz); err != nil {
+			return nil, err
+		}
 	}
 
 	b := &BusinessLogic{
-		async: o.Async,
-		reg:   reg,
+		async:    o.Async,
+		auth:     auth,
+		authz:    authz,
+		tenant:   tenant,
+		tunnels:  tunnels,
+		timeouts: timeouts,
+		metrics:  newMetrics(tenant),
+
+		apiVersions:    apiVersions,
+		forwardHeaders: cli.HeaderNames(o.ForwardHeaders),
+		conformance:    conformance,
+		catalogs:       catalogCache{path: o.CatalogCache},
+		catalogRefresh: o.CatalogRefresh,
+		overlay:        overlay,
+		rules:          rules,
+
+		asyncBudget: o.AsyncBudget,
+		operations:  newOperationTable(),
+		inventory:   store,
+		sealer:      sealer,
+
+		emulateRetrieval: o.EmulateRetrieval,
 	}
+	b.startCatalogRefresh(o.CatalogRefresh)
+	b.startAuthReload(o.CredentialsReload)
+	b.startHealthChecks(o.HealthInterval)
 
 	return b, nil
 }
@@ -60,131 +156,314 @@ type BusinessLogic struct {
 	// Indicates if the broker should handle the requests asynchronously.
 	async bool
 
-	//	catalog *broker.CatalogResponse
+	// The tenant this proxy serves, empty for the proxy's own routes, and the
+	// proxies of the tenants served under /tenants.
+	tenant  string
+	tenants map[string]*BusinessLogic
+	// The broker library's OSB routes for a tenant, and the registry of the
+	// tenant's metrics.
+	api      *rest.APISurface
+	registry *prom.Registry
+	// Checks the credentials of platforms, nil to let any request through.
+	auth *authenticator
+	// What platforms may call, by client certificate, nil for anything.
+	authz *ClientAuthz
+
+	// The last good catalog, and how often it is refreshed.
+	catalogs       catalogCache
+	catalogRefresh time.Duration
+	// Changes to the remote catalog, or a static one, nil for none.
+	overlay *CatalogOverlay
+	// What part of the catalog the platform sees, nil for all of it.
+	rules *CatalogRules
+
+	// The ways to the local sides, the first one serving a static catalog.
+	tunnels []*tunnel
+
+	// How long to wait for the remote side, by operation, service and plan,
+	// unless the tunnel has its own policy.
+	timeouts *TimeoutPolicy
+
+	metrics *proxyMetrics
+
+	// The OSB API versions platforms may use.
+	apiVersions apiversion.Range
+	// The platform request headers passed on to the broker.
+	forwardHeaders []string
+	// What to do with responses that break the OSB spec.
+	conformance ConformanceMode
+
+	// How long a request that accepts an incomplete answer may wait for the
+	// remote side before the proxy answers 202 Accepted on its behalf.
+	asyncBudget time.Duration
+	// The operations answered with 202 Accepted by the proxy.
+	operations *operationTable
+
+	// What the proxy provisioned and bound, updated from the responses.
+	inventory inventory.Store
+	// Encrypts the secrets kept in the inventory, nil to not keep them.
+	sealer *inventory.Sealer
+
+	// Whether to answer fetch instance and binding from the inventory for
+	// services whose backend cannot.
+	emulateRetrieval bool
+	retrievable      retrievableServices
+}
 
-	reg *messages.Registry
+// RegisterMetrics adds the proxy's metrics to reg. Those of its tenants are
+// served under their own routes.
+func (b *BusinessLogic) RegisterMetrics(reg prom.Registerer) error {
+	return reg.Register(b.metrics)
 }
 
 func (b *BusinessLogic) AdditionalRouting(router *mux.Router) {
-	// TODO: could pass in the router to the registry and it can do the assigning internally.
+	if b.tenant == "" {
+		b.authRouting(router)
+		b.catalogRouting(router)
+	}
+	b.retrievalRouting(router)
+	b.bindingRouting(router)
+	b.adminRouting(router)
+	b.tenantRouting(router)
 }
 
-var _ broker.Interface = &BusinessLogic{}
-
-type ResponseBody struct {
-	Response interface{} `json:"response"`
-	Error    interface{} `json:"error"`
+// adminRouting mounts the admin API, which tells about every instance and
+// tunnel, only when platforms have to prove who they are to call it.
+func (b *BusinessLogic) adminRouting(router *mux.Router) {
+	if b.auth == nil && b.authz == nil {
+		if b.tenant != "" {
+			glog.Warningf("tenant %s: not serving the admin API, it needs auth or clientAuthz", b.tenant)
+		} else {
+			glog.Warning("not serving the admin API, it needs --auth or --clientAuthz")
+		}
+		return
+	}
+	b.inventoryRouting(router)
+	b.tunnelRouting(router)
 }
 
-func (b *BusinessLogic) ventAndWait(method string, request interface{}) (*ResponseBody, error) {
-	id, err := b.reg.Vent(method, request)
+var _ broker.Interface = &BusinessLogic{}
 
+// ventAndWait calls op on the remote side serving serviceID and waits for its
+// reply, for as long as the timeout policy allows for the service and plan.
+// The platform's API version and forwarded headers are taken from c, which
+// is nil for the proxy's own calls.
+func ventAndWait[Req, Resp any](b *BusinessLogic, op messages.Operation[Req, Resp], request *Req, serviceID, planID string, c *broker.RequestContext) (*Resp, error) {
+	t, err := b.tunnelFor(serviceID)
 	if err != nil {
 		return nil, err
 	}
+	return ventAndWaitVia(b, t, op, request, serviceID, planID, c)
+}
 
-	body, err := b.reg.WaitFor(*id)
-	if err != nil {
-		return nil, err
+// ventAndWaitVia is ventAndWait through a given tunnel.
+func ventAndWaitVia[Req, Resp any](b *BusinessLogic, t *tunnel, op messages.Operation[Req, Resp], request *Req, serviceID, planID string, c *broker.RequestContext) (*Resp, error) {
+	timeout := b.timeout(t, op.Name, serviceID, planID)
+	glog.Infof("%s: waiting up to %s (tunnel %s, service %q, plan %q)", op.Name, timeout, t.name, serviceID, planID)
+	b.metrics.timeout.WithLabelValues(op.Name).Observe(timeout.Seconds())
+
+	opts := []messages.CallOption{messages.WithTimeout(timeout)}
+	version := ""
+	if c != nil && c.Request != nil {
+		version = c.Request.Header.Get(osb.APIVersionHeader)
+		opts = append(opts, messages.WithHeaders(b.forwardedHeaders(c.Request.Header)))
+	}
+	if version == "" && b.apiVersions != (apiversion.Range{}) {
+		// The proxy's own calls, such as the background catalog refresh,
+		// speak the newest version it supports, so that the catalog tells
+		// all the broker can do.
+		version = b.apiVersions.Max.String()
+	}
+	if version != "" {
+		opts = append(opts, messages.WithAPIVersion(version))
 	}
-	// body is a message response, with an error and a response.
-
-	var resp ResponseBody
 
-	if data, err := json.Marshal(body); err != nil {
-		glog.Error(err)
-	} else if err := json.Unmarshal(data, &resp); err != nil {
-		glog.Error(err)
+	if t.ids != nil && op.Name != messages.GetCatalog.Name && !t.ids.learned() {
+		// Only the broker's catalog tells how to map the platform's IDs
+		// back, and none was cached before the proxy started.
+		if _, err := b.refreshCatalog(nil); err != nil {
+			glog.Errorf("tunnel %s: cannot map the IDs of %s without the catalog: %v", t.name, op.Name, err)
+			return nil, err
+		}
 	}
 
-	return &resp, nil
+	start := time.Now()
+	resp, err := messages.Call(t.client, op, mapRequest(t.ids, request), opts...)
+	t.observe(b.metrics, err)
+	if err == messages.ErrTimeout {
+		glog.Errorf("%s: no reply within %s through tunnel %s", op.Name, timeout, t.name)
+		b.metrics.timeouts.WithLabelValues(op.Name).Inc()
+		return nil, err
+	}
+	b.metrics.duration.WithLabelValues(op.Name).Observe(time.Since(start).Seconds())
+	return mapResponse(t.ids, resp), err
 }
 
-func convertRemoteResponse(resp *ResponseBody, remoteResponse interface{}, remoteErr error) {
-	if resp.Response != nil {
-		if data, err := json.Marshal(resp.Response); err != nil {
-			glog.Error(err)
-		} else if err := json.Unmarshal(data, &remoteResponse); err != nil {
-			glog.Error(err)
+// forwardedHeaders picks the allowed headers out of header.
+func (b *BusinessLogic) forwardedHeaders(header http.Header) map[string]string {
+	var headers map[string]string
+	for _, key := range b.forwardHeaders {
+		if value := header.Get(key); value != "" {
+			if headers == nil {
+				headers = make(map[string]string)
+			}
+			headers[key] = value
 		}
 	}
+	return headers
+}
 
-	if resp.Error != nil {
-		remoteErr = resp.Error.(error)
+func deref(s *string) string {
+	if s == nil {
+		return ""
 	}
+	return *s
 }
 
-func (b *BusinessLogic) GetCatalog(c *broker.RequestContext) (remoteResponse *broker.CatalogResponse, remoteErr error) {
-	resp, err := b.ventAndWait("GetCatalog", nil)
-	if err != nil {
+func (b *BusinessLogic) Provision(request *osb.ProvisionRequest, c *broker.RequestContext) (*broker.ProvisionResponse, error) {
+	if err := b.validateProvision(request); err != nil {
 		return nil, err
 	}
-
-	convertRemoteResponse(resp, &remoteResponse, remoteErr)
-	return
+	response, err := b.provision(request, c)
+	response, err = conform(b, messages.Provision.Name, response, err, func(r *broker.ProvisionResponse) []violation {
+		return checkProvision(request, r)
+	})
+	b.recordProvision(request, response, err)
+	return response, err
 }
 
-func (b *BusinessLogic) Provision(request *osb.ProvisionRequest, c *broker.RequestContext) (remoteResponse *broker.ProvisionResponse, remoteErr error) {
-	resp, err := b.ventAndWait("Provision", request)
-	if err != nil {
-		return nil, err
+func (b *BusinessLogic) provision(request *osb.ProvisionRequest, c *broker.RequestContext) (*broker.ProvisionResponse, error) {
+	if !request.AcceptsIncomplete || b.asyncBudget <= 0 {
+		return ventAndWait(b, messages.Provision, request, request.ServiceID, request.PlanID, c)
 	}
 
-	convertRemoteResponse(resp, &remoteResponse, remoteErr)
-	return
+	response, key, err := ventOrDefer(b, messages.Provision, request, request.ServiceID, request.PlanID, c, func(r *broker.ProvisionResponse) (bool, *osb.OperationKey) {
+		return r.Async, r.OperationKey
+	})
+	if key != nil {
+		response = &broker.ProvisionResponse{}
+		response.Async = true
+		response.OperationKey = key
+	}
+	return response, err
 }
 
-func (b *BusinessLogic) Deprovision(request *osb.DeprovisionRequest, c *broker.RequestContext) (remoteResponse *broker.DeprovisionResponse, remoteErr error) {
-	resp, err := b.ventAndWait("Deprovision", request)
-	if err != nil {
+func (b *BusinessLogic) Deprovision(request *osb.DeprovisionRequest, c *broker.RequestContext) (*broker.DeprovisionResponse, error) {
+	if err := b.validateDeprovision(request); err != nil {
 		return nil, err
 	}
-
-	convertRemoteResponse(resp, &remoteResponse, remoteErr)
-	return
+	response, err := b.deprovision(request, c)
+	response, err = conform(b, messages.Deprovision.Name, response, err, func(r *broker.DeprovisionResponse) []violation {
+		return checkDeprovision(request, r)
+	})
+	b.recordDeprovision(request, response, err)
+	return response, err
 }
 
-func (b *BusinessLogic) LastOperation(request *osb.LastOperationRequest, c *broker.RequestContext) (remoteResponse *broker.LastOperationResponse, remoteErr error) {
-	resp, err := b.ventAndWait("LastOperation", request)
-	if err != nil {
-		return nil, err
+func (b *BusinessLogic) deprovision(request *osb.DeprovisionRequest, c *broker.RequestContext) (*broker.DeprovisionResponse, error) {
+	if !request.AcceptsIncomplete || b.asyncBudget <= 0 {
+		return ventAndWait(b, messages.Deprovision, request, request.ServiceID, request.PlanID, c)
+	}
+
+	response, key, err := ventOrDefer(b, messages.Deprovision, request, request.ServiceID, request.PlanID, c, func(r *broker.DeprovisionResponse) (bool, *osb.OperationKey) {
+		return r.Async, r.OperationKey
+	})
+	if key != nil {
+		response = &broker.DeprovisionResponse{}
+		response.Async = true
+		response.OperationKey = key
 	}
+	return response, err
+}
 
-	convertRemoteResponse(resp, &remoteResponse, remoteErr)
-	return
+func (b *BusinessLogic) LastOperation(request *osb.LastOperationRequest, c *broker.RequestContext) (*broker.LastOperationResponse, error) {
+	response, err := b.lastOperation(request, c)
+	response, err = conform(b, messages.LastOperation.Name, response, err, checkLastOperation)
+	b.recordLastOperation(request, response, err)
+	return response, err
 }
 
-func (b *BusinessLogic) Bind(request *osb.BindRequest, c *broker.RequestContext) (remoteResponse *broker.BindResponse, remoteErr error) {
-	resp, err := b.ventAndWait("Bind", request)
-	if err != nil {
-		return nil, err
+func (b *BusinessLogic) lastOperation(request *osb.LastOperationRequest, c *broker.RequestContext) (*broker.LastOperationResponse, error) {
+	serviceID, planID := b.requestIDs(request.InstanceID, request.ServiceID, request.PlanID)
+	// The remote broker is told the service and plan found in the
+	// inventory when the platform did not say them.
+	remote := *request
+	if serviceID != "" {
+		remote.ServiceID = &serviceID
 	}
-
-	convertRemoteResponse(resp, &remoteResponse, remoteErr)
-	return
+	if planID != "" {
+		remote.PlanID = &planID
+	}
+	if isProxyOperation(request.OperationKey) {
+		return b.proxyLastOperation(*request.OperationKey, func(remoteKey *osb.OperationKey) (*broker.LastOperationResponse, error) {
+			polled := remote
+			polled.OperationKey = remoteKey
+			return ventAndWait(b, messages.LastOperation, &polled, serviceID, planID, c)
+		})
+	}
+	return ventAndWait(b, messages.LastOperation, &remote, serviceID, planID, c)
 }
 
-func (b *BusinessLogic) Unbind(request *osb.UnbindRequest, c *broker.RequestContext) (remoteResponse *broker.UnbindResponse, remoteErr error) {
-	resp, err := b.ventAndWait("Unbind", request)
-	if err != nil {
+func (b *BusinessLogic) Bind(request *osb.BindRequest, c *broker.RequestContext) (*broker.BindResponse, error) {
+	acceptIncomplete(&request.AcceptsIncomplete, c)
+	if err := b.validateBind(request); err != nil {
 		return nil, err
 	}
+	response, err := b.bind(request, c)
+	response, err = conform(b, messages.Bind.Name, response, err, func(r *broker.BindResponse) []violation {
+		return checkBind(request, r)
+	})
+	b.recordBind(request, response, err)
+	return response, err
+}
 
-	convertRemoteResponse(resp, &remoteResponse, remoteErr)
-	return
+func (b *BusinessLogic) Unbind(request *osb.UnbindRequest, c *broker.RequestContext) (*broker.UnbindResponse, error) {
+	acceptIncomplete(&request.AcceptsIncomplete, c)
+	if err := b.validateUnbind(request); err != nil {
+		return nil, err
+	}
+	response, err := b.unbind(request, c)
+	response, err = conform(b, messages.Unbind.Name, response, err, func(r *broker.UnbindResponse) []violation {
+		return checkUnbind(request, r)
+	})
+	b.recordUnbind(request, response, err)
+	return response, err
 }
 
-func (b *BusinessLogic) Update(request *osb.UpdateInstanceRequest, c *broker.RequestContext) (remoteResponse *broker.UpdateInstanceResponse, remoteErr error) {
-	resp, err := b.ventAndWait("Update", request)
-	if err != nil {
+func (b *BusinessLogic) Update(request *osb.UpdateInstanceRequest, c *broker.RequestContext) (*broker.UpdateInstanceResponse, error) {
+	if err := b.validateUpdate(request); err != nil {
 		return nil, err
 	}
+	response, err := b.update(request, c)
+	response, err = conform(b, messages.Update.Name, response, err, func(r *broker.UpdateInstanceResponse) []violation {
+		return checkUpdate(request, r)
+	})
+	b.recordUpdate(request, response, err)
+	return response, err
+}
+
+func (b *BusinessLogic) update(request *osb.UpdateInstanceRequest, c *broker.RequestContext) (*broker.UpdateInstanceResponse, error) {
+	if !request.AcceptsIncomplete || b.asyncBudget <= 0 {
+		return ventAndWait(b, messages.Update, request, request.ServiceID, deref(request.PlanID), c)
+	}
 
-	convertRemoteResponse(resp, &remoteResponse, remoteErr)
-	return
+	response, key, err := ventOrDefer(b, messages.Update, request, request.ServiceID, deref(request.PlanID), c, func(r *broker.UpdateInstanceResponse) (bool, *osb.OperationKey) {
+		return r.Async, r.OperationKey
+	})
+	if key != nil {
+		response = &broker.UpdateInstanceResponse{}
+		response.Async = true
+		response.OperationKey = key
+	}
+	return response, err
 }
 
+// ValidateBrokerAPIVersion rejects platforms using an API version outside of
+// the configured range with 412 Precondition Failed.
 func (b *BusinessLogic) ValidateBrokerAPIVersion(version string) error {
-	glog.Info("ValidateBrokerAPIVersion")
+	if err := b.apiVersions.Check(version); err != nil {
+		glog.Infof("rejecting API version %q: %v", version, err)
+		return err
+	}
 	return nil
 }
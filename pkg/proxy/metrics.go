@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	prom "github.com/prometheus/client_golang/prometheus"
+)
+
+// proxyMetrics are the proxy's own metrics, next to the OSB metrics kept by
+// the broker library.
+type proxyMetrics struct {
+	// timeout is the effective wait applied to each request.
+	timeout *prom.HistogramVec
+	// duration is how long each request took to get a reply.
+	duration *prom.HistogramVec
+	// timeouts counts the requests that got no reply in time.
+	timeouts *prom.CounterVec
+	// violations counts the ways remote responses broke the OSB spec.
+	violations *prom.CounterVec
+	// tunnelUp is whether the remote side behind each tunnel replies.
+	tunnelUp *prom.GaugeVec
+	// conflicts counts the services left out of the merged catalog, by the
+	// tunnel serving them.
+	conflicts *prom.CounterVec
+}
+
+// newMetrics returns the metrics of tenant, which label them all, empty for
+// the proxy's own.
+func newMetrics(tenant string) *proxyMetrics {
+	labels := prom.Labels{"tenant": tenant}
+	return &proxyMetrics{
+		timeout: prom.NewHistogramVec(prom.HistogramOpts{
+			Namespace:   "proxy",
+			Name:        "request_timeout_seconds",
+			Help:        "Effective time the proxy waits for the remote side, by operation.",
+			ConstLabels: labels,
+			Buckets:     prom.ExponentialBuckets(1, 2, 12),
+		}, []string{"operation"}),
+		duration: prom.NewHistogramVec(prom.HistogramOpts{
+			Namespace:   "proxy",
+			Name:        "request_duration_seconds",
+			Help:        "Time until the remote side replied, by operation.",
+			ConstLabels: labels,
+			Buckets:     prom.ExponentialBuckets(0.05, 2, 14),
+		}, []string{"operation"}),
+		timeouts: prom.NewCounterVec(prom.CounterOpts{
+			Namespace:   "proxy",
+			Name:        "request_timeouts_total",
+			Help:        "Requests the remote side did not answer in time, by operation.",
+			ConstLabels: labels,
+		}, []string{"operation"}),
+		violations: prom.NewCounterVec(prom.CounterOpts{
+			Namespace:   "proxy",
+			Name:        "response_violations_total",
+			Help:        "OSB spec violations found in remote responses, by operation.",
+			ConstLabels: labels,
+		}, []string{"operation"}),
+		tunnelUp: prom.NewGaugeVec(prom.GaugeOpts{
+			Namespace:   "proxy",
+			Name:        "tunnel_up",
+			Help:        "Whether the remote side behind a tunnel replied to the last request, by tunnel.",
+			ConstLabels: labels,
+		}, []string{"tunnel"}),
+		conflicts: prom.NewCounterVec(prom.CounterOpts{
+			Namespace:   "proxy",
+			Name:        "catalog_conflicts_total",
+			Help:        "Services left out of the catalog for conflicting with another tunnel's, by tunnel.",
+			ConstLabels: labels,
+		}, []string{"tunnel"}),
+	}
+}
+
+func (m *proxyMetrics) Describe(ch chan<- *prom.Desc) {
+	m.timeout.Describe(ch)
+	m.duration.Describe(ch)
+	m.timeouts.Describe(ch)
+	m.violations.Describe(ch)
+	m.tunnelUp.Describe(ch)
+	m.conflicts.Describe(ch)
+}
+
+func (m *proxyMetrics) Collect(ch chan<- prom.Metric) {
+	m.timeout.Collect(ch)
+	m.duration.Collect(ch)
+	m.timeouts.Collect(ch)
+	m.violations.Collect(ch)
+	m.tunnelUp.Collect(ch)
+	m.conflicts.Collect(ch)
+}
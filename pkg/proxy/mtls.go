@@ -0,0 +1,320 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/n3wscott/k8s-broker-proxy/pkg/config"
+)
+
+// The proxy can serve TLS from certificate files, reread as they are
+// rotated, and require platforms to present a client certificate from a CA
+// of its own. ClientAuthz then says which certificates stand for which
+// platform, and what each may call.
+
+// ServerTLS is the TLS setup of the proxy, from files.
+type ServerTLS struct {
+	certFile, keyFile, clientCAFile string
+
+	mutex     sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	signature [sha256.Size]byte
+}
+
+// NewServerTLS reads the certificate and key the proxy serves, and the CA
+// bundle client certificates have to be signed by, empty to not ask for
+// them.
+func NewServerTLS(certFile, keyFile, clientCAFile string) (*ServerTLS, error) {
+	s := &ServerTLS{certFile: certFile, keyFile: keyFile, clientCAFile: clientCAFile}
+	if _, err := s.reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// reload rereads the files, and keeps the previous certificates if they
+// cannot be read.
+func (s *ServerTLS) reload() (bool, error) {
+	cert, err := ioutil.ReadFile(s.certFile)
+	if err != nil {
+		return false, err
+	}
+	key, err := ioutil.ReadFile(s.keyFile)
+	if err != nil {
+		return false, err
+	}
+	var ca []byte
+	if s.clientCAFile != "" {
+		if ca, err = ioutil.ReadFile(s.clientCAFile); err != nil {
+			return false, err
+		}
+	}
+	signature := sha256.New()
+	for _, data := range [][]byte{cert, key, ca} {
+		fmt.Fprintf(signature, "%d:", len(data))
+		signature.Write(data)
+	}
+	var sum [sha256.Size]byte
+	copy(sum[:], signature.Sum(nil))
+
+	s.mutex.RLock()
+	unchanged := s.cert != nil && sum == s.signature
+	s.mutex.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	pair, err := tls.X509KeyPair(cert, key)
+	if err != nil {
+		return false, fmt.Errorf("%s: %v", s.certFile, err)
+	}
+	var pool *x509.CertPool
+	if ca != nil {
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return false, fmt.Errorf("%s: no certificates", s.clientCAFile)
+		}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.cert, s.clientCAs, s.signature = &pair, pool, sum
+	return true, nil
+}
+
+// Config returns the TLS configuration of the server, which picks up the
+// files as they are reloaded.
+func (s *ServerTLS) Config() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		// Older Go releases only find the server certificate here, not in
+		// the config for the client.
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			s.mutex.RLock()
+			defer s.mutex.RUnlock()
+			return s.cert, nil
+		},
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			s.mutex.RLock()
+			defer s.mutex.RUnlock()
+			c := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*s.cert},
+				// The server only adds HTTP/2 to its own config.
+				NextProtos: []string{"h2", "http/1.1"},
+			}
+			if s.clientCAs != nil {
+				c.ClientAuth = tls.RequireAndVerifyClientCert
+				c.ClientCAs = s.clientCAs
+			}
+			return c, nil
+		},
+	}
+}
+
+// RunTLS serves handler with config, which the broker library's RunTLS has
+// no room for, until ctx is done.
+func RunTLS(ctx context.Context, handler http.Handler, addr string, config *tls.Config) error {
+	srv := &http.Server{Addr: addr, Handler: handler, TLSConfig: config}
+	go func() {
+		<-ctx.Done()
+		shutdown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(shutdown); err != nil {
+			glog.Errorf("error shutting down the server: %v", err)
+		}
+	}()
+
+	glog.Infof("Starting TLS server on %s", addr)
+	if err := srv.ListenAndServeTLS("", ""); err != http.ErrServerClosed {
+		return err
+	}
+	return ctx.Err()
+}
+
+// StartReload rereads the files every interval.
+func (s *ServerTLS) StartReload(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			changed, err := s.reload()
+			if err != nil {
+				glog.Errorf("keeping the previous TLS certificates: %v", err)
+			} else if changed {
+				glog.Info("reloaded the TLS certificates")
+			}
+		}
+	}()
+}
+
+// ClientAuthz lists the platforms allowed to call the proxy, by the client
+// certificates they present.
+type ClientAuthz struct {
+	Identities []ClientIdentity `json:"identities"`
+}
+
+// ClientIdentity is a platform, presenting a certificate whose subject, or
+// one of whose DNS, URI or email SANs, matches one of the path.Match
+// patterns, and the operations it may call, "*" for all of them. Operations
+// are named as the messages between the proxy and the local side are,
+// "Admin" stands for the admin API, and "Metrics" for the metrics of a
+// tenant.
+type ClientIdentity struct {
+	Name       string   `json:"name"`
+	Subjects   []string `json:"subjects,omitempty"`
+	DNSNames   []string `json:"dnsNames,omitempty"`
+	URIs       []string `json:"uris,omitempty"`
+	Emails     []string `json:"emails,omitempty"`
+	Operations []string `json:"operations"`
+}
+
+// LoadClientAuthz reads the client certificate authorization from a YAML or
+// JSON file.
+func LoadClientAuthz(file string) (*ClientAuthz, error) {
+	c := &ClientAuthz{}
+	if err := config.Load(file, c); err != nil {
+		return nil, err
+	}
+	for _, identity := range c.Identities {
+		if identity.Name == "" {
+			return nil, fmt.Errorf("%s: identities need a name", file)
+		}
+		for _, pattern := range identity.patterns() {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("%s: identity %s: bad pattern %q", file, identity.Name, pattern)
+			}
+		}
+	}
+	return c, nil
+}
+
+func (i ClientIdentity) patterns() []string {
+	var patterns []string
+	for _, list := range [][]string{i.Subjects, i.DNSNames, i.URIs, i.Emails} {
+		patterns = append(patterns, list...)
+	}
+	return patterns
+}
+
+func matchesAny(patterns []string, values ...string) bool {
+	for _, pattern := range patterns {
+		for _, value := range values {
+			if ok, _ := path.Match(pattern, value); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// identify returns the identity cert stands for, nil for none.
+func (c *ClientAuthz) identify(cert *x509.Certificate) *ClientIdentity {
+	var uris []string
+	for _, uri := range cert.URIs {
+		uris = append(uris, uri.String())
+	}
+	for i := range c.Identities {
+		identity := &c.Identities[i]
+		if matchesAny(identity.Subjects, cert.Subject.String()) ||
+			matchesAny(identity.DNSNames, cert.DNSNames...) ||
+			matchesAny(identity.URIs, uris...) ||
+			matchesAny(identity.Emails, cert.EmailAddresses...) {
+			return identity
+		}
+	}
+	return nil
+}
+
+func (i *ClientIdentity) allows(operation string) bool {
+	for _, allowed := range i.Operations {
+		if allowed == "*" || allowed == operation {
+			return true
+		}
+	}
+	return false
+}
+
+// operationOf names the operation a request with method to route, below the
+// tenant, calls, empty for routes outside the OSB and admin APIs.
+func operationOf(method, route string) string {
+	if strings.HasPrefix(route, "/admin/") {
+		return "Admin"
+	}
+	parts := strings.Split(strings.Trim(route, "/"), "/")
+	if len(parts) < 2 || parts[0] != "v2" {
+		return ""
+	}
+	parts = parts[1:]
+	switch {
+	case len(parts) == 1 && parts[0] == "catalog":
+		return "GetCatalog"
+	case len(parts) < 2 || parts[0] != "service_instances":
+		return ""
+	case len(parts) == 2:
+		return map[string]string{"PUT": "Provision", "PATCH": "Update", "DELETE": "Deprovision", "GET": "GetInstance"}[method]
+	case len(parts) == 3 && parts[2] == "last_operation":
+		return "LastOperation"
+	case len(parts) < 4 || parts[2] != "service_bindings":
+		return ""
+	case len(parts) == 4:
+		return map[string]string{"PUT": "Bind", "DELETE": "Unbind", "GET": "GetBinding"}[method]
+	case len(parts) == 5 && parts[4] == "last_operation":
+		return "BindingLastOperation"
+	}
+	return ""
+}
+
+// authorize lets through the requests whose client certificate stands for
+// an identity allowed to call their operation.
+func (b *BusinessLogic) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// A tenant's routes are authorized by the tenant's own identities,
+		// so a platform known to one tenant cannot call another.
+		proxy, route := b.servedBy(r.URL.Path)
+		operation := operationOf(r.Method, route)
+		if proxy.tenant != "" && route == "/metrics" {
+			operation = "Metrics"
+		}
+		if proxy.authz == nil || operation == "" || r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+		var identity *ClientIdentity
+		if r.TLS != nil && len(r.TLS.VerifiedChains) != 0 {
+			identity = proxy.authz.identify(r.TLS.VerifiedChains[0][0])
+		}
+		if identity == nil {
+			glog.V(1).Infof("rejected %s %s from %s: no known client certificate", r.Method, r.URL.Path, r.RemoteAddr)
+			writeJSON(w, http.StatusForbidden, osbError{
+				Error:       "Forbidden",
+				Description: "the request carries no client certificate the broker knows",
+			})
+			return
+		}
+		if !identity.allows(operation) {
+			glog.V(1).Infof("rejected %s %s from %s: %s may not call %s", r.Method, r.URL.Path, r.RemoteAddr, identity.Name, operation)
+			writeJSON(w, http.StatusForbidden, osbError{
+				Error:       "Forbidden",
+				Description: fmt.Sprintf("%s may not call %s", identity.Name, operation),
+			})
+			return
+		}
+		glog.V(2).Infof("%s %s from %s", operation, r.URL.Path, identity.Name)
+		next.ServeHTTP(w, r)
+	})
+}
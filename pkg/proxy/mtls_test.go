@@ -0,0 +1,291 @@
+package proxy
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/n3wscott/k8s-broker-proxy/pkg/apiversion"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+)
+
+// selfSigned returns a PEM certificate and key for commonName.
+func selfSigned(t *testing.T, commonName string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+}
+
+func TestServerTLSReload(t *testing.T) {
+	dir := t.TempDir()
+	cert, key := selfSigned(t, "first")
+	certFile := writeFile(t, filepath.Join(dir, "tls.crt"), cert)
+	keyFile := writeFile(t, filepath.Join(dir, "tls.key"), key)
+	caFile := writeFile(t, filepath.Join(dir, "ca.crt"), cert)
+
+	s, err := NewServerTLS(certFile, keyFile, caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := func() (*tls.Config, string) {
+		c, err := s.Config().GetConfigForClient(&tls.ClientHelloInfo{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaf, err := x509.ParseCertificate(c.Certificates[0].Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c, leaf.Subject.CommonName
+	}
+	if c, name := served(); name != "first" || c.ClientAuth != tls.RequireAndVerifyClientCert {
+		t.Errorf("expected the first certificate and client certificates to be required, got %s, %v", name, c.ClientAuth)
+	}
+
+	if changed, err := s.reload(); err != nil || changed {
+		t.Errorf("expected unchanged files, got %v, %v", changed, err)
+	}
+	cert, key = selfSigned(t, "second")
+	writeFile(t, certFile, cert)
+	writeFile(t, keyFile, key)
+	if changed, err := s.reload(); err != nil || !changed {
+		t.Fatalf("expected the rotated certificate to be picked up, got %v, %v", changed, err)
+	}
+	if _, name := served(); name != "second" {
+		t.Errorf("expected the rotated certificate, got %s", name)
+	}
+
+	writeFile(t, keyFile, "not a key")
+	if _, err := s.reload(); err == nil {
+		t.Error("expected a broken key to be refused")
+	}
+	if _, name := served(); name != "second" {
+		t.Errorf("expected the previous certificate to be kept, got %s", name)
+	}
+}
+
+func TestRunTLS(t *testing.T) {
+	dir := t.TempDir()
+	cert, key := selfSigned(t, "proxy")
+	certFile := writeFile(t, filepath.Join(dir, "tls.crt"), cert)
+	keyFile := writeFile(t, filepath.Join(dir, "tls.key"), key)
+	s, err := NewServerTLS(certFile, keyFile, writeFile(t, filepath.Join(dir, "ca.crt"), cert))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A port nothing listens on.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- RunTLS(ctx, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), addr, s.Config())
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	pair, err := tls.X509KeyPair([]byte(cert), []byte(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: &http.Transport{
+		// The certificate names no host.
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true, Certificates: []tls.Certificate{pair}},
+		ForceAttemptHTTP2: true,
+	}}
+	var response *http.Response
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		select {
+		case err := <-done:
+			t.Fatalf("expected the server to run, got %v", err)
+		default:
+		}
+		if response, err = client.Get("https://" + addr + "/"); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.ProtoMajor != 2 {
+		t.Errorf("expected HTTP/2, got %s", response.Proto)
+	}
+	if name := response.TLS.PeerCertificates[0].Subject.CommonName; name != "proxy" {
+		t.Errorf("expected the proxy's certificate, got %s", name)
+	}
+}
+
+func TestOperationOf(t *testing.T) {
+	cases := []struct{ method, route, operation string }{
+		{"GET", "/v2/catalog", "GetCatalog"},
+		{"PUT", "/v2/service_instances/i", "Provision"},
+		{"PATCH", "/v2/service_instances/i", "Update"},
+		{"DELETE", "/v2/service_instances/i", "Deprovision"},
+		{"GET", "/v2/service_instances/i", "GetInstance"},
+		{"GET", "/v2/service_instances/i/last_operation", "LastOperation"},
+		{"PUT", "/v2/service_instances/i/service_bindings/b", "Bind"},
+		{"DELETE", "/v2/service_instances/i/service_bindings/b", "Unbind"},
+		{"GET", "/v2/service_instances/i/service_bindings/b", "GetBinding"},
+		{"GET", "/v2/service_instances/i/service_bindings/b/last_operation", "BindingLastOperation"},
+		{"GET", "/admin/instances", "Admin"},
+		{"GET", "/metrics", ""},
+	}
+	for _, tc := range cases {
+		if operation := operationOf(tc.method, tc.route); operation != tc.operation {
+			t.Errorf("%s %s: expected %q, got %q", tc.method, tc.route, tc.operation, operation)
+		}
+	}
+}
+
+func TestAuthorizeClientCertificates(t *testing.T) {
+	platform, _ := url.Parse("spiffe://example.com/platform")
+	b := &BusinessLogic{authz: &ClientAuthz{Identities: []ClientIdentity{
+		{Name: "platform", URIs: []string{"spiffe://example.com/*"}, Operations: []string{"*"}},
+		{Name: "auditor", Subjects: []string{"CN=auditor*"}, Operations: []string{"GetCatalog", "Admin"}},
+	}}}
+	serve := func(method, path string, cert *x509.Certificate) int {
+		r := httptest.NewRequest(method, path, nil)
+		if cert != nil {
+			r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+		}
+		w := httptest.NewRecorder()
+		b.authorize(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		})).ServeHTTP(w, r)
+		return w.Code
+	}
+
+	cases := []struct {
+		name   string
+		method string
+		path   string
+		cert   *x509.Certificate
+		code   int
+	}{
+		{name: "no certificate", method: "GET", path: "/v2/catalog", code: http.StatusForbidden},
+		{name: "not an OSB route", method: "GET", path: "/metrics", code: http.StatusOK},
+		{name: "platform by URI", method: "PUT", path: "/v2/service_instances/i", cert: &x509.Certificate{URIs: []*url.URL{platform}}, code: http.StatusOK},
+		{name: "auditor reads", method: "GET", path: "/v2/catalog", cert: &x509.Certificate{Subject: pkix.Name{CommonName: "auditor-1"}}, code: http.StatusOK},
+		{name: "auditor provisions", method: "PUT", path: "/v2/service_instances/i", cert: &x509.Certificate{Subject: pkix.Name{CommonName: "auditor-1"}}, code: http.StatusForbidden},
+		{name: "unknown certificate", method: "GET", path: "/v2/catalog", cert: &x509.Certificate{Subject: pkix.Name{CommonName: "someone"}}, code: http.StatusForbidden},
+	}
+	for _, tc := range cases {
+		if code := serve(tc.method, tc.path, tc.cert); code != tc.code {
+			t.Errorf("%s: expected %d, got %d", tc.name, tc.code, code)
+		}
+	}
+}
+
+func TestTenantsAuthorizeTheirOwnCertificates(t *testing.T) {
+	dir := t.TempDir()
+	serverCert, serverKey := selfSigned(t, "proxy")
+	acmeCert, acmeKey := selfSigned(t, "acme")
+	globexCert, globexKey := selfSigned(t, "globex")
+	serverTLS, err := NewServerTLS(
+		writeFile(t, filepath.Join(dir, "tls.crt"), serverCert),
+		writeFile(t, filepath.Join(dir, "tls.key"), serverKey),
+		writeFile(t, filepath.Join(dir, "ca.crt"), acmeCert+globexCert),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tenant := func(name string) *BusinessLogic {
+		b := newTestBusinessLogic(t, slowBroker{})
+		b.tenant = name
+		b.apiVersions = apiversion.Range{Min: apiversion.Version{Major: 2, Minor: 11}, Max: apiversion.Version{Major: 2, Minor: 14}}
+		b.authz = &ClientAuthz{Identities: []ClientIdentity{{Name: name, Subjects: []string{"CN=" + name}, Operations: []string{"*"}}}}
+		if err := b.tenantAPI(); err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	b := &BusinessLogic{tenants: map[string]*BusinessLogic{"acme": tenant("acme"), "globex": tenant("globex")}}
+	router := mux.NewRouter()
+	b.AdditionalRouting(router)
+
+	server := httptest.NewUnstartedServer(router)
+	server.TLS = serverTLS.Config()
+	server.StartTLS()
+	defer server.Close()
+
+	get := func(cert, key, path string) int {
+		pair, err := tls.X509KeyPair([]byte(cert), []byte(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			Certificates:       []tls.Certificate{pair},
+			InsecureSkipVerify: true,
+		}}}
+		r, err := http.NewRequest(http.MethodGet, server.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set(osb.APIVersionHeader, "2.13")
+		resp, err := client.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := get(acmeCert, acmeKey, "/tenants/acme/v2/catalog"); code != http.StatusOK {
+		t.Errorf("expected acme to read its own catalog, got %d", code)
+	}
+	if code := get(acmeCert, acmeKey, "/tenants/globex/v2/catalog"); code != http.StatusForbidden {
+		t.Errorf("expected acme to be kept out of globex, got %d", code)
+	}
+	if code := get(globexCert, globexKey, "/tenants/acme/v2/service_instances/i"); code != http.StatusForbidden {
+		t.Errorf("expected globex to be kept out of acme, got %d", code)
+	}
+	if code := get(acmeCert, acmeKey, "/tenants/acme/metrics"); code != http.StatusOK {
+		t.Errorf("expected acme to read its own metrics, got %d", code)
+	}
+	if code := get(globexCert, globexKey, "/tenants/acme/metrics"); code != http.StatusForbidden {
+		t.Errorf("expected globex to be kept out of the metrics of acme, got %d", code)
+	}
+}
@@ -0,0 +1,180 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/n3wscott/k8s-broker-proxy/messages"
+	"github.com/pborman/uuid"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	"github.com/pmorie/osb-broker-lib/pkg/broker"
+)
+
+// proxyOperationPrefix marks operation keys minted by the proxy, as opposed
+// to keys the remote broker returned.
+const proxyOperationPrefix = "proxy-"
+
+// operationRetention is how long a finished operation is kept for the
+// platform to poll.
+const operationRetention = time.Hour
+
+// operation is a request the proxy answered with 202 Accepted because the
+// remote side was too slow, and is still waiting on in the background.
+type operation struct {
+	name    string
+	done    bool
+	updated time.Time
+
+	// err is the error the remote side answered with.
+	err error
+	// remoteAsync is set when the remote broker itself answered
+	// asynchronously, in which case remoteKey is its operation key and it
+	// has to be polled for the outcome.
+	remoteAsync bool
+	remoteKey   *osb.OperationKey
+
+	// request is what was sent and response what the remote side answered,
+	// for operations that need more than the state once they are done.
+	request  interface{}
+	response interface{}
+}
+
+// operationTable tracks the operations the proxy made asynchronous.
+type operationTable struct {
+	mutex      sync.Mutex
+	operations map[osb.OperationKey]*operation
+}
+
+func newOperationTable() *operationTable {
+	return &operationTable{
+		operations: make(map[osb.OperationKey]*operation),
+	}
+}
+
+func isProxyOperation(key *osb.OperationKey) bool {
+	return key != nil && strings.HasPrefix(string(*key), proxyOperationPrefix)
+}
+
+// start records a new in-progress operation for request and returns its key.
+func (t *operationTable) start(name string, request interface{}) osb.OperationKey {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for key, op := range t.operations {
+		if op.done && time.Since(op.updated) > operationRetention {
+			delete(t.operations, key)
+		}
+	}
+
+	key := osb.OperationKey(proxyOperationPrefix + uuid.NewUUID().String())
+	t.operations[key] = &operation{
+		name:    name,
+		updated: time.Now(),
+		request: request,
+	}
+	return key
+}
+
+// finish records the outcome of the operation.
+func (t *operationTable) finish(key osb.OperationKey, response interface{}, remoteAsync bool, remoteKey *osb.OperationKey, err error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	op, ok := t.operations[key]
+	if !ok {
+		return
+	}
+	op.done = true
+	op.updated = time.Now()
+	op.err = err
+	op.response = response
+	op.remoteAsync = remoteAsync
+	op.remoteKey = remoteKey
+}
+
+func (t *operationTable) get(key osb.OperationKey) (operation, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	op, ok := t.operations[key]
+	if !ok {
+		return operation{}, false
+	}
+	return *op, true
+}
+
+type callResult[Resp any] struct {
+	response *Resp
+	err      error
+}
+
+// ventOrDefer is ventAndWait for requests that accept an incomplete answer.
+// If no reply arrives within the async budget, it returns the key of a proxy
+// operation instead of a response and keeps waiting in the background.
+// remote extracts whether and how the remote broker itself answered
+// asynchronously.
+func ventOrDefer[Req, Resp any](b *BusinessLogic, op messages.Operation[Req, Resp], request *Req, serviceID, planID string, c *broker.RequestContext, remote func(*Resp) (bool, *osb.OperationKey)) (*Resp, *osb.OperationKey, error) {
+	done := make(chan callResult[Resp], 1)
+	go func() {
+		response, err := ventAndWait(b, op, request, serviceID, planID, c)
+		done <- callResult[Resp]{response, err}
+	}()
+
+	select {
+	case result := <-done:
+		return result.response, nil, result.err
+	case <-time.After(b.asyncBudget):
+	}
+
+	key := b.operations.start(op.Name, request)
+	glog.Infof("%s: no reply within %s, continuing as operation %s", op.Name, b.asyncBudget, key)
+	go func() {
+		result := <-done
+		var remoteAsync bool
+		var remoteKey *osb.OperationKey
+		if result.err == nil && result.response != nil {
+			remoteAsync, remoteKey = remote(result.response)
+		}
+		glog.Infof("%s: operation %s finished, error: %v", op.Name, key, result.err)
+		b.operations.finish(key, result.response, remoteAsync, remoteKey, result.err)
+	}()
+	return nil, &key, nil
+}
+
+// proxyLastOperation answers a poll for an operation the proxy made
+// asynchronous. Once the remote broker's answer is in, it is replayed: a
+// remote asynchronous answer is polled with poll using the remote key.
+func (b *BusinessLogic) proxyLastOperation(key osb.OperationKey, poll func(remoteKey *osb.OperationKey) (*broker.LastOperationResponse, error)) (*broker.LastOperationResponse, error) {
+	op, ok := b.operations.get(key)
+	if !ok {
+		description := fmt.Sprintf("unknown operation %s, the proxy may have restarted", key)
+		return nil, osb.HTTPStatusCodeError{
+			StatusCode:  http.StatusBadRequest,
+			Description: &description,
+		}
+	}
+
+	response := &broker.LastOperationResponse{}
+	switch {
+	case !op.done:
+		response.State = osb.StateInProgress
+	case op.remoteAsync:
+		return poll(op.remoteKey)
+	case op.err != nil:
+		if httpErr, ok := osb.IsHTTPError(op.err); ok && httpErr.StatusCode == http.StatusGone {
+			// Gone is how the platform learns a deprovision or unbind
+			// succeeded.
+			return nil, op.err
+		}
+		description := op.err.Error()
+		response.State = osb.StateFailed
+		response.Description = &description
+	default:
+		response.State = osb.StateSucceeded
+	}
+	return response, nil
+}
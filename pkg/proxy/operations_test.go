@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/n3wscott/k8s-broker-proxy/pkg/inventory"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+)
+
+func TestProvisionBecomesAsync(t *testing.T) {
+	b := newTestBusinessLogic(t, slowBroker{delay: 100 * time.Millisecond})
+	b.asyncBudget = 10 * time.Millisecond
+
+	response, err := b.Provision(&osb.ProvisionRequest{InstanceID: "instance", ServiceID: "service", PlanID: "plan", AcceptsIncomplete: true}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !response.Async || !isProxyOperation(response.OperationKey) {
+		t.Fatalf("expected an async response with a proxy operation, got %+v", response)
+	}
+
+	poll := &osb.LastOperationRequest{InstanceID: "instance", OperationKey: response.OperationKey}
+	last, err := b.LastOperation(poll, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last.State != osb.StateInProgress {
+		t.Errorf("expected %q while the remote side works, got %q", osb.StateInProgress, last.State)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	if last, err = b.LastOperation(poll, nil); err != nil {
+		t.Fatal(err)
+	}
+	if last.State != osb.StateSucceeded {
+		t.Errorf("expected %q once the reply arrived, got %q", osb.StateSucceeded, last.State)
+	}
+
+	instance, err := b.inventory.GetInstance("instance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if instance.State != inventory.StateSucceeded {
+		t.Errorf("expected the inventory to record %q, got %q", inventory.StateSucceeded, instance.State)
+	}
+}
+
+func TestProvisionStaysSyncWithoutAcceptsIncomplete(t *testing.T) {
+	b := newTestBusinessLogic(t, slowBroker{delay: 50 * time.Millisecond})
+	b.asyncBudget = 10 * time.Millisecond
+
+	response, err := b.Provision(&osb.ProvisionRequest{InstanceID: "instance", ServiceID: "service", PlanID: "plan"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Async {
+		t.Errorf("expected a synchronous response, got %+v", response)
+	}
+}
+
+func TestBindBecomesAsync(t *testing.T) {
+	b := newTestBusinessLogic(t, slowBroker{delay: 100 * time.Millisecond})
+	b.asyncBudget = 10 * time.Millisecond
+	b.emulateRetrieval = true
+	sealer, err := inventory.NewSealer(bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.sealer = sealer
+
+	request := &osb.BindRequest{InstanceID: "instance", BindingID: "binding", ServiceID: "service", PlanID: "plan", AcceptsIncomplete: true}
+	response, err := b.Bind(request, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !response.Async || !isProxyOperation(response.OperationKey) {
+		t.Fatalf("expected an async response with a proxy operation, got %+v", response)
+	}
+
+	fetch := &osb.GetBindingRequest{InstanceID: "instance", BindingID: "binding"}
+	if _, err := b.GetBinding(fetch, nil); err == nil {
+		t.Error("expected the binding to be unavailable while it is being bound")
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	poll := &osb.BindingLastOperationRequest{InstanceID: "instance", BindingID: "binding", OperationKey: response.OperationKey}
+	last, err := b.BindingLastOperation(poll, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last.State != osb.StateSucceeded {
+		t.Fatalf("expected %q once the reply arrived, got %q", osb.StateSucceeded, last.State)
+	}
+
+	binding, err := b.GetBinding(fetch, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if binding.Credentials["password"] != "secret" {
+		t.Errorf("expected the credentials of the deferred bind, got %v", binding.Credentials)
+	}
+}
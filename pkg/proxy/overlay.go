@@ -0,0 +1,202 @@
+package proxy
+
+import (
+	"fmt"
+
+	"github.com/golang/glog"
+	"github.com/n3wscott/k8s-broker-proxy/pkg/config"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	"github.com/pmorie/osb-broker-lib/pkg/broker"
+)
+
+// CatalogOverlay is the catalog file given with --catalogPath. In static
+// mode its Catalog is served as is and the remote side is never asked for
+// one. In overlay mode, the default, Services change the remote catalog.
+type CatalogOverlay struct {
+	Mode    string               `json:"mode,omitempty"`
+	Catalog *osb.CatalogResponse `json:"catalog,omitempty"`
+
+	Services []ServiceOverlay `json:"services,omitempty"`
+}
+
+const (
+	overlayModeOverlay = "overlay"
+	overlayModeStatic  = "static"
+)
+
+// ServiceOverlay changes the remote service with the same ID. Metadata is
+// merged into the remote metadata, and DisplayName sets its displayName.
+type ServiceOverlay struct {
+	ID          string                 `json:"id"`
+	Name        *string                `json:"name,omitempty"`
+	Description *string                `json:"description,omitempty"`
+	DisplayName *string                `json:"displayName,omitempty"`
+	Metadata    map[string]interface{} `json:"metadata,omitempty"`
+	// Hidden leaves the service out of the catalog.
+	Hidden bool `json:"hidden,omitempty"`
+
+	Plans []PlanOverlay `json:"plans,omitempty"`
+}
+
+// PlanOverlay changes the remote plan with the same ID, or adds Plan. An
+// added plan is passed on to the remote side unchanged, so the backend has to
+// accept it even though it does not list it.
+type PlanOverlay struct {
+	ID          string                 `json:"id"`
+	Name        *string                `json:"name,omitempty"`
+	Description *string                `json:"description,omitempty"`
+	DisplayName *string                `json:"displayName,omitempty"`
+	Metadata    map[string]interface{} `json:"metadata,omitempty"`
+	Hidden      bool                   `json:"hidden,omitempty"`
+
+	Plan *osb.Plan `json:"plan,omitempty"`
+}
+
+// LoadCatalogOverlay reads a catalog overlay from a YAML or JSON file.
+func LoadCatalogOverlay(path string) (*CatalogOverlay, error) {
+	overlay := &CatalogOverlay{}
+	if err := config.Load(path, overlay); err != nil {
+		return nil, err
+	}
+	switch overlay.Mode {
+	case "":
+		overlay.Mode = overlayModeOverlay
+	case overlayModeOverlay:
+	case overlayModeStatic:
+		if overlay.Catalog == nil {
+			return nil, fmt.Errorf("%s: a static catalog needs a catalog", path)
+		}
+	default:
+		return nil, fmt.Errorf("%s: unknown catalog mode %q", path, overlay.Mode)
+	}
+	if err := overlay.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return overlay, nil
+}
+
+// validate checks what can be told without the remote catalog: every entry
+// has an ID, no ID is overlaid twice, and added plans are plans.
+func (o *CatalogOverlay) validate() error {
+	services := make(map[string]bool)
+	for _, so := range o.Services {
+		if so.ID == "" {
+			return fmt.Errorf("a service has no id")
+		}
+		if services[so.ID] {
+			return fmt.Errorf("service %s is overlaid twice", so.ID)
+		}
+		services[so.ID] = true
+		plans := make(map[string]bool)
+		for _, po := range so.Plans {
+			if po.ID == "" {
+				return fmt.Errorf("a plan of service %s has no id", so.ID)
+			}
+			if plans[po.ID] {
+				return fmt.Errorf("plan %s of service %s is overlaid twice", po.ID, so.ID)
+			}
+			plans[po.ID] = true
+			if po.Plan != nil && (po.Plan.Name == "" || po.Plan.Description == "") {
+				return fmt.Errorf("added plan %s of service %s needs a name and a description", po.ID, so.ID)
+			}
+		}
+	}
+	return nil
+}
+
+// static returns the catalog to serve instead of the remote one, or nil.
+func (o *CatalogOverlay) static() *broker.CatalogResponse {
+	if o == nil || o.Mode != overlayModeStatic {
+		return nil
+	}
+	return &broker.CatalogResponse{CatalogResponse: *o.Catalog}
+}
+
+// apply changes catalog in place. Entries for services and plans the remote
+// catalog does not have, or adding plans it already has, are logged and
+// skipped, so that the rest of the overlay still applies.
+func (o *CatalogOverlay) apply(catalog *broker.CatalogResponse) {
+	if o == nil || o.Mode != overlayModeOverlay {
+		return
+	}
+
+	hidden := make(map[string]bool)
+	for _, so := range o.Services {
+		service, err := findService(catalog, so.ID)
+		if err != nil {
+			glog.Warningf("catalog overlay: skipping service %s, it does not exist remotely", so.ID)
+			continue
+		}
+		if so.Hidden {
+			hidden[so.ID] = true
+			continue
+		}
+		setString(&service.Name, so.Name)
+		setString(&service.Description, so.Description)
+		service.Metadata = mergeMetadata(service.Metadata, so.Metadata, so.DisplayName)
+
+		hiddenPlans := make(map[string]bool)
+		for _, po := range so.Plans {
+			plan, err := findPlan(service, po.ID)
+			if po.Plan != nil {
+				if err == nil {
+					glog.Warningf("catalog overlay: not adding plan %s of service %s, it already exists remotely", po.ID, so.ID)
+					continue
+				}
+				added := *po.Plan
+				added.ID = po.ID
+				service.Plans = append(service.Plans, added)
+				continue
+			}
+			if err != nil {
+				glog.Warningf("catalog overlay: skipping plan %s of service %s, it does not exist remotely", po.ID, so.ID)
+				continue
+			}
+			if po.Hidden {
+				hiddenPlans[po.ID] = true
+				continue
+			}
+			setString(&plan.Name, po.Name)
+			setString(&plan.Description, po.Description)
+			plan.Metadata = mergeMetadata(plan.Metadata, po.Metadata, po.DisplayName)
+		}
+		plans := service.Plans[:0]
+		for _, plan := range service.Plans {
+			if !hiddenPlans[plan.ID] {
+				plans = append(plans, plan)
+			}
+		}
+		service.Plans = plans
+	}
+
+	services := catalog.Services[:0]
+	for _, service := range catalog.Services {
+		if !hidden[service.ID] {
+			services = append(services, service)
+		}
+	}
+	catalog.Services = services
+}
+
+func setString(field *string, value *string) {
+	if value != nil {
+		*field = *value
+	}
+}
+
+func mergeMetadata(metadata, overlay map[string]interface{}, displayName *string) map[string]interface{} {
+	if len(overlay) == 0 && displayName == nil {
+		return metadata
+	}
+	merged := make(map[string]interface{}, len(metadata)+len(overlay)+1)
+	for k, v := range metadata {
+		merged[k] = v
+	}
+	for k, v := range overlay {
+		merged[k] = v
+	}
+	if displayName != nil {
+		merged["displayName"] = *displayName
+	}
+	return merged
+}
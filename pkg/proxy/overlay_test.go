@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"path/filepath"
+	"testing"
+
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	"github.com/pmorie/osb-broker-lib/pkg/broker"
+)
+
+func overlayTestCatalog() *broker.CatalogResponse {
+	catalog := testCatalog()
+	catalog.Services[0].Plans = append(catalog.Services[0].Plans, osb.Plan{ID: "legacy", Name: "legacy", Description: "legacy"})
+	return catalog
+}
+
+func TestCatalogOverlay(t *testing.T) {
+	overlay := loadOverlay(t, `{
+		"services": [{
+			"id": "service",
+			"description": "A better description",
+			"displayName": "Service",
+			"plans": [
+				{"id": "legacy", "hidden": true},
+				{"id": "plan", "metadata": {"costs": "free"}},
+				{"id": "extra", "plan": {"name": "extra", "description": "extra"}}
+			]
+		}]
+	}`)
+
+	catalog := overlayTestCatalog()
+	overlay.apply(catalog)
+	service := catalog.Services[0]
+	if service.Description != "A better description" || service.Metadata["displayName"] != "Service" {
+		t.Errorf("expected the service to be overlaid, got %+v", service)
+	}
+	if len(service.Plans) != 2 || service.Plans[0].ID != "plan" || service.Plans[1].ID != "extra" {
+		t.Fatalf("expected plans plan and extra, got %+v", service.Plans)
+	}
+	if service.Plans[0].Metadata["costs"] != "free" {
+		t.Errorf("expected the plan metadata to be merged, got %v", service.Plans[0].Metadata)
+	}
+}
+
+func TestCatalogOverlaySkipsBadEntries(t *testing.T) {
+	b := newTestBusinessLogic(t, slowBroker{})
+	b.overlay = loadOverlay(t, `{"services": [
+		{"id": "missing", "description": "gone"},
+		{"id": "service", "description": "overlaid", "plans": [
+			{"id": "missing", "hidden": true},
+			{"id": "plan", "plan": {"name": "plan", "description": "again"}},
+			{"id": "legacy", "hidden": true}
+		]}
+	]}`)
+
+	catalog, err := b.cacheCatalog(map[string]*broker.CatalogResponse{defaultTunnel: overlayTestCatalog()})
+	if err != nil {
+		t.Fatalf("expected the catalog to be cached despite the bad entries, got %v", err)
+	}
+	service := catalog.Services[0]
+	if service.Description != "overlaid" {
+		t.Errorf("expected the rest of the overlay to apply, got %+v", service)
+	}
+	if len(service.Plans) != 1 || service.Plans[0].ID != "plan" || service.Plans[0].Description == "again" {
+		t.Errorf("expected only the remote plan to be left, got %+v", service.Plans)
+	}
+}
+
+func TestCatalogOverlayValidation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "catalog.yaml")
+	for _, content := range []string{
+		`{"services": [{"plans": [{"id": "plan"}]}]}`,
+		`{"services": [{"id": "service"}, {"id": "service"}]}`,
+		`{"services": [{"id": "service", "plans": [{"hidden": true}]}]}`,
+		`{"services": [{"id": "service", "plans": [{"id": "plan"}, {"id": "plan"}]}]}`,
+		`{"services": [{"id": "service", "plans": [{"id": "extra", "plan": {}}]}]}`,
+	} {
+		if _, err := LoadCatalogOverlay(writeFile(t, path, content)); err == nil {
+			t.Errorf("%s: expected the overlay to be refused", content)
+		}
+	}
+}
+
+func TestStaticCatalog(t *testing.T) {
+	overlay := loadOverlay(t, `{"mode": "static", "catalog": {"services": [{"id": "static", "name": "static", "description": "static"}]}}`)
+	catalog := overlay.static()
+	if catalog == nil || len(catalog.Services) != 1 || catalog.Services[0].ID != "static" {
+		t.Errorf("expected the static catalog, got %+v", catalog)
+	}
+}
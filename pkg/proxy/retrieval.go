@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/n3wscott/k8s-broker-proxy/messages"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	"github.com/pmorie/osb-broker-lib/pkg/broker"
+)
+
+var _ messages.InstanceRetriever = &BusinessLogic{}
+var _ messages.BindingRetriever = &BusinessLogic{}
+
+// retrievalRouting mounts the OSB fetch instance and fetch binding endpoints,
+// which the broker library does not serve.
+func (b *BusinessLogic) retrievalRouting(router *mux.Router) {
+	router.HandleFunc("/v2/service_instances/{instance_id}", b.getInstanceHandler).Methods("GET")
+	router.HandleFunc("/v2/service_instances/{instance_id}/service_bindings/{binding_id}", b.getBindingHandler).Methods("GET")
+}
+
+func (b *BusinessLogic) GetInstance(request *osb.GetInstanceRequest, c *broker.RequestContext) (*osb.GetInstanceResponse, error) {
+	serviceID, planID := b.instanceIDs(request.InstanceID)
+	if b.emulateRetrieval && !b.retrievabilityOf(serviceID).instances {
+		return b.emulatedGetInstance(request)
+	}
+	response, err := ventAndWait(b, messages.GetInstance, request, serviceID, planID, c)
+	return conform(b, messages.GetInstance.Name, response, err, checkGetInstance)
+}
+
+func (b *BusinessLogic) GetBinding(request *osb.GetBindingRequest, c *broker.RequestContext) (*osb.GetBindingResponse, error) {
+	serviceID, planID := b.instanceIDs(request.InstanceID)
+	if b.emulateRetrieval && !b.retrievabilityOf(serviceID).bindings {
+		return b.emulatedGetBinding(request)
+	}
+	return ventAndWait(b, messages.GetBinding, request, serviceID, planID, c)
+}
+
+func (b *BusinessLogic) getInstanceHandler(w http.ResponseWriter, r *http.Request) {
+	if err := b.ValidateBrokerAPIVersion(r.Header.Get(osb.APIVersionHeader)); err != nil {
+		writeOSBError(w, err)
+		return
+	}
+
+	request := &osb.GetInstanceRequest{
+		InstanceID: mux.Vars(r)["instance_id"],
+	}
+	response, err := b.GetInstance(request, &broker.RequestContext{Writer: w, Request: r})
+	if err != nil {
+		writeOSBError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (b *BusinessLogic) getBindingHandler(w http.ResponseWriter, r *http.Request) {
+	if err := b.ValidateBrokerAPIVersion(r.Header.Get(osb.APIVersionHeader)); err != nil {
+		writeOSBError(w, err)
+		return
+	}
+
+	vars := mux.Vars(r)
+	request := &osb.GetBindingRequest{
+		InstanceID: vars["instance_id"],
+		BindingID:  vars["binding_id"],
+	}
+	response, err := b.GetBinding(request, &broker.RequestContext{Writer: w, Request: r})
+	if err != nil {
+		writeOSBError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, response)
+}
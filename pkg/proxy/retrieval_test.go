@@ -0,0 +1,121 @@
+package proxy
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+
+	"github.com/n3wscott/k8s-broker-proxy/pkg/inventory"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+)
+
+func TestEmulatedRetrieval(t *testing.T) {
+	b := newTestBusinessLogic(t, slowBroker{})
+	b.emulateRetrieval = true
+	sealer, err := inventory.NewSealer(bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.sealer = sealer
+	cacheTestCatalog(t, b, testCatalog())
+
+	catalog, err := b.GetCatalog(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if service := catalog.Services[0]; !service.InstancesRetrievable || !service.BindingsRetrievable {
+		t.Errorf("expected the catalog to advertise retrieval, got %+v", service)
+	}
+
+	if _, err := b.GetInstance(&osb.GetInstanceRequest{InstanceID: "instance"}, nil); !isStatus(err, http.StatusNotFound) {
+		t.Errorf("expected an unknown instance to be not found, got %v", err)
+	}
+
+	provision := &osb.ProvisionRequest{
+		InstanceID: "instance",
+		ServiceID:  "service",
+		PlanID:     "plan",
+		Parameters: map[string]interface{}{"size": "small"},
+	}
+	if _, err := b.Provision(provision, nil); err != nil {
+		t.Fatal(err)
+	}
+	instance, err := b.GetInstance(&osb.GetInstanceRequest{InstanceID: "instance"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if instance.ServiceID != "service" || instance.PlanID != "plan" || instance.Parameters["size"] != "small" {
+		t.Errorf("expected the provisioned instance, got %+v", instance)
+	}
+
+	bind := &osb.BindRequest{InstanceID: "instance", BindingID: "binding", ServiceID: "service", PlanID: "plan"}
+	if _, err := b.Bind(bind, nil); err != nil {
+		t.Fatal(err)
+	}
+	binding, err := b.GetBinding(&osb.GetBindingRequest{InstanceID: "instance", BindingID: "binding"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if binding.Credentials["password"] != "secret" {
+		t.Errorf("expected the credentials of the bind, got %v", binding.Credentials)
+	}
+}
+
+func TestRetrievalPassesThrough(t *testing.T) {
+	b := newTestBusinessLogic(t, slowBroker{})
+
+	catalog, err := b.GetCatalog(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if service := catalog.Services[0]; service.InstancesRetrievable || service.BindingsRetrievable {
+		t.Errorf("expected the catalog to advertise what the backend supports, got %+v", service)
+	}
+
+	provision := &osb.ProvisionRequest{InstanceID: "instance", ServiceID: "service", PlanID: "plan"}
+	if _, err := b.Provision(provision, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.GetInstance(&osb.GetInstanceRequest{InstanceID: "instance"}, nil); !isStatus(err, http.StatusNotImplemented) {
+		t.Errorf("expected the backend to refuse fetch instance, got %v", err)
+	}
+	if _, err := b.GetBinding(&osb.GetBindingRequest{InstanceID: "instance", BindingID: "binding"}, nil); !isStatus(err, http.StatusNotImplemented) {
+		t.Errorf("expected the backend to refuse fetch binding, got %v", err)
+	}
+}
+
+func TestRetrievalAsksTheCatalogFirst(t *testing.T) {
+	b := newTestBusinessLogic(t, retrievingBroker{dashboardURL: "https://backend"})
+	b.emulateRetrieval = true
+	// A proxy that just started has no catalog to tell the backend can
+	// fetch instances.
+	forgetTestCatalog(b)
+	if err := b.inventory.PutInstance(&inventory.Instance{ID: "instance", ServiceID: "service", PlanID: "plan"}); err != nil {
+		t.Fatal(err)
+	}
+
+	instance, err := b.GetInstance(&osb.GetInstanceRequest{InstanceID: "instance"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if instance.DashboardURL != "https://backend" {
+		t.Errorf("expected the backend to be asked, got %+v", instance)
+	}
+}
+
+func TestEmulatedBindingNeedsItsCredentials(t *testing.T) {
+	b := newTestBusinessLogic(t, slowBroker{})
+	b.emulateRetrieval = true
+	if err := b.inventory.PutBinding(&inventory.Binding{ID: "binding", InstanceID: "instance", ServiceID: "service", PlanID: "plan"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := b.GetBinding(&osb.GetBindingRequest{InstanceID: "instance", BindingID: "binding"}, nil); !isStatus(err, http.StatusNotFound) {
+		t.Errorf("expected a binding without its credentials to be not found, got %v", err)
+	}
+}
+
+func isStatus(err error, code int) bool {
+	httpErr, ok := osb.IsHTTPError(err)
+	return ok && httpErr.StatusCode == code
+}
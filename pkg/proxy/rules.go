@@ -0,0 +1,189 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+
+	"github.com/n3wscott/k8s-broker-proxy/pkg/config"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	"github.com/pmorie/osb-broker-lib/pkg/broker"
+)
+
+// CatalogRules filter and rewrite the catalog served to the platform. They
+// are read from the file given with --catalogRules. Plans the rules filter
+// out cannot be provisioned or updated to either, as requests are validated
+// against the filtered catalog.
+type CatalogRules struct {
+	// Allow keeps only the plans matching one of its matches, when set.
+	Allow []CatalogMatch `json:"allow,omitempty"`
+	// Deny drops the plans matching one of its matches.
+	Deny []CatalogMatch `json:"deny,omitempty"`
+	// Rewrite changes the services and plans left, in order.
+	Rewrite []CatalogRewrite `json:"rewrite,omitempty"`
+}
+
+// CatalogMatch matches plans. Service and Plan match names or IDs, with
+// path.Match patterns such as "mysql-*". Empty fields match anything.
+type CatalogMatch struct {
+	Service string `json:"service,omitempty"`
+	Plan    string `json:"plan,omitempty"`
+	// Tag is a tag the service has.
+	Tag string `json:"tag,omitempty"`
+	// Metadata and PlanMetadata hold values the service and plan metadata
+	// have, compared as strings.
+	Metadata     map[string]string `json:"metadata,omitempty"`
+	PlanMetadata map[string]string `json:"planMetadata,omitempty"`
+}
+
+// CatalogRewrite changes what Match matches: the plans when Match.Plan is
+// set, and the services otherwise. Metadata is merged into the metadata, and
+// DisplayName sets its displayName.
+type CatalogRewrite struct {
+	Match       CatalogMatch           `json:"match"`
+	Name        *string                `json:"name,omitempty"`
+	Description *string                `json:"description,omitempty"`
+	DisplayName *string                `json:"displayName,omitempty"`
+	Metadata    map[string]interface{} `json:"metadata,omitempty"`
+}
+
+// LoadCatalogRules reads catalog rules from a YAML or JSON file.
+func LoadCatalogRules(path string) (*CatalogRules, error) {
+	rules := &CatalogRules{}
+	if err := config.Load(path, rules); err != nil {
+		return nil, err
+	}
+	for _, m := range append(append([]CatalogMatch{}, rules.Allow...), rules.Deny...) {
+		if err := m.validate(); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	for _, r := range rules.Rewrite {
+		if err := r.Match.validate(); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	return rules, nil
+}
+
+func (m CatalogMatch) validate() error {
+	for _, pattern := range []string{m.Service, m.Plan} {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("bad pattern %q: %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+func matchPattern(pattern, name, id string) bool {
+	if pattern == "" {
+		return true
+	}
+	byName, _ := path.Match(pattern, name)
+	byID, _ := path.Match(pattern, id)
+	return byName || byID
+}
+
+func matchMetadata(want map[string]string, metadata map[string]interface{}) bool {
+	for key, value := range want {
+		got, ok := metadata[key]
+		if !ok || fmt.Sprint(got) != value {
+			return false
+		}
+	}
+	return true
+}
+
+func (m CatalogMatch) matchesService(service *osb.Service) bool {
+	if !matchPattern(m.Service, service.Name, service.ID) || !matchMetadata(m.Metadata, service.Metadata) {
+		return false
+	}
+	if m.Tag == "" {
+		return true
+	}
+	for _, tag := range service.Tags {
+		if tag == m.Tag {
+			return true
+		}
+	}
+	return false
+}
+
+func (m CatalogMatch) matches(service *osb.Service, plan *osb.Plan) bool {
+	return m.matchesService(service) &&
+		matchPattern(m.Plan, plan.Name, plan.ID) &&
+		matchMetadata(m.PlanMetadata, plan.Metadata)
+}
+
+// visible tells whether the rules let the platform see plan.
+func (r *CatalogRules) visible(service *osb.Service, plan *osb.Plan) bool {
+	allowed := len(r.Allow) == 0
+	for _, m := range r.Allow {
+		if m.matches(service, plan) {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return false
+	}
+	for _, m := range r.Deny {
+		if m.matches(service, plan) {
+			return false
+		}
+	}
+	return true
+}
+
+// apply filters and rewrites catalog in place. Services left without plans
+// are dropped.
+func (r *CatalogRules) apply(catalog *broker.CatalogResponse) {
+	if r == nil {
+		return
+	}
+
+	services := catalog.Services[:0]
+	for _, service := range catalog.Services {
+		plans := service.Plans[:0]
+		for i := range service.Plans {
+			if r.visible(&service, &service.Plans[i]) {
+				plans = append(plans, service.Plans[i])
+			}
+		}
+		service.Plans = plans
+		if len(plans) != 0 {
+			services = append(services, service)
+		}
+	}
+	catalog.Services = services
+
+	for _, rewrite := range r.Rewrite {
+		for i := range catalog.Services {
+			service := &catalog.Services[i]
+			if rewrite.Match.Plan == "" && rewrite.Match.PlanMetadata == nil {
+				if rewrite.Match.matchesService(service) {
+					setString(&service.Name, rewrite.Name)
+					setString(&service.Description, rewrite.Description)
+					service.Metadata = mergeMetadata(service.Metadata, rewrite.Metadata, rewrite.DisplayName)
+				}
+				continue
+			}
+			for j := range service.Plans {
+				plan := &service.Plans[j]
+				if rewrite.Match.matches(service, plan) {
+					setString(&plan.Name, rewrite.Name)
+					setString(&plan.Description, rewrite.Description)
+					plan.Metadata = mergeMetadata(plan.Metadata, rewrite.Metadata, rewrite.DisplayName)
+				}
+			}
+		}
+	}
+}
+
+func catalogUnavailable() error {
+	description := "the catalog is unavailable, so the plan cannot be checked against the catalog rules"
+	return osb.HTTPStatusCodeError{
+		StatusCode:  http.StatusServiceUnavailable,
+		Description: &description,
+	}
+}
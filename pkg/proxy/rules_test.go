@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/n3wscott/k8s-broker-proxy/pkg/inventory"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+)
+
+func TestCatalogRules(t *testing.T) {
+	rules := loadRules(t, `{
+		"deny": [{"plan": "legacy"}],
+		"rewrite": [
+			{"match": {"service": "service"}, "name": "cloud-service", "displayName": "Cloud Service"},
+			{"match": {"plan": "plan"}, "description": "The only plan"}
+		]
+	}`)
+	catalog := overlayTestCatalog()
+	rules.apply(catalog)
+	service := catalog.Services[0]
+	if service.Name != "cloud-service" || service.Metadata["displayName"] != "Cloud Service" {
+		t.Errorf("expected the service to be rewritten, got %+v", service)
+	}
+	if len(service.Plans) != 1 || service.Plans[0].ID != "plan" {
+		t.Fatalf("expected only plan to be left, got %+v", service.Plans)
+	}
+	if service.Plans[0].Description != "The only plan" {
+		t.Errorf("expected the plan to be rewritten, got %+v", service.Plans[0])
+	}
+}
+
+func TestCatalogRulesAllow(t *testing.T) {
+	rules := loadRules(t, `{"allow": [{"service": "other"}]}`)
+	catalog := overlayTestCatalog()
+	rules.apply(catalog)
+	if len(catalog.Services) != 0 {
+		t.Errorf("expected services without allowed plans to be dropped, got %+v", catalog.Services)
+	}
+}
+
+func TestHiddenPlanCannotBeProvisioned(t *testing.T) {
+	b := newTestBusinessLogic(t, slowBroker{})
+	b.rules = loadRules(t, `{"deny": [{"plan": "legacy"}]}`)
+	cacheTestCatalog(t, b, overlayTestCatalog())
+
+	_, err := b.Provision(&osb.ProvisionRequest{InstanceID: "instance", ServiceID: "service", PlanID: "legacy"}, nil)
+	if httpErr, ok := osb.IsHTTPError(err); !ok || httpErr.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected a 400 for a hidden plan, got %v", err)
+	}
+	if err := b.inventory.PutInstance(&inventory.Instance{ID: "instance", ServiceID: "service", PlanID: "legacy"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.validateBind(&osb.BindRequest{InstanceID: "instance", BindingID: "binding", ServiceID: "service", PlanID: "legacy"}); err != nil {
+		t.Errorf("expected instances of hidden plans to stay bindable, got %v", err)
+	}
+}
@@ -0,0 +1,274 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+	"github.com/n3wscott/k8s-broker-proxy/pkg/binding"
+	"github.com/n3wscott/k8s-broker-proxy/pkg/cli"
+	"github.com/n3wscott/k8s-broker-proxy/pkg/config"
+	"github.com/pmorie/osb-broker-lib/pkg/metrics"
+	"github.com/pmorie/osb-broker-lib/pkg/rest"
+	"github.com/pmorie/osb-broker-lib/pkg/server"
+	prom "github.com/prometheus/client_golang/prometheus"
+)
+
+// A proxy can serve several tenants, each under /tenants/{tenant}/v2 with its
+// own brokers. A tenant gets a proxy of its own: its own tunnels and their
+// credentials, catalog, inventory, operations and metrics, so nothing one
+// tenant sends or stores reaches another. The tenant's metrics, its proxy's
+// and the OSB metrics of the broker library, are served at
+// /tenants/{tenant}/metrics to its own platforms only; the /metrics of the
+// proxy has none of them.
+
+// tenantName is what a tenant may be called, as it is part of the routes.
+var tenantName = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+
+// TenantsConfig lists the tenants of the proxy.
+type TenantsConfig struct {
+	Tenants []TenantConfig `json:"tenants"`
+}
+
+// TenantConfig sets up a tenant. Its broker is reached the way the command
+// line flags of the same names say, and Tunnels lists its tunnels the way
+// --tunnels does. The rest of the proxy's settings are shared, except for the
+// files holding tenant data, which the tenant has to set for itself.
+type TenantConfig struct {
+	Name string `json:"name"`
+
+	Binding      string `json:"binding,omitempty"`
+	ProjectID    string `json:"projectId,omitempty"`
+	Topic        string `json:"topic,omitempty"`
+	Subscription string `json:"subscription,omitempty"`
+	Credentials  string `json:"credentials,omitempty"`
+	Tunnels      string `json:"tunnels,omitempty"`
+
+	CatalogPath   string `json:"catalogPath,omitempty"`
+	CatalogRules  string `json:"catalogRules,omitempty"`
+	CatalogCache  string `json:"catalogCache,omitempty"`
+	InventoryPath string `json:"inventoryPath,omitempty"`
+	InventoryKey  string `json:"inventoryKey,omitempty"`
+
+	// Auth is the tenant's platform authentication, and ClientAuthz its
+	// client certificate authorization, instead of the proxy's.
+	Auth        string `json:"auth,omitempty"`
+	ClientAuthz string `json:"clientAuthz,omitempty"`
+}
+
+// LoadTenants reads the tenants from a YAML or JSON file.
+func LoadTenants(path string) ([]TenantConfig, error) {
+	c := &TenantsConfig{}
+	if err := config.Load(path, c); err != nil {
+		return nil, err
+	}
+	names := make(map[string]bool)
+	for _, t := range c.Tenants {
+		if !tenantName.MatchString(t.Name) {
+			return nil, fmt.Errorf("%s: bad tenant name %q", path, t.Name)
+		}
+		if names[t.Name] {
+			return nil, fmt.Errorf("%s: tenant %s is listed twice", path, t.Name)
+		}
+		names[t.Name] = true
+	}
+	return c.Tenants, nil
+}
+
+// checkTenantIsolation makes sure no two tenants, or a tenant and the proxy
+// itself, share a file with their data, or a Pub/Sub topic or subscription
+// their requests and replies go through.
+func checkTenantIsolation(o cli.Options, tenants []TenantConfig) error {
+	owners := make(map[string]string)
+	claim := func(owner, path string) error {
+		if path == "" {
+			return nil
+		}
+		if other, ok := owners[path]; ok {
+			return fmt.Errorf("%s and %s both keep their data in %s", other, owner, path)
+		}
+		owners[path] = owner
+		return nil
+	}
+
+	if err := claim("the proxy", o.CatalogCache); err != nil {
+		return err
+	}
+	if err := claim("the proxy", o.InventoryPath); err != nil {
+		return err
+	}
+	for _, t := range tenants {
+		owner := "tenant " + t.Name
+		if o.Inventory == "bolt" && t.InventoryPath == "" {
+			return fmt.Errorf("%s needs an inventoryPath of its own", owner)
+		}
+		if err := claim(owner, t.CatalogCache); err != nil {
+			return err
+		}
+		if err := claim(owner, t.InventoryPath); err != nil {
+			return err
+		}
+	}
+
+	// Tunnels that do not load are left for opening them to report.
+	resources := make(map[string]string)
+	if configs, err := tunnelConfigs(o); err == nil {
+		if err := claimPubSub(resources, "the proxy", configs); err != nil {
+			return err
+		}
+	}
+	for _, t := range tenants {
+		configs, err := t.tunnelConfigs()
+		if err != nil {
+			continue
+		}
+		if err := claimPubSub(resources, "tenant "+t.Name, configs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// claimPubSub records the topics and subscriptions of the tunnels configs
+// set up as owner's in resources, and fails if another owner has them.
+func claimPubSub(resources map[string]string, owner string, configs []TunnelConfig) error {
+	for _, c := range configs {
+		projectID, topic, subscription := c.ProjectID, c.Topic, c.Subscription
+		if c.Binding != "" {
+			var err error
+			if projectID, topic, subscription, err = binding.PubSubBindingIDs(c.Binding); err != nil {
+				continue
+			}
+		}
+		var names []string
+		if topic != "" {
+			names = append(names, fmt.Sprintf("projects/%s/topics/%s", projectID, topic))
+		}
+		if subscription != "" {
+			names = append(names, fmt.Sprintf("projects/%s/subscriptions/%s", projectID, subscription))
+		}
+		for _, name := range names {
+			if other, ok := resources[name]; ok && other != owner {
+				return fmt.Errorf("%s and %s both use %s", other, owner, name)
+			}
+			resources[name] = owner
+		}
+	}
+	return nil
+}
+
+// tenantOptions are the proxy's options for tenant t.
+func tenantOptions(o cli.Options, t TenantConfig) cli.Options {
+	o.Binding, o.ProjectID, o.Topic, o.Subscription = t.Binding, t.ProjectID, t.Topic, t.Subscription
+	o.Tunnels = t.Tunnels
+	o.Tenants = ""
+	o.CatalogPath = t.CatalogPath
+	o.CatalogRules = t.CatalogRules
+	o.CatalogCache = t.CatalogCache
+	o.InventoryPath = t.InventoryPath
+	o.InventoryKey = t.InventoryKey
+	if t.Auth != "" {
+		o.Auth = t.Auth
+	}
+	if t.ClientAuthz != "" {
+		o.ClientAuthz = t.ClientAuthz
+	}
+	return o
+}
+
+// tunnelConfigs returns the tunnels of the tenant. Unlike the proxy's own
+// default tunnel, the tenant's never falls back on the environment.
+func (t TenantConfig) tunnelConfigs() ([]TunnelConfig, error) {
+	if t.Tunnels != "" {
+		return LoadTunnels(t.Tunnels)
+	}
+	c := TunnelConfig{
+		Name:         defaultTunnel,
+		Binding:      t.Binding,
+		ProjectID:    t.ProjectID,
+		Topic:        t.Topic,
+		Subscription: t.Subscription,
+		Credentials:  t.Credentials,
+	}
+	if !c.configured() {
+		return nil, fmt.Errorf("tenant %s has no broker", t.Name)
+	}
+	return []TunnelConfig{c}, nil
+}
+
+// configured tells whether c says where its tunnel goes.
+func (c TunnelConfig) configured() bool {
+	return c.Binding != "" || c.ProjectID != "" || c.Topic != "" || c.Subscription != ""
+}
+
+// newTenant returns the proxy of tenant t.
+func newTenant(o cli.Options, t TenantConfig) (*BusinessLogic, error) {
+	configs, err := t.tunnelConfigs()
+	if err != nil {
+		return nil, err
+	}
+	b, err := newBusinessLogic(tenantOptions(o, t), t.Name, configs)
+	if err != nil {
+		return nil, fmt.Errorf("tenant %s: %v", t.Name, err)
+	}
+	if err := b.tenantAPI(); err != nil {
+		return nil, fmt.Errorf("tenant %s: %v", t.Name, err)
+	}
+	return b, nil
+}
+
+// tenantAPI sets up the broker library's OSB API for a tenant's proxy, and
+// the registry of the tenant's metrics.
+func (b *BusinessLogic) tenantAPI() error {
+	b.registry = prom.NewRegistry()
+	osbMetrics := metrics.New()
+	if err := b.registry.Register(osbMetrics); err != nil {
+		return err
+	}
+	if err := b.registry.Register(b.metrics); err != nil {
+		return err
+	}
+
+	api, err := rest.NewAPISurface(b, osbMetrics)
+	if err != nil {
+		return err
+	}
+	api.EnableCORS = true
+	b.api = api
+	return nil
+}
+
+// tenantRouting mounts every tenant under /tenants/{tenant}, served by a
+// router of its own as if it was the proxy at the root.
+func (b *BusinessLogic) tenantRouting(router *mux.Router) {
+	var names []string
+	for name := range b.tenants {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		prefix := "/tenants/" + name
+		router.PathPrefix(prefix + "/").Handler(http.StripPrefix(prefix, b.tenants[name].tenantRouter()))
+	}
+}
+
+// tenantRouter returns the routes of a tenant's proxy: the OSB routes and
+// metrics of the broker library, and the proxy's own. The metrics are only
+// served when the tenant's platforms have to prove who they are to read them.
+func (b *BusinessLogic) tenantRouter() *mux.Router {
+	router := mux.NewRouter()
+	if b.api != nil {
+		registry := b.registry
+		if b.auth == nil && b.authz == nil {
+			glog.Warningf("tenant %s: not serving metrics, they need auth or clientAuthz", b.tenant)
+			registry = prom.NewRegistry()
+		}
+		router = server.New(b.api, registry).Router
+	}
+	b.AdditionalRouting(router)
+	return router
+}
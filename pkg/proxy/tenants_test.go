@@ -0,0 +1,161 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/n3wscott/k8s-broker-proxy/pkg/apiversion"
+	"github.com/n3wscott/k8s-broker-proxy/pkg/cli"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+)
+
+func TestLoadTenants(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tenants.yaml")
+	for content, valid := range map[string]bool{
+		`{"tenants": [{"name": "acme"}, {"name": "globex-2"}]}`: true,
+		`{"tenants": [{"name": "acme"}, {"name": "acme"}]}`:     false,
+		`{"tenants": [{"name": "../acme"}]}`:                    false,
+	} {
+		if _, err := LoadTenants(writeFile(t, path, content)); (err == nil) != valid {
+			t.Errorf("%s: expected valid %v, got %v", content, valid, err)
+		}
+	}
+}
+
+func TestTenantsKeepTheirDataApart(t *testing.T) {
+	o := cli.Options{Inventory: "bolt", InventoryPath: "proxy.db"}
+	if err := checkTenantIsolation(o, []TenantConfig{{Name: "acme"}}); err == nil {
+		t.Error("expected a tenant without an inventory of its own to be refused")
+	}
+	tenants := []TenantConfig{{Name: "acme", InventoryPath: "acme.db"}, {Name: "globex", InventoryPath: "acme.db"}}
+	if err := checkTenantIsolation(o, tenants); err == nil {
+		t.Error("expected tenants sharing an inventory to be refused")
+	}
+	tenants[1].InventoryPath = "globex.db"
+	if err := checkTenantIsolation(o, tenants); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTenantsShareNoPubSub(t *testing.T) {
+	dir := t.TempDir()
+	encode := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+	bindingFile := func(name, topic, subscription string) string {
+		return writeFile(t, filepath.Join(dir, name), `{"data": {"projectId": "`+encode("project")+`", "topicId": "`+encode(topic)+`", "subscriptionId": "`+encode(subscription)+`"}}`)
+	}
+
+	o := cli.Options{ProjectID: "project", Topic: "proxy", Subscription: "proxy-replies"}
+	cases := []struct {
+		name    string
+		tenants []TenantConfig
+		valid   bool
+	}{
+		{
+			name: "apart",
+			tenants: []TenantConfig{
+				{Name: "acme", ProjectID: "project", Topic: "acme", Subscription: "acme-replies"},
+				{Name: "globex", Binding: bindingFile("globex.json", "globex", "globex-replies")},
+			},
+			valid: true,
+		},
+		{
+			name: "same topic",
+			tenants: []TenantConfig{
+				{Name: "acme", ProjectID: "project", Topic: "shared", Subscription: "acme-replies"},
+				{Name: "globex", ProjectID: "project", Topic: "shared", Subscription: "globex-replies"},
+			},
+		},
+		{
+			name: "the proxy's subscription",
+			tenants: []TenantConfig{
+				{Name: "acme", ProjectID: "project", Topic: "acme", Subscription: "proxy-replies"},
+			},
+		},
+		{
+			name: "same subscription through a binding",
+			tenants: []TenantConfig{
+				{Name: "acme", ProjectID: "project", Topic: "acme", Subscription: "shared-replies"},
+				{Name: "globex", Binding: bindingFile("shared.json", "globex", "shared-replies")},
+			},
+		},
+		{
+			name: "same topic in a tunnels file",
+			tenants: []TenantConfig{
+				{Name: "acme", ProjectID: "project", Topic: "acme", Subscription: "acme-replies"},
+				{Name: "globex", Tunnels: writeFile(t, filepath.Join(dir, "tunnels.json"), `{"tunnels": [{"name": "eu", "projectId": "project", "topic": "acme", "subscription": "globex-replies"}]}`)},
+			},
+		},
+	}
+	for _, tc := range cases {
+		if err := checkTenantIsolation(o, tc.tenants); (err == nil) != tc.valid {
+			t.Errorf("%s: expected valid %v, got %v", tc.name, tc.valid, err)
+		}
+	}
+}
+
+func TestTenantsAreIsolated(t *testing.T) {
+	tenant := func(name string, broker slowBroker) *BusinessLogic {
+		b := newTestBusinessLogic(t, broker)
+		b.tenant = name
+		b.apiVersions = apiversion.Range{Min: apiversion.Version{Major: 2, Minor: 11}, Max: apiversion.Version{Major: 2, Minor: 14}}
+		if err := b.tenantAPI(); err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	acme := tenant("acme", slowBroker{delay: 100 * time.Millisecond})
+	acme.asyncBudget = 10 * time.Millisecond
+	b := &BusinessLogic{tenants: map[string]*BusinessLogic{"acme": acme, "globex": tenant("globex", slowBroker{})}}
+	router := mux.NewRouter()
+	b.AdditionalRouting(router)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	call := func(method, path, body string) (int, map[string]interface{}) {
+		r, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set(osb.APIVersionHeader, "2.14")
+		resp, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		decoded := make(map[string]interface{})
+		json.NewDecoder(resp.Body).Decode(&decoded)
+		return resp.StatusCode, decoded
+	}
+
+	code, provisioned := call("PUT", "/tenants/acme/v2/service_instances/instance?accepts_incomplete=true", `{"service_id": "service", "plan_id": "plan"}`)
+	if code != http.StatusAccepted {
+		t.Fatalf("expected acme to provision asynchronously, got %d %v", code, provisioned)
+	}
+	operation, _ := provisioned["operation"].(string)
+	if operation == "" {
+		t.Fatalf("expected an operation, got %v", provisioned)
+	}
+
+	if code, _ := call("GET", "/tenants/acme/v2/service_instances/instance/last_operation?operation="+operation, ""); code != http.StatusOK {
+		t.Errorf("expected acme to know its operation, got %d", code)
+	}
+	if code, _ := call("GET", "/tenants/globex/v2/service_instances/instance/last_operation?operation="+operation, ""); code == http.StatusOK {
+		t.Error("expected the operation to be unknown to another tenant")
+	}
+	if _, err := b.tenants["globex"].inventory.GetInstance("instance"); err == nil {
+		t.Error("expected the instance to be unknown to another tenant")
+	}
+	if code, _ := call("GET", "/tenants/initech/v2/catalog", ""); code != http.StatusNotFound {
+		t.Errorf("expected an unknown tenant to be not found, got %d", code)
+	}
+	if code, _ := call("GET", "/tenants/globex/v2/catalog", ""); code != http.StatusOK {
+		t.Errorf("expected globex to serve its catalog, got %d", code)
+	}
+}
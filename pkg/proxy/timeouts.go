@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"time"
+
+	"github.com/n3wscott/k8s-broker-proxy/pkg/config"
+)
+
+// TimeoutPolicy decides how long the proxy waits for the remote side to
+// answer a request. Plan rules win over service rules, which win over the
+// top level; within a rule, an operation specific timeout wins over the
+// rule's default.
+type TimeoutPolicy struct {
+	TimeoutRule
+
+	// Services holds rules by service ID.
+	Services map[string]TimeoutRule `json:"services,omitempty"`
+	// Plans holds rules by plan ID.
+	Plans map[string]TimeoutRule `json:"plans,omitempty"`
+}
+
+// TimeoutRule sets timeouts for one scope of the policy.
+type TimeoutRule struct {
+	Default    config.Duration            `json:"default,omitempty"`
+	Operations map[string]config.Duration `json:"operations,omitempty"`
+}
+
+// LoadTimeoutPolicy reads a policy from a YAML or JSON file. Without a file,
+// or if the file sets no default, fallback is the default timeout.
+func LoadTimeoutPolicy(path string, fallback time.Duration) (*TimeoutPolicy, error) {
+	policy := &TimeoutPolicy{}
+	if path != "" {
+		if err := config.Load(path, policy); err != nil {
+			return nil, err
+		}
+	}
+	if policy.Default.Duration == 0 {
+		policy.Default.Duration = fallback
+	}
+	return policy, nil
+}
+
+// Timeout returns the wait for operation on the given service and plan. Any
+// of serviceID and planID may be empty when the request does not carry them.
+func (p *TimeoutPolicy) Timeout(operation, serviceID, planID string) time.Duration {
+	if rule, ok := p.Plans[planID]; ok && planID != "" {
+		if d := rule.timeout(operation); d != 0 {
+			return d
+		}
+	}
+	if rule, ok := p.Services[serviceID]; ok && serviceID != "" {
+		if d := rule.timeout(operation); d != 0 {
+			return d
+		}
+	}
+	return p.TimeoutRule.timeout(operation)
+}
+
+func (r TimeoutRule) timeout(operation string) time.Duration {
+	if d, ok := r.Operations[operation]; ok && d.Duration != 0 {
+		return d.Duration
+	}
+	return r.Default.Duration
+}
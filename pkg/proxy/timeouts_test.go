@@ -0,0 +1,41 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/n3wscott/k8s-broker-proxy/pkg/config"
+)
+
+func TestTimeoutPolicy(t *testing.T) {
+	d := func(d time.Duration) config.Duration { return config.Duration{Duration: d} }
+	policy := &TimeoutPolicy{
+		TimeoutRule: TimeoutRule{
+			Default:    d(30 * time.Second),
+			Operations: map[string]config.Duration{"Provision": d(time.Minute)},
+		},
+		Services: map[string]TimeoutRule{
+			"slow-service": {Operations: map[string]config.Duration{"Provision": d(5 * time.Minute)}},
+		},
+		Plans: map[string]TimeoutRule{
+			"huge-plan": {Default: d(20 * time.Minute)},
+		},
+	}
+
+	cases := []struct {
+		operation, serviceID, planID string
+		want                         time.Duration
+	}{
+		{"GetCatalog", "", "", 30 * time.Second},
+		{"Provision", "fast-service", "small-plan", time.Minute},
+		{"Provision", "slow-service", "small-plan", 5 * time.Minute},
+		{"Bind", "slow-service", "small-plan", 30 * time.Second},
+		{"Provision", "slow-service", "huge-plan", 20 * time.Minute},
+		{"LastOperation", "slow-service", "huge-plan", 20 * time.Minute},
+	}
+	for _, tc := range cases {
+		if got := policy.Timeout(tc.operation, tc.serviceID, tc.planID); got != tc.want {
+			t.Errorf("Timeout(%q, %q, %q) = %s, want %s", tc.operation, tc.serviceID, tc.planID, got, tc.want)
+		}
+	}
+}
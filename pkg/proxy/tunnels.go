@@ -0,0 +1,391 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+	"github.com/n3wscott/k8s-broker-proxy/messages"
+	"github.com/n3wscott/k8s-broker-proxy/pkg/binding"
+	"github.com/n3wscott/k8s-broker-proxy/pkg/catalog"
+	"github.com/n3wscott/k8s-broker-proxy/pkg/cli"
+	"github.com/n3wscott/k8s-broker-proxy/pkg/config"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	"github.com/pmorie/osb-broker-lib/pkg/broker"
+	"google.golang.org/api/option"
+)
+
+// A proxy can front several local sides, each reached through its own tunnel:
+// a Pub/Sub topic and subscription. The catalogs of all tunnels are merged,
+// and requests are routed to the tunnel whose catalog has their service.
+
+// defaultTunnel names the tunnel set up from the command line flags.
+const defaultTunnel = "default"
+
+// TunnelsConfig lists the tunnels of the proxy, in order of precedence: a
+// service or plan ID already served by one tunnel is dropped from the
+// catalogs of the tunnels after it.
+type TunnelsConfig struct {
+	Tunnels []TunnelConfig `json:"tunnels"`
+}
+
+// TunnelConfig sets up one tunnel, from a binding file or from the Pub/Sub
+// settings. The tunnel uses the credentials of its binding, or those in the
+// Credentials key file, and the application default credentials otherwise.
+// Timeout and TimeoutConfig replace the proxy's timeout policy for the
+// tunnel, and MaxWait its --maxWait.
+type TunnelConfig struct {
+	Name string `json:"name"`
+
+	Binding      string `json:"binding,omitempty"`
+	ProjectID    string `json:"projectId,omitempty"`
+	Topic        string `json:"topic,omitempty"`
+	Subscription string `json:"subscription,omitempty"`
+	Credentials  string `json:"credentials,omitempty"`
+
+	Timeout       config.Duration `json:"timeout,omitempty"`
+	TimeoutConfig string          `json:"timeoutConfig,omitempty"`
+	MaxWait       config.Duration `json:"maxWait,omitempty"`
+
+	// IDs maps the service and plan IDs of the tunnel's broker, nil to
+	// leave them as they are.
+	IDs *IDMapping `json:"ids,omitempty"`
+}
+
+// LoadTunnels reads the tunnels from a YAML or JSON file.
+func LoadTunnels(path string) ([]TunnelConfig, error) {
+	c := &TunnelsConfig{}
+	if err := config.Load(path, c); err != nil {
+		return nil, err
+	}
+	if len(c.Tunnels) == 0 {
+		return nil, fmt.Errorf("%s: no tunnels", path)
+	}
+	names := make(map[string]bool)
+	for _, t := range c.Tunnels {
+		if t.Name == "" {
+			return nil, fmt.Errorf("%s: a tunnel has no name", path)
+		}
+		if names[t.Name] {
+			return nil, fmt.Errorf("%s: tunnel %s is listed twice", path, t.Name)
+		}
+		if t.IDs != nil && t.IDs.Namespace == "" {
+			return nil, fmt.Errorf("%s: tunnel %s maps IDs without a namespace", path, t.Name)
+		}
+		names[t.Name] = true
+	}
+	return c.Tunnels, nil
+}
+
+// defaultTunnelConfig is the single tunnel set up by the command line flags,
+// or the environment.
+func defaultTunnelConfig(o cli.Options) TunnelConfig {
+	c := TunnelConfig{
+		Name:         defaultTunnel,
+		Binding:      o.Binding,
+		ProjectID:    o.ProjectID,
+		Topic:        o.Topic,
+		Subscription: o.Subscription,
+	}
+	if c.Binding == "" {
+		if c.ProjectID == "" {
+			c.ProjectID = os.Getenv(binding.GCPProjectEnvName)
+		}
+		if c.Topic == "" {
+			c.Topic = os.Getenv(binding.PubSubTopicEnvName)
+		}
+		if c.Subscription == "" {
+			c.Subscription = os.Getenv(binding.PubSubSubscriptionEnvName)
+		}
+	}
+	return c
+}
+
+// tunnel is the way to one local side.
+type tunnel struct {
+	name   string
+	reg    *messages.Registry
+	client *messages.Client
+	// timeouts replaces the proxy's policy for the tunnel, nil for none.
+	timeouts *TimeoutPolicy
+	// ids maps the IDs of the tunnel's broker, nil for none.
+	ids *idMapper
+
+	health tunnelHealth
+}
+
+func newTunnel(name string, reg *messages.Registry, timeouts *TimeoutPolicy) *tunnel {
+	return &tunnel{
+		name:     name,
+		reg:      reg,
+		client:   messages.NewClient(reg),
+		timeouts: timeouts,
+	}
+}
+
+// openTunnel connects the tunnel c sets up.
+func openTunnel(c TunnelConfig, o cli.Options) (*tunnel, error) {
+	if c.Binding != "" {
+		projectID, topic, subscription, credentials, err := binding.PubSubBindingCredentials(c.Binding)
+		if err != nil {
+			return nil, err
+		}
+		c.ProjectID, c.Topic, c.Subscription, c.Credentials = projectID, topic, subscription, credentials
+	}
+
+	var opts []option.ClientOption
+	if c.Credentials != "" {
+		opts = append(opts, option.WithCredentialsFile(c.Credentials))
+	}
+	reg, err := messages.NewRegistry(c.ProjectID, c.Topic, c.Subscription, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("tunnel %s: %v", c.Name, err)
+	}
+	if c.MaxWait.Duration > 0 {
+		reg.WaitForMaxTimeout = c.MaxWait.Duration
+	} else if o.MaxWait > 0 {
+		reg.WaitForMaxTimeout = o.MaxWait
+	}
+
+	var timeouts *TimeoutPolicy
+	if c.Timeout.Duration > 0 || c.TimeoutConfig != "" {
+		fallback := o.Timeout
+		if c.Timeout.Duration > 0 {
+			fallback = c.Timeout.Duration
+		}
+		if timeouts, err = LoadTimeoutPolicy(c.TimeoutConfig, fallback); err != nil {
+			return nil, fmt.Errorf("tunnel %s: %v", c.Name, err)
+		}
+	}
+	t := newTunnel(c.Name, reg, timeouts)
+	t.ids = newIDMapper(c.IDs)
+	return t, nil
+}
+
+// tunnelConfigs returns the tunnels listed in o.Tunnels, or the default one.
+func tunnelConfigs(o cli.Options) ([]TunnelConfig, error) {
+	if o.Tunnels != "" {
+		return LoadTunnels(o.Tunnels)
+	}
+	return []TunnelConfig{defaultTunnelConfig(o)}, nil
+}
+
+// openTunnels connects the tunnels configs set up.
+func openTunnels(configs []TunnelConfig, o cli.Options) ([]*tunnel, error) {
+	var tunnels []*tunnel
+	for _, c := range configs {
+		t, err := openTunnel(c, o)
+		if err != nil {
+			for _, open := range tunnels {
+				open.reg.Stop()
+			}
+			return nil, err
+		}
+		tunnels = append(tunnels, t)
+	}
+	return tunnels, nil
+}
+
+// tunnelHealth tracks whether the local side behind a tunnel answers. Any
+// reply, an error from the broker included, counts as an answer.
+type tunnelHealth struct {
+	mutex     sync.Mutex
+	up        bool
+	lastReply time.Time
+	lastError string
+	// failures counts the requests in a row that got no reply.
+	failures int
+	// backends is the health of the brokers behind the tunnel, as its local
+	// side last reported it.
+	backends        []messages.BackendHealth
+	backendsChecked time.Time
+}
+
+// healthTimeout is how long the proxy waits for a local side to report the
+// health of its brokers. Local sides that predate health reports do not
+// answer at all.
+const healthTimeout = 5 * time.Second
+
+// TunnelStatus is the health of a tunnel, as the admin API reports it.
+type TunnelStatus struct {
+	Name      string    `json:"name"`
+	Up        bool      `json:"up"`
+	LastReply time.Time `json:"lastReply,omitempty"`
+	LastError string    `json:"lastError,omitempty"`
+	Failures  int       `json:"failures"`
+	Services  []string  `json:"services,omitempty"`
+	// Backends is the health of the brokers behind the tunnel, as its local
+	// side last reported it when BackendsChecked.
+	Backends        []messages.BackendHealth `json:"backends,omitempty"`
+	BackendsChecked time.Time                `json:"backendsChecked,omitempty"`
+}
+
+// observe records the outcome of a call through the tunnel.
+func (t *tunnel) observe(m *proxyMetrics, err error) {
+	t.health.mutex.Lock()
+	defer t.health.mutex.Unlock()
+
+	if err == messages.ErrTimeout {
+		t.health.failures++
+		t.health.lastError = err.Error()
+		if t.health.up {
+			glog.Warningf("tunnel %s: no reply, marking it down", t.name)
+		}
+		t.health.up = false
+	} else {
+		if !t.health.up {
+			glog.Infof("tunnel %s: replying, marking it up", t.name)
+		}
+		t.health.up = true
+		t.health.failures = 0
+		t.health.lastReply = time.Now()
+	}
+	up := 0.0
+	if t.health.up {
+		up = 1
+	}
+	m.tunnelUp.WithLabelValues(t.name).Set(up)
+}
+
+func (t *tunnel) status() TunnelStatus {
+	t.health.mutex.Lock()
+	defer t.health.mutex.Unlock()
+	return TunnelStatus{
+		Name:      t.name,
+		Up:        t.health.up,
+		LastReply: t.health.lastReply,
+		LastError: t.health.lastError,
+		Failures:  t.health.failures,
+
+		Backends:        t.health.backends,
+		BackendsChecked: t.health.backendsChecked,
+	}
+}
+
+// checkBackends asks the local side behind t for the health of its brokers.
+// The call is not observed: a local side that predates health reports does
+// not answer it, but is not down for that.
+func (t *tunnel) checkBackends() {
+	health, err := messages.Call(t.client, messages.Health, &messages.HealthRequest{}, messages.WithTimeout(healthTimeout))
+	if err != nil {
+		glog.V(1).Infof("tunnel %s: no backend health: %v", t.name, err)
+		return
+	}
+	t.health.mutex.Lock()
+	defer t.health.mutex.Unlock()
+	t.health.backends = health.Backends
+	t.health.backendsChecked = time.Now()
+}
+
+// startHealthChecks asks the local sides for the health of their brokers
+// every interval, for the admin API to report.
+func (b *BusinessLogic) startHealthChecks(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		for {
+			for _, t := range b.tunnels {
+				go t.checkBackends()
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// timeout returns the wait for operation through t.
+func (b *BusinessLogic) timeout(t *tunnel, operation, serviceID, planID string) time.Duration {
+	if t.timeouts != nil {
+		return t.timeouts.Timeout(operation, serviceID, planID)
+	}
+	return b.timeouts.Timeout(operation, serviceID, planID)
+}
+
+func (b *BusinessLogic) tunnelNamed(name string) *tunnel {
+	for _, t := range b.tunnels {
+		if t.name == name {
+			return t
+		}
+	}
+	return nil
+}
+
+// tunnelFor returns the tunnel serving serviceID. With a single tunnel, that
+// is the one; otherwise the catalog tells, and is fetched if the proxy has
+// none yet.
+func (b *BusinessLogic) tunnelFor(serviceID string) (*tunnel, error) {
+	if len(b.tunnels) == 0 {
+		return nil, noTunnels()
+	}
+	if len(b.tunnels) == 1 {
+		return b.tunnels[0], nil
+	}
+	name, ok := b.catalogs.route(serviceID)
+	if !ok && !b.catalogs.loaded() {
+		if _, err := b.refreshCatalog(nil); err != nil {
+			return nil, err
+		}
+		name, ok = b.catalogs.route(serviceID)
+	}
+	if t := b.tunnelNamed(name); ok && t != nil {
+		return t, nil
+	}
+	if serviceID == "" {
+		return nil, badRequest("the service of the request is unknown, so is the broker to send it to")
+	}
+	return nil, badRequest("no broker serves service %s", serviceID)
+}
+
+// noTunnels is the error of a proxy with tenants but no broker of its own.
+func noTunnels() error {
+	description := "no broker is served here, only under /tenants"
+	return osb.HTTPStatusCodeError{
+		StatusCode:  http.StatusNotFound,
+		Description: &description,
+	}
+}
+
+// mergeCatalogs merges the catalogs of the tunnels, in the order of
+// b.tunnels, and returns which tunnel serves each service.
+func (b *BusinessLogic) mergeCatalogs(catalogs map[string]*broker.CatalogResponse) (*broker.CatalogResponse, map[string]string) {
+	var sources []catalog.Source
+	for _, t := range b.tunnels {
+		if c, ok := catalogs[t.name]; ok && c != nil {
+			sources = append(sources, catalog.Source{Name: t.name, Catalog: &c.CatalogResponse})
+		}
+	}
+	merged, routes, conflicts := catalog.Merge(sources)
+	for _, c := range conflicts {
+		glog.Errorf("tunnel %s: leaving service %s out of the catalog, %s %s is served by tunnel %s", c.Source, c.Service, c.Field, c.Value, c.Owner)
+		b.metrics.conflicts.WithLabelValues(c.Source).Inc()
+	}
+	return &broker.CatalogResponse{CatalogResponse: *merged}, routes
+}
+
+// tunnelRouting mounts the admin API reporting the health of the tunnels.
+func (b *BusinessLogic) tunnelRouting(router *mux.Router) {
+	router.HandleFunc("/admin/tunnels", b.adminListTunnelsHandler).Methods("GET")
+}
+
+// adminListTunnelsHandler reports the health of the tunnels, and of the
+// brokers behind them as last checked, without waiting on the local sides.
+func (b *BusinessLogic) adminListTunnelsHandler(w http.ResponseWriter, r *http.Request) {
+	routes := b.catalogs.routes()
+	tunnels := make([]TunnelStatus, 0, len(b.tunnels))
+	for _, t := range b.tunnels {
+		status := t.status()
+		for serviceID, name := range routes {
+			if name == t.name {
+				status.Services = append(status.Services, serviceID)
+			}
+		}
+		sort.Strings(status.Services)
+		tunnels = append(tunnels, status)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"tunnels": tunnels})
+}
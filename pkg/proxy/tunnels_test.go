@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+)
+
+func TestTunnelsRouteByService(t *testing.T) {
+	var first, second int
+	secondCatalog := serviceCatalog("other", "other-plan")
+	// Conflicts with the first tunnel's service.
+	secondCatalog.Services = append(secondCatalog.Services, serviceCatalog("service", "plan").Services[0])
+
+	b := newTestBusinessLogic(t, namedBroker{catalog: testCatalog(), provisioned: &first})
+	b.tunnels[0].name = "first"
+	b.tunnels = append(b.tunnels, newTestTunnel(t, "second", namedBroker{catalog: secondCatalog, provisioned: &second}))
+	forgetTestCatalog(b)
+
+	catalog, err := b.GetCatalog(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(catalog.Services) != 2 || catalog.Services[0].ID != "service" || catalog.Services[1].ID != "other" {
+		t.Fatalf("expected the conflicting service to be left out, got %+v", catalog.Services)
+	}
+
+	if _, err := b.Provision(&osb.ProvisionRequest{InstanceID: "instance", ServiceID: "other", PlanID: "other-plan"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if first != 0 || second != 1 {
+		t.Errorf("expected the second tunnel to provision, got %d and %d", first, second)
+	}
+
+	for _, status := range []TunnelStatus{b.tunnels[0].status(), b.tunnels[1].status()} {
+		if !status.Up {
+			t.Errorf("expected tunnel %s to be up", status.Name)
+		}
+	}
+}
+
+func TestTunnelTimeouts(t *testing.T) {
+	b := &BusinessLogic{timeouts: &TimeoutPolicy{}}
+	b.timeouts.Default.Duration = 30
+	own := &TimeoutPolicy{}
+	own.Default.Duration = 60
+
+	if d := b.timeout(&tunnel{}, "provision", "", ""); d != 30 {
+		t.Errorf("expected the proxy's timeout, got %s", d)
+	}
+	if d := b.timeout(&tunnel{timeouts: own}, "provision", "", ""); d != 60 {
+		t.Errorf("expected the tunnel's timeout, got %s", d)
+	}
+}
+
+func TestTunnelHealthIsCached(t *testing.T) {
+	b := newTestBusinessLogic(t, reportingBroker{})
+	b.tunnels = append(b.tunnels, newTestTunnel(t, "old", slowBroker{}))
+
+	list := func() []TunnelStatus {
+		w := httptest.NewRecorder()
+		b.adminListTunnelsHandler(w, httptest.NewRequest(http.MethodGet, "/admin/tunnels", nil))
+		var body struct {
+			Tunnels []TunnelStatus `json:"tunnels"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		return body.Tunnels
+	}
+
+	if tunnels := list(); len(tunnels) != 2 || tunnels[0].Backends != nil {
+		t.Fatalf("expected no backend health before a check, got %+v", tunnels)
+	}
+	for _, tunnel := range b.tunnels {
+		tunnel.checkBackends()
+	}
+	tunnels := list()
+	if len(tunnels[0].Backends) != 1 || !tunnels[0].Backends[0].Healthy || tunnels[0].BackendsChecked.IsZero() {
+		t.Errorf("expected the reported backend health, got %+v", tunnels[0])
+	}
+	if tunnels[1].Backends != nil || tunnels[1].Failures != 0 {
+		t.Errorf("expected a local side without health reports not to count as failing, got %+v", tunnels[1])
+	}
+}
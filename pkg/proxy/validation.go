@@ -0,0 +1,270 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/golang/glog"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	"github.com/pmorie/osb-broker-lib/pkg/broker"
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// Requests are validated against the OSB spec and the catalog before they
+// are sent through the tunnel, so the platform gets its 400 Bad Request
+// without waiting on the remote side.
+
+func badRequest(format string, args ...interface{}) error {
+	description := fmt.Sprintf(format, args...)
+	return osb.HTTPStatusCodeError{
+		StatusCode:  http.StatusBadRequest,
+		Description: &description,
+	}
+}
+
+// requiredID is an ID a request has to set, by its name in the OSB spec.
+type requiredID struct {
+	name  string
+	value string
+}
+
+// requireIDs checks that the IDs are set.
+func requireIDs(ids ...requiredID) error {
+	for _, id := range ids {
+		if id.value == "" {
+			return badRequest("%s is required", id.name)
+		}
+	}
+	return nil
+}
+
+// validationCatalog returns the catalog to validate requests with, fetching
+// it when the proxy has none yet. Without a catalog only the shape of
+// requests is validated.
+func (b *BusinessLogic) validationCatalog() *broker.CatalogResponse {
+	if catalog, _, _ := b.catalogs.get(); catalog != nil {
+		return catalog
+	}
+	catalog, err := b.refreshCatalog(nil)
+	if err != nil {
+		glog.Errorf("validating requests without a catalog: %v", err)
+		return nil
+	}
+	return catalog
+}
+
+func findService(catalog *broker.CatalogResponse, serviceID string) (*osb.Service, error) {
+	for i := range catalog.Services {
+		if catalog.Services[i].ID == serviceID {
+			return &catalog.Services[i], nil
+		}
+	}
+	return nil, badRequest("unknown service %s", serviceID)
+}
+
+func findPlan(service *osb.Service, planID string) (*osb.Plan, error) {
+	for i := range service.Plans {
+		if service.Plans[i].ID == planID {
+			return &service.Plans[i], nil
+		}
+	}
+	return nil, badRequest("plan %s does not belong to service %s", planID, service.ID)
+}
+
+// validateParameters validates parameters against the JSON schema of a plan,
+// if there is one.
+func validateParameters(what string, schema interface{}, parameters map[string]interface{}) error {
+	if schema == nil {
+		return nil
+	}
+	if parameters == nil {
+		parameters = map[string]interface{}{}
+	}
+	result, err := gojsonschema.Validate(gojsonschema.NewGoLoader(schema), gojsonschema.NewGoLoader(parameters))
+	if err != nil {
+		// A broken schema is the broker's problem, not the platform's.
+		glog.Errorf("failed to validate %s parameters: %v", what, err)
+		return nil
+	}
+	if result.Valid() {
+		return nil
+	}
+	var problems []string
+	for _, e := range result.Errors() {
+		problems = append(problems, e.String())
+	}
+	return badRequest("invalid %s parameters: %s", what, strings.Join(problems, "; "))
+}
+
+func instanceCreateSchema(plan *osb.Plan) interface{} {
+	if plan.Schemas == nil || plan.Schemas.ServiceInstance == nil || plan.Schemas.ServiceInstance.Create == nil {
+		return nil
+	}
+	return plan.Schemas.ServiceInstance.Create.Parameters
+}
+
+func instanceUpdateSchema(plan *osb.Plan) interface{} {
+	if plan.Schemas == nil || plan.Schemas.ServiceInstance == nil || plan.Schemas.ServiceInstance.Update == nil {
+		return nil
+	}
+	return plan.Schemas.ServiceInstance.Update.Parameters
+}
+
+func bindingCreateSchema(plan *osb.Plan) interface{} {
+	if plan.Schemas == nil || plan.Schemas.ServiceBinding == nil || plan.Schemas.ServiceBinding.Create == nil {
+		return nil
+	}
+	return plan.Schemas.ServiceBinding.Create.Parameters
+}
+
+func (b *BusinessLogic) validateProvision(request *osb.ProvisionRequest) error {
+	if err := requireIDs(requiredID{"instance_id", request.InstanceID}, requiredID{"service_id", request.ServiceID}, requiredID{"plan_id", request.PlanID}); err != nil {
+		return err
+	}
+	catalog := b.validationCatalog()
+	if catalog == nil {
+		return b.uncheckedPlan()
+	}
+	service, err := findService(catalog, request.ServiceID)
+	if err != nil {
+		return err
+	}
+	plan, err := findPlan(service, request.PlanID)
+	if err != nil {
+		return err
+	}
+	return validateParameters("provision", instanceCreateSchema(plan), request.Parameters)
+}
+
+func (b *BusinessLogic) validateUpdate(request *osb.UpdateInstanceRequest) error {
+	if err := requireIDs(requiredID{"instance_id", request.InstanceID}, requiredID{"service_id", request.ServiceID}); err != nil {
+		return err
+	}
+	catalog := b.validationCatalog()
+	if catalog == nil {
+		if request.PlanID != nil && *request.PlanID != "" {
+			return b.uncheckedPlan()
+		}
+		return nil
+	}
+	// The plan the inventory records for the instance is trusted over the
+	// previous values the platform says it had.
+	recorded := b.recordedPlan(request.InstanceID, request.ServiceID)
+	service, err := findService(catalog, request.ServiceID)
+	if err != nil {
+		if recorded != "" && (request.PlanID == nil || *request.PlanID == recorded) && b.hiddenPlan(request.ServiceID, recorded) {
+			// Instances of services the rules hide stay updateable, as
+			// long as they keep their plan.
+			return nil
+		}
+		return err
+	}
+
+	current := recorded
+	if current == "" && request.PreviousValues != nil {
+		current = request.PreviousValues.PlanID
+	}
+
+	planID := current
+	if request.PlanID != nil && *request.PlanID != "" {
+		planID = *request.PlanID
+		if current != "" && planID != current && (service.PlanUpdatable == nil || !*service.PlanUpdatable) {
+			return badRequest("the plans of service %s are not updateable", service.ID)
+		}
+	}
+	if planID == "" {
+		return nil
+	}
+	plan, err := findPlan(service, planID)
+	if err != nil {
+		if planID == recorded && b.hiddenPlan(service.ID, recorded) {
+			return nil
+		}
+		return err
+	}
+	return validateParameters("update", instanceUpdateSchema(plan), request.Parameters)
+}
+
+func (b *BusinessLogic) validateDeprovision(request *osb.DeprovisionRequest) error {
+	return requireIDs(requiredID{"instance_id", request.InstanceID}, requiredID{"service_id", request.ServiceID}, requiredID{"plan_id", request.PlanID})
+}
+
+func (b *BusinessLogic) validateBind(request *osb.BindRequest) error {
+	if err := requireIDs(requiredID{"instance_id", request.InstanceID}, requiredID{"binding_id", request.BindingID}, requiredID{"service_id", request.ServiceID}, requiredID{"plan_id", request.PlanID}); err != nil {
+		return err
+	}
+	catalog := b.validationCatalog()
+	if catalog == nil {
+		return nil
+	}
+	if request.PlanID == b.recordedPlan(request.InstanceID, request.ServiceID) && b.hiddenPlan(request.ServiceID, request.PlanID) {
+		// Instances of plans the rules hide can still be bound, the
+		// backend is left to check the request.
+		return nil
+	}
+	service, err := findService(catalog, request.ServiceID)
+	if err != nil {
+		return err
+	}
+	plan, err := findPlan(service, request.PlanID)
+	if err != nil {
+		return err
+	}
+	bindable := service.Bindable
+	if plan.Bindable != nil {
+		bindable = *plan.Bindable
+	}
+	if !bindable {
+		return badRequest("plan %s of service %s is not bindable", plan.ID, service.ID)
+	}
+	return validateParameters("bind", bindingCreateSchema(plan), request.Parameters)
+}
+
+func (b *BusinessLogic) validateUnbind(request *osb.UnbindRequest) error {
+	return requireIDs(requiredID{"instance_id", request.InstanceID}, requiredID{"binding_id", request.BindingID}, requiredID{"service_id", request.ServiceID}, requiredID{"plan_id", request.PlanID})
+}
+
+// uncheckedPlan is the outcome of validating a plan without a catalog: fine,
+// unless catalog rules hide plans that cannot be told apart without one.
+func (b *BusinessLogic) uncheckedPlan() error {
+	if b.rules == nil {
+		return nil
+	}
+	return catalogUnavailable()
+}
+
+// recordedPlan returns the plan the inventory records for the instance of
+// the service, or "" when it records none.
+func (b *BusinessLogic) recordedPlan(instanceID, serviceID string) string {
+	recordedService, planID := b.instanceIDs(instanceID)
+	if recordedService != serviceID {
+		return ""
+	}
+	return planID
+}
+
+// hiddenPlan tells whether the remote catalog has the plan, or any plan of
+// the service when planID is empty, that the served catalog hides.
+func (b *BusinessLogic) hiddenPlan(serviceID, planID string) bool {
+	served, _, _ := b.catalogs.get()
+	remote := b.catalogs.getRemote()
+	if served == nil || remote == nil {
+		return false
+	}
+	service, err := findService(remote, serviceID)
+	if err != nil {
+		return false
+	}
+	for _, plan := range service.Plans {
+		if planID != "" && plan.ID != planID {
+			continue
+		}
+		if s, err := findService(served, serviceID); err != nil {
+			return true
+		} else if _, err := findPlan(s, plan.ID); err != nil {
+			return true
+		}
+	}
+	return false
+}
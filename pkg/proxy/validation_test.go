@@ -0,0 +1,191 @@
+package proxy
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/n3wscott/k8s-broker-proxy/pkg/inventory"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+)
+
+func TestValidateProvision(t *testing.T) {
+	catalog := testCatalog()
+	catalog.Services[0].Plans[0].Schemas = &osb.Schemas{
+		ServiceInstance: &osb.ServiceInstanceSchema{
+			Create: &osb.InputParametersSchema{Parameters: map[string]interface{}{
+				"type":     "object",
+				"required": []interface{}{"size"},
+				"properties": map[string]interface{}{
+					"size": map[string]interface{}{"type": "integer"},
+				},
+			}},
+		},
+	}
+	b := &BusinessLogic{}
+	b.catalogs.set(nil, catalog, catalog, nil)
+
+	cases := []struct {
+		name    string
+		request osb.ProvisionRequest
+		valid   bool
+	}{
+		{name: "valid", request: osb.ProvisionRequest{InstanceID: "i", ServiceID: "service", PlanID: "plan", Parameters: map[string]interface{}{"size": 3}}, valid: true},
+		{name: "no service", request: osb.ProvisionRequest{InstanceID: "i", PlanID: "plan"}},
+		{name: "unknown plan", request: osb.ProvisionRequest{InstanceID: "i", ServiceID: "service", PlanID: "other"}},
+		{name: "missing parameter", request: osb.ProvisionRequest{InstanceID: "i", ServiceID: "service", PlanID: "plan"}},
+		{name: "wrong type", request: osb.ProvisionRequest{InstanceID: "i", ServiceID: "service", PlanID: "plan", Parameters: map[string]interface{}{"size": "big"}}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := b.validateProvision(&tc.request)
+			if tc.valid {
+				if err != nil {
+					t.Errorf("unexpected error %v", err)
+				}
+				return
+			}
+			if httpErr, ok := osb.IsHTTPError(err); !ok || httpErr.StatusCode != http.StatusBadRequest {
+				t.Errorf("expected 400, got %v", err)
+			}
+		})
+	}
+}
+
+func TestValidateBind(t *testing.T) {
+	catalog := testCatalog()
+	notBindable := false
+	catalog.Services[0].Plans = append(catalog.Services[0].Plans, osb.Plan{ID: "unbindable", Name: "unbindable", Description: "unbindable", Bindable: &notBindable})
+	catalog.Services[0].Plans[0].Schemas = &osb.Schemas{
+		ServiceBinding: &osb.ServiceBindingSchema{
+			Create: &osb.RequestResponseSchema{InputParametersSchema: osb.InputParametersSchema{Parameters: map[string]interface{}{
+				"type":     "object",
+				"required": []interface{}{"role"},
+				"properties": map[string]interface{}{
+					"role": map[string]interface{}{"type": "string"},
+				},
+			}}},
+		},
+	}
+	b := &BusinessLogic{inventory: inventory.NewMemoryStore()}
+	b.catalogs.set(nil, catalog, catalog, nil)
+
+	cases := []struct {
+		name    string
+		request osb.BindRequest
+		valid   bool
+	}{
+		{name: "valid", request: osb.BindRequest{InstanceID: "i", BindingID: "b", ServiceID: "service", PlanID: "plan", Parameters: map[string]interface{}{"role": "reader"}}, valid: true},
+		{name: "no binding", request: osb.BindRequest{InstanceID: "i", ServiceID: "service", PlanID: "plan", Parameters: map[string]interface{}{"role": "reader"}}},
+		{name: "plan not bindable", request: osb.BindRequest{InstanceID: "i", BindingID: "b", ServiceID: "service", PlanID: "unbindable"}},
+		{name: "missing parameter", request: osb.BindRequest{InstanceID: "i", BindingID: "b", ServiceID: "service", PlanID: "plan"}},
+		{name: "wrong type", request: osb.BindRequest{InstanceID: "i", BindingID: "b", ServiceID: "service", PlanID: "plan", Parameters: map[string]interface{}{"role": 1}}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := b.validateBind(&tc.request)
+			if tc.valid {
+				if err != nil {
+					t.Errorf("unexpected error %v", err)
+				}
+				return
+			}
+			if httpErr, ok := osb.IsHTTPError(err); !ok || httpErr.StatusCode != http.StatusBadRequest {
+				t.Errorf("expected 400, got %v", err)
+			}
+		})
+	}
+}
+
+func TestValidateUpdateHonorsPlanUpdateable(t *testing.T) {
+	catalog := testCatalog()
+	catalog.Services[0].Plans = append(catalog.Services[0].Plans, osb.Plan{ID: "bigger", Name: "bigger", Description: "bigger"})
+	b := &BusinessLogic{inventory: inventory.NewMemoryStore()}
+	b.catalogs.set(nil, catalog, catalog, nil)
+
+	bigger := "bigger"
+	request := &osb.UpdateInstanceRequest{
+		InstanceID:     "i",
+		ServiceID:      "service",
+		PlanID:         &bigger,
+		PreviousValues: &osb.PreviousValues{PlanID: "plan"},
+	}
+	if err := b.validateUpdate(request); err == nil {
+		t.Error("expected a plan change to be rejected")
+	}
+
+	updatable := true
+	catalog.Services[0].PlanUpdatable = &updatable
+	if err := b.validateUpdate(request); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestValidateUpdateTrustsTheInventory(t *testing.T) {
+	catalog := testCatalog()
+	catalog.Services[0].Plans = append(catalog.Services[0].Plans, osb.Plan{ID: "bigger", Name: "bigger", Description: "bigger"})
+	b := &BusinessLogic{inventory: inventory.NewMemoryStore()}
+	b.catalogs.set(nil, catalog, catalog, nil)
+	if err := b.inventory.PutInstance(&inventory.Instance{ID: "i", ServiceID: "service", PlanID: "plan"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The platform cannot skip the plan updateable check by claiming the
+	// instance already has the plan it asks for.
+	bigger := "bigger"
+	request := &osb.UpdateInstanceRequest{
+		InstanceID:     "i",
+		ServiceID:      "service",
+		PlanID:         &bigger,
+		PreviousValues: &osb.PreviousValues{PlanID: "bigger"},
+	}
+	if err := b.validateUpdate(request); err == nil {
+		t.Error("expected a plan change to be rejected despite the previous values")
+	}
+}
+
+func TestHiddenPlansNeedTheInventory(t *testing.T) {
+	b := newTestBusinessLogic(t, slowBroker{})
+	b.rules = loadRules(t, `{"deny": [{"plan": "legacy"}]}`)
+	cacheTestCatalog(t, b, overlayTestCatalog())
+	if err := b.inventory.PutInstance(&inventory.Instance{ID: "recorded", ServiceID: "service", PlanID: "legacy"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.inventory.PutInstance(&inventory.Instance{ID: "other", ServiceID: "service", PlanID: "plan"}); err != nil {
+		t.Fatal(err)
+	}
+	legacy := "legacy"
+
+	cases := []struct {
+		name string
+		err  error
+	}{
+		{
+			name: "update claiming a hidden previous plan",
+			err:  b.validateUpdate(&osb.UpdateInstanceRequest{InstanceID: "unknown", ServiceID: "service", PlanID: &legacy, PreviousValues: &osb.PreviousValues{PlanID: "legacy"}}),
+		},
+		{
+			name: "update of another instance to a hidden plan",
+			err:  b.validateUpdate(&osb.UpdateInstanceRequest{InstanceID: "other", ServiceID: "service", PlanID: &legacy, PreviousValues: &osb.PreviousValues{PlanID: "legacy"}}),
+		},
+		{
+			name: "bind of an unknown instance of a hidden plan",
+			err:  b.validateBind(&osb.BindRequest{InstanceID: "unknown", BindingID: "binding", ServiceID: "service", PlanID: "legacy"}),
+		},
+		{
+			name: "bind of another instance with a hidden plan",
+			err:  b.validateBind(&osb.BindRequest{InstanceID: "other", BindingID: "binding", ServiceID: "service", PlanID: "legacy"}),
+		},
+	}
+	for _, tc := range cases {
+		if httpErr, ok := osb.IsHTTPError(tc.err); !ok || httpErr.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %v", tc.name, tc.err)
+		}
+	}
+
+	if err := b.validateUpdate(&osb.UpdateInstanceRequest{InstanceID: "recorded", ServiceID: "service", PlanID: &legacy}); err != nil {
+		t.Errorf("expected an instance of a hidden plan to stay updateable, got %v", err)
+	}
+	if err := b.validateBind(&osb.BindRequest{InstanceID: "recorded", BindingID: "binding", ServiceID: "service", PlanID: "legacy"}); err != nil {
+		t.Errorf("expected an instance of a hidden plan to stay bindable, got %v", err)
+	}
+}